@@ -46,7 +46,9 @@ func (f *appendRequesterFactory) GetRequester(number uint64) bench.Requester {
 		opts:   f.opts,
 		output: f.output,
 		newStore: func() (wal.LogStore, error) {
-			return wal.Open(f.opts.dir, wal.WithSegmentSize(f.opts.segSize*1024*1024))
+			// A zero threshold leaves preallocation disabled.
+			return wal.Open(f.opts.dir, wal.WithSegmentSize(f.opts.segSize*1024*1024),
+				wal.WithSegmentPreallocation(f.opts.prealloc), wal.WithFSOptions(f.opts.fsOpts))
 		},
 	}
 }
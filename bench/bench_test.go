@@ -10,9 +10,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/stretchr/testify/require"
 
 	"github.com/polarsignals/wal"
+	"github.com/polarsignals/wal/fs"
 	"github.com/polarsignals/wal/types"
 )
 
@@ -81,6 +83,63 @@ func runAppendBench(b *testing.B, ls wal.LogStore, s, n int) {
 	}
 }
 
+func BenchmarkRotation(b *testing.B) {
+	// 64KiB entries into 4MiB segments rotate about every 64 appends. Writers
+	// wait for the rotation to complete so its cost shows up in the latency of
+	// the append after it. That's fewer than 2% of appends so it's reported as
+	// the p99 append latency while p50 is a plain append.
+	for _, prealloc := range []float64{0, 0.5} {
+		b.Run(fmt.Sprintf("prealloc=%g/v=WAL", prealloc), func(b *testing.B) {
+			tmpDir, err := os.MkdirTemp("", "raft-wal-bench-*")
+			require.NoError(b, err)
+			defer os.RemoveAll(tmpDir)
+
+			ls, err := wal.Open(tmpDir, wal.WithSegmentSize(4*1024*1024), wal.WithSegmentPreallocation(prealloc))
+			require.NoError(b, err)
+			defer ls.Close()
+
+			h := hdrhistogram.New(1, int64(time.Second), 3)
+			batch := []types.LogEntry{{Data: randomData[:64*1024]}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch[0].Index = uint64(i + 1)
+				start := time.Now()
+				err := ls.StoreLogs(batch)
+				h.RecordValue(int64(time.Since(start)))
+				if err != nil {
+					b.Fatalf("error appending: %s", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(h.ValueAtQuantile(50)), "p50-ns")
+			b.ReportMetric(float64(h.ValueAtQuantile(99)), "p99-ns")
+		})
+	}
+}
+
+func BenchmarkSyncModes(b *testing.B) {
+	for _, opts := range []fs.Options{
+		{Sync: fs.SyncFull},
+		{Sync: fs.SyncData},
+		{Sync: fs.SyncDSync},
+		{Sync: fs.SyncData, DirectIO: true},
+	} {
+		b.Run(fmt.Sprintf("sync=%s/direct=%v/v=WAL", opts.Sync, opts.DirectIO), func(b *testing.B) {
+			if _, err := fs.NewWithOptions(opts); err != nil {
+				b.Skip(err)
+			}
+			tmpDir, err := os.MkdirTemp("", "raft-wal-bench-*")
+			require.NoError(b, err)
+			defer os.RemoveAll(tmpDir)
+
+			ls, err := wal.Open(tmpDir, wal.WithFSOptions(opts))
+			require.NoError(b, err)
+			defer ls.Close()
+			runAppendBench(b, ls, 1024, 10)
+		})
+	}
+}
+
 func BenchmarkGetLogs(b *testing.B) {
 	sizes := []int{
 		1000,
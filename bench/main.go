@@ -16,6 +16,7 @@ import (
 
 	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/benmathews/bench"
+	"github.com/polarsignals/wal/fs"
 	"github.com/polarsignals/wal/metadb"
 )
 
@@ -25,6 +26,8 @@ type opts struct {
 	dir            string
 	segSize        int
 	noFreelistSync bool
+	prealloc       float64
+	fsOpts         fs.Options
 
 	// Common params
 	preLoadN int
@@ -53,8 +56,17 @@ func main() {
 	flag.DurationVar(&o.truncatePeriod, "tp", 0, "how often to head truncate back to 'trail' logs during append")
 	flag.IntVar(&o.preLoadN, "preload", 0, "number of logs to append and then truncate before we start")
 	flag.BoolVar(&o.noFreelistSync, "no-fl-sync", false, "used to disable freelist sync in boltdb for v=bolt")
+	flag.Float64Var(&o.prealloc, "prealloc", 0, "preallocate the next segment in the background once this fraction of the tail is full. 0 disables it")
+	syncMode := flag.String("sync", "fsync", "how appends are made durable: fsync, fdatasync or dsync")
+	flag.BoolVar(&o.fsOpts.DirectIO, "direct", false, "write segments with O_DIRECT")
 	flag.Parse()
 
+	mode, err := parseSyncMode(*syncMode)
+	if err != nil {
+		panic(err)
+	}
+	o.fsOpts.Sync = mode
+
 	var outBuf bytes.Buffer
 	teeOut := io.MultiWriter(os.Stdout, &outBuf)
 
@@ -109,9 +121,22 @@ func outFileName(o opts, suffix string) string {
 	if o.version == "bolt" && o.noFreelistSync {
 		version += "-nfls"
 	}
-	return fmt.Sprintf("bench-result-%s-s%d-n%d-r%d-seg%dm-pre%d-trail%d-tp%s/%s-%s.txt",
+	direct := ""
+	if o.fsOpts.DirectIO {
+		direct = "-direct"
+	}
+	return fmt.Sprintf("bench-result-%s-s%d-n%d-r%d-seg%dm-pre%d-trail%d-tp%s-pa%g-%s%s/%s-%s.txt",
 		o.duration, o.logSize, o.batchSize, o.rate, o.segSize, o.preLoadN,
-		o.truncateTrailingLogs, o.truncatePeriod, version, suffix)
+		o.truncateTrailingLogs, o.truncatePeriod, o.prealloc, o.fsOpts.Sync, direct, version, suffix)
+}
+
+func parseSyncMode(s string) (fs.SyncMode, error) {
+	for _, m := range []fs.SyncMode{fs.SyncFull, fs.SyncData, fs.SyncDSync} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync mode %q", s)
 }
 
 func printHistogram(f io.Writer, name string, h *hdrhistogram.Histogram, scale int64) {
@@ -3,40 +3,110 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/polarsignals/wal/codec"
 	"github.com/polarsignals/wal/fs"
 	"github.com/polarsignals/wal/segment"
 	"github.com/polarsignals/wal/types"
 )
 
 type opts struct {
-	Dir    string
-	After  uint64
-	Before uint64
+	Dir         string
+	After       uint64
+	Before      uint64
+	Codec       string
+	Quarantined bool
+	Restore     string
+}
+
+type entry struct {
+	Index   uint64
+	Segment uint64
+	Data    any
+}
+
+type quarantined struct {
+	Name      string
+	Time      time.Time
+	Segment   uint64
+	BaseIndex uint64
 }
 
 func main() {
 	var o opts
 	flag.Uint64Var(&o.After, "after", 0, "specified an index to use as an exclusive lower bound when dumping log entries.")
 	flag.Uint64Var(&o.Before, "before", 0, "specified an index to use as an exclusive upper bound when dumping log entries.")
+	flag.StringVar(&o.Codec, "codec", "", "decode entry data with the named codec. Only json is supported. If not set data is output as base64.")
+	flag.BoolVar(&o.Quarantined, "quarantined", false, "list the segment files in the quarantine directory instead of dumping log entries.")
+	flag.StringVar(&o.Restore, "restore", "", "move the named quarantined segment file back into the WAL dir instead of dumping log entries.")
 
 	flag.Parse()
 
 	// Accept dir as positional arg
 	o.Dir = flag.Arg(0)
 	if o.Dir == "" {
-		fmt.Println("Usage: waldump [-after INDEX] [-before INDEX] <path to WAL dir>")
+		fmt.Println("Usage: waldump [-after INDEX] [-before INDEX] [-codec NAME] <path to WAL dir>")
+		fmt.Println("       waldump -quarantined <path to WAL dir>")
+		fmt.Println("       waldump -restore FILE <path to WAL dir>")
 		os.Exit(1)
 	}
 
 	vfs := fs.New()
 	f := segment.NewFiler(o.Dir, vfs)
+	enc := json.NewEncoder(os.Stdout)
+
+	switch {
+	case o.Quarantined:
+		qfs, err := f.ListQuarantined()
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		for _, qf := range qfs {
+			out := quarantined{Name: qf.Name, Time: qf.Time, Segment: qf.Segment.ID, BaseIndex: qf.Segment.BaseIndex}
+			if err := enc.Encode(out); err != nil {
+				fmt.Printf("ERROR: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		return
+	case o.Restore != "":
+		info, err := f.RestoreQuarantined(o.Restore)
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %s\n", segment.FileName(info))
+		return
+	}
+
+	var dec codec.Codec[any]
+	switch o.Codec {
+	case "":
+	case "json":
+		dec = codec.JSON[any]{}
+	default:
+		fmt.Printf("ERROR: unknown codec %q\n", o.Codec)
+		os.Exit(1)
+	}
 
 	err := f.DumpLogs(o.After, o.Before, func(info types.SegmentInfo, e types.LogEntry) (bool, error) {
-		fmt.Println("TODO: decode bytes:", e.Data)
+		out := entry{Index: e.Index, Segment: info.ID, Data: e.Data}
+		if dec != nil {
+			v, err := dec.Decode(e.Data)
+			if err != nil {
+				return false, &codec.DecodeError{Index: e.Index, SegmentID: info.ID, Err: err}
+			}
+			out.Data = v
+		}
+		if err := enc.Encode(out); err != nil {
+			return false, err
+		}
 		return true, nil
 	})
 	if err != nil {
@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package codec provides encodings for storing typed values in WAL entries.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec encodes values of type T to and from WAL entry data. Implementations
+// must be safe for concurrent use.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// DecodeError is returned when an entry's data can't be decoded. It records
+// where the entry is so the bad data can be found with waldump.
+type DecodeError struct {
+	Index     uint64
+	SegmentID uint64
+	Err       error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode entry %d in segment %d: %s", e.Index, e.SegmentID, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// JSON encodes values with encoding/json.
+type JSON[T any] struct{}
+
+// Encode implements Codec.
+func (JSON[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Decode implements Codec.
+func (JSON[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// Gob encodes values with encoding/gob. Each entry is a self-contained gob
+// stream so it carries its own type information which makes entries larger than
+// with the other codecs.
+type Gob[T any] struct{}
+
+// Encode implements Codec.
+func (Gob[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode implements Codec.
+func (Gob[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
@@ -0,0 +1,65 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package codec
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type event struct {
+	Name  string
+	Count int
+}
+
+func TestCodecs(t *testing.T) {
+	want := event{Name: "hello", Count: 3}
+
+	t.Run("json", func(t *testing.T) {
+		var c Codec[event] = JSON[event]{}
+		raw, err := c.Encode(want)
+		require.NoError(t, err)
+		got, err := c.Decode(raw)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+
+		_, err = c.Decode([]byte("{"))
+		require.Error(t, err)
+	})
+
+	t.Run("gob", func(t *testing.T) {
+		var c Codec[event] = Gob[event]{}
+		raw, err := c.Encode(want)
+		require.NoError(t, err)
+		got, err := c.Decode(raw)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+
+		_, err = c.Decode(raw[:len(raw)/2])
+		require.Error(t, err)
+	})
+
+	t.Run("proto", func(t *testing.T) {
+		var c Codec[*wrapperspb.StringValue] = Proto[*wrapperspb.StringValue]{}
+		raw, err := c.Encode(wrapperspb.String("hello"))
+		require.NoError(t, err)
+		got, err := c.Decode(raw)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(wrapperspb.String("hello"), got))
+
+		_, err = c.Decode([]byte{0xff})
+		require.Error(t, err)
+	})
+}
+
+func TestDecodeError(t *testing.T) {
+	cause := errors.New("boom")
+	var err error = &DecodeError{Index: 12, SegmentID: 3, Err: cause}
+	require.EqualError(t, err, "failed to decode entry 12 in segment 3: boom")
+	require.ErrorIs(t, err, cause)
+}
@@ -0,0 +1,29 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package codec
+
+import (
+	"google.golang.org/protobuf/proto"
+)
+
+// Proto encodes protobuf messages in the binary wire format. T must be the
+// pointer type of a generated message, e.g. Proto[*pb.Event].
+type Proto[T proto.Message] struct{}
+
+// Encode implements Codec.
+func (Proto[T]) Encode(v T) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+// Decode implements Codec.
+func (Proto[T]) Decode(data []byte) (T, error) {
+	// Generated messages report their type even through a nil pointer so we can
+	// allocate a new one without the caller providing a constructor.
+	var zero T
+	v := zero.ProtoReflect().Type().New().Interface().(T)
+	if err := proto.Unmarshal(data, v); err != nil {
+		return zero, err
+	}
+	return v, nil
+}
@@ -0,0 +1,305 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"errors"
+	"io"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// compactionPolicy configures background rewriting of sealed segments.
+type compactionPolicy struct {
+	// head enables rewriting the first segment once the entries truncated from
+	// its front are estimated to take up at least minReclaim bytes.
+	head       bool
+	minReclaim uint64
+
+	// mergeBelow enables merging adjacent sealed segments smaller than this
+	// many bytes. Zero disables merging.
+	mergeBelow uint64
+}
+
+func (p compactionPolicy) enabled() bool {
+	return p.head || p.mergeBelow > 0
+}
+
+// segmentMerger is implemented by SegmentFilers that can copy the entries left
+// in one or more adjacent sealed segments into a new segment file, such as
+// segment.Filer.
+type segmentMerger interface {
+	Merge(from []types.SegmentInfo, to types.SegmentInfo) (types.SegmentInfo, error)
+}
+
+// errCompactionStale is returned from the swap transaction when one of the
+// segments being rewritten was removed from the log while it was being copied.
+var errCompactionStale = errors.New("rewritten segment is no longer in the log")
+
+// triggerCompaction wakes the compaction goroutine if compaction or merging
+// are enabled. It never blocks so it's safe to call with the write lock held.
+func (w *WAL) triggerCompaction() {
+	if w.compactCh == nil {
+		return
+	}
+	select {
+	case w.compactCh <- struct{}{}:
+	default:
+		// Already pending
+	}
+}
+
+// runCompaction compacts the head segment and merges small segments each time
+// it's triggered until the WAL is closed.
+func (w *WAL) runCompaction() {
+	for {
+		select {
+		case <-w.shutdownCh:
+			return
+		case <-w.compactCh:
+			if err := w.compact(); err != nil && err != ErrClosed {
+				level.Error(w.logger).Log("msg", "segment compaction failed", "err", err)
+			}
+		}
+	}
+}
+
+func (w *WAL) compact() error {
+	if w.compaction.head {
+		if err := w.compactHead(); err != nil {
+			return err
+		}
+	}
+	if w.compaction.mergeBelow > 0 {
+		// Keep going while there is anything left to merge.
+		for {
+			merged, err := w.mergeSegments()
+			if err != nil || !merged {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compactHead rewrites the first segment of the log without the entries that
+// were truncated from its front if that would reclaim at least the configured
+// number of bytes.
+func (w *WAL) compactHead() error {
+	from, err := w.pickSegments(func(s *state) []segmentState {
+		seg, ok := compactionCandidate(s, w.compaction.minReclaim)
+		if !ok {
+			return nil
+		}
+		return []segmentState{seg}
+	})
+	if err != nil || from == nil {
+		return err
+	}
+	to, err := w.replaceSegments(from)
+	if err != nil {
+		return err
+	}
+	if to != nil {
+		w.metrics.SegmentCompactions.Inc()
+		// The old size may only be an estimate if it was sealed by an older
+		// version.
+		if before, after := sealedSegmentSize(from[0]), to.Size; before > after {
+			w.metrics.CompactionBytesReclaimed.Add(float64(before - after))
+		}
+	}
+	return nil
+}
+
+// mergeSegments merges the first run of small adjacent sealed segments into a
+// single segment. It returns true if segments were merged.
+func (w *WAL) mergeSegments() (bool, error) {
+	from, err := w.pickSegments(func(s *state) []segmentState {
+		return mergeCandidates(s, w.compaction.mergeBelow, uint64(w.segmentSize))
+	})
+	if err != nil || from == nil {
+		return false, err
+	}
+	to, err := w.replaceSegments(from)
+	if err != nil || to == nil {
+		return false, err
+	}
+	w.metrics.SegmentMerges.Inc()
+	return true, nil
+}
+
+// pickSegments calls pick with the current state under the write lock.
+func (w *WAL) pickSegments(pick func(s *state) []segmentState) ([]segmentState, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	return pick(w.loadState()), nil
+}
+
+// replaceSegments copies the remaining entries of the adjacent sealed segments
+// in from into a single new segment and swaps it into the log in their place.
+// The entries are copied without holding the write lock and the old segments
+// stay readable until the new one is swapped in. They are only closed and
+// deleted once all readers that might be using them are done. It returns the
+// info of the new segment or nil if the old segments were truncated away in
+// the meantime.
+func (w *WAL) replaceSegments(from []segmentState) (*types.SegmentInfo, error) {
+	first, last := from[0], from[len(from)-1]
+	infos := make([]types.SegmentInfo, 0, len(from))
+	for _, seg := range from {
+		infos = append(infos, seg.SegmentInfo)
+	}
+
+	// Reserve an ID for the new segment. Committing it before the file exists
+	// means the file can't be confused with a segment created later if we crash
+	// part way through.
+	to := types.SegmentInfo{
+		BaseIndex:  first.MinIndex,
+		MinIndex:   first.MinIndex,
+		MaxIndex:   last.MaxIndex,
+		SizeLimit:  first.SizeLimit,
+		CreateTime: first.CreateTime,
+		SealTime:   last.SealTime,
+	}
+	if len(from) > 1 {
+		to.SizeLimit = uint64(w.segmentSize)
+	}
+	w.writeMu.Lock()
+	err := w.checkClosed()
+	if err == nil {
+		err = w.mutateStateLocked(func(newState *state) (func(), func() error, error) {
+			to.ID = newState.nextSegmentID
+			newState.nextSegmentID++
+			return nil, nil, nil
+		})
+	}
+	w.writeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Holding the state stops a concurrent truncation from deleting the old
+	// files while we copy them.
+	_, release := w.acquireState()
+	to, err = w.sf.(segmentMerger).Merge(infos, to)
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := w.sf.Open(to)
+	if err != nil {
+		// Any file left behind is deleted as an orphan on the next Open.
+		w.sf.Delete(to.BaseIndex, to.ID)
+		return nil, err
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	err = w.checkClosed()
+	if err == nil {
+		err = w.mutateStateLocked(func(newState *state) (func(), func() error, error) {
+			toClose := make([]io.Closer, 0, len(from))
+			toDelete := make(map[uint64]types.SegmentInfo, len(from))
+			for i, seg := range from {
+				cur, ok := newState.segments.Get(seg.BaseIndex)
+				if !ok || cur.ID != seg.ID || cur.SealTime.IsZero() || cur.MaxIndex < cur.MinIndex {
+					return nil, nil, errCompactionStale
+				}
+				// Truncations might have moved the first segment's MinIndex or the
+				// last one's MaxIndex while we were copying. The new file still has
+				// every entry left in the segments.
+				if i == 0 {
+					if cur.MinIndex < to.BaseIndex {
+						return nil, nil, errCompactionStale
+					}
+					to.MinIndex = cur.MinIndex
+				}
+				if i == len(from)-1 {
+					to.MaxIndex = cur.MaxIndex
+				}
+				toClose = append(toClose, cur.r)
+				toDelete[cur.ID] = cur.SegmentInfo
+				newState.segments = newState.segments.Delete(cur.BaseIndex)
+			}
+			newState.segments = newState.segments.Set(to.BaseIndex, segmentState{SegmentInfo: to, r: r})
+
+			fin := func() {
+				w.closeSegments(toClose)
+				w.deleteSegments(toDelete)
+			}
+			return fin, nil, nil
+		})
+	}
+	if err != nil {
+		w.closeSegments([]io.Closer{r})
+		w.sf.Delete(to.BaseIndex, to.ID)
+		if err == errCompactionStale {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &to, nil
+}
+
+// compactionCandidate returns the first segment of the log if it's sealed and
+// the entries truncated from its front are estimated to take up at least
+// minReclaim bytes. Only the first segment can have truncated entries since
+// front truncations delete whole segments before it.
+func compactionCandidate(s *state, minReclaim uint64) (segmentState, bool) {
+	it := s.segments.Iterator()
+	if it.Done() {
+		return segmentState{}, false
+	}
+	_, seg, _ := it.Next()
+	if seg.SealTime.IsZero() || seg.MinIndex <= seg.BaseIndex || seg.MaxIndex < seg.MinIndex {
+		return seg, false
+	}
+	// Assume entries are all about the same size.
+	total := seg.MaxIndex - seg.BaseIndex + 1
+	dead := seg.MinIndex - seg.BaseIndex
+	reclaim := float64(sealedSegmentSize(seg)) * float64(dead) / float64(total)
+	return seg, reclaim >= float64(minReclaim)
+}
+
+// mergeCandidates returns the first run of at least two adjacent sealed
+// segments that are each smaller than smallSize and together no larger than
+// maxSize, or nil if there is none.
+func mergeCandidates(s *state, smallSize, maxSize uint64) []segmentState {
+	var run []segmentState
+	var runSize uint64
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if seg.SealTime.IsZero() {
+			// The tail, and so the end of the sealed segments.
+			break
+		}
+		size := sealedSegmentSize(seg)
+		if size >= smallSize || seg.MaxIndex < seg.MinIndex {
+			if len(run) > 1 {
+				return run
+			}
+			run, runSize = nil, 0
+			continue
+		}
+		if runSize+size > maxSize {
+			if len(run) > 1 {
+				return run
+			}
+			// Start a new run from this segment.
+			run, runSize = nil, 0
+		}
+		run = append(run, seg)
+		runSize += size
+	}
+	if len(run) > 1 {
+		return run
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/segment"
+	"github.com/polarsignals/wal/types"
+)
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, WithSegmentSize(8*1024), WithCompaction(1024))
+	require.NoError(t, err)
+
+	for i := uint64(1); i <= 500; i += 10 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(i, 10)))
+	}
+	segs := w.loadState().Persistent().Segments
+	require.GreaterOrEqual(t, len(segs), 2)
+	head := segs[0]
+
+	// Truncating just a few entries isn't worth a rewrite.
+	require.NoError(t, w.TruncateFront(head.BaseIndex+5))
+	_, ok := compactionCandidate(w.loadState(), 1024)
+	require.False(t, ok)
+
+	// Keep reading the remaining entries of the head segment throughout so we
+	// catch it being unreadable during the swap.
+	newMin := head.MaxIndex - 10
+	stop := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		var le types.LogEntry
+		for {
+			for i := newMin; i <= head.MaxIndex; i++ {
+				select {
+				case <-stop:
+					readErr <- nil
+					return
+				default:
+				}
+				if err := w.GetLog(i, &le); err != nil {
+					readErr <- err
+					return
+				}
+			}
+		}
+	}()
+
+	// Truncate most of the head segment.
+	require.NoError(t, w.TruncateFront(newMin))
+
+	var compacted types.SegmentInfo
+	require.Eventually(t, func() bool {
+		compacted = w.loadState().Persistent().Segments[0]
+		return compacted.ID != head.ID
+	}, 5*time.Second, 10*time.Millisecond)
+	close(stop)
+	require.NoError(t, <-readErr)
+	require.Equal(t, 1.0, testutil.ToFloat64(w.metrics.SegmentCompactions))
+
+	require.Equal(t, newMin, compacted.BaseIndex)
+	require.Equal(t, newMin, compacted.MinIndex)
+	require.Equal(t, head.MaxIndex, compacted.MaxIndex)
+	require.Equal(t, head.SealTime, compacted.SealTime)
+
+	// The old file is gone and the new one only holds the remaining entries.
+	_, err = os.Stat(filepath.Join(dir, segment.FileName(head)))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	fi, err := os.Stat(filepath.Join(dir, segment.FileName(compacted)))
+	require.NoError(t, err)
+	require.Less(t, fi.Size(), int64(2*1024))
+	require.Equal(t, uint64(fi.Size()), compacted.Size)
+	require.Equal(t, float64(head.Size-compacted.Size), testutil.ToFloat64(w.metrics.CompactionBytesReclaimed))
+
+	check := func(w *WAL) {
+		t.Helper()
+		var le types.LogEntry
+		require.ErrorIs(t, w.GetLog(newMin-1, &le), ErrNotFound)
+		for i := newMin; i <= 500; i++ {
+			require.NoError(t, w.GetLog(i, &le))
+			validateLogEntry(t, le)
+		}
+	}
+	check(w)
+	require.NoError(t, w.Close())
+
+	w, err = Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+	check(w)
+}
+
+func TestCompactionRequiresRewriter(t *testing.T) {
+	_, err := Open(t.TempDir(), WithCompaction(1024), WithSegmentFiler(struct{ types.SegmentFiler }{}))
+	require.ErrorContains(t, err, "can rewrite segments")
+}
+
+func TestSegmentMerging(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, WithSegmentSize(8*1024), WithSegmentMerging(4*1024))
+	require.NoError(t, err)
+
+	// Each TruncateBack seals the tail leaving a small segment behind.
+	next := uint64(1)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.StoreLogs(makeLogEntries(next, 10)))
+		require.NoError(t, w.TruncateBack(next+8))
+		next += 9
+	}
+	require.NoError(t, w.StoreLogs(makeLogEntries(next, 5)))
+	last := next + 4
+
+	// Keep reading throughout so we catch entries being unreadable during the
+	// swap.
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopReader := func() { stopOnce.Do(func() { close(stop) }) }
+	defer stopReader()
+	readErr := make(chan error, 1)
+	go func() {
+		var le types.LogEntry
+		for {
+			for i := uint64(1); i <= last; i++ {
+				select {
+				case <-stop:
+					readErr <- nil
+					return
+				default:
+				}
+				if err := w.GetLog(i, &le); err != nil {
+					readErr <- err
+					return
+				}
+			}
+		}
+	}()
+
+	var segs []types.SegmentInfo
+	require.Eventually(t, func() bool {
+		segs = w.loadState().Persistent().Segments
+		return len(segs) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	stopReader()
+	require.NoError(t, <-readErr)
+	require.GreaterOrEqual(t, testutil.ToFloat64(w.metrics.SegmentMerges), 1.0)
+
+	merged := segs[0]
+	require.Equal(t, uint64(1), merged.BaseIndex)
+	require.Equal(t, uint64(1), merged.MinIndex)
+	require.Equal(t, next-1, merged.MaxIndex)
+	require.False(t, merged.SealTime.IsZero())
+	require.NotZero(t, merged.Size)
+	require.LessOrEqual(t, merged.Size, merged.SizeLimit)
+
+	// Only the merged segment and the tail are left on disk.
+	files, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	check := func(w *WAL) {
+		t.Helper()
+		var le types.LogEntry
+		for i := uint64(1); i <= last; i++ {
+			require.NoError(t, w.GetLog(i, &le))
+			validateLogEntry(t, le)
+		}
+		got, err := w.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, last, got)
+	}
+	check(w)
+	require.NoError(t, w.Close())
+
+	w, err = Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+	check(w)
+}
+
+func TestMergeCandidates(t *testing.T) {
+	// Each full test segment has 100 entries of 4 bytes so is 400 bytes.
+	_, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segFull(), segFull(), segTail(10)}, nil, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	s := w.loadState()
+	require.Nil(t, mergeCandidates(s, 400, 1000))
+
+	run := mergeCandidates(s, 401, 1000)
+	require.Len(t, run, 2)
+	require.Equal(t, uint64(1), run[0].BaseIndex)
+	require.Equal(t, uint64(101), run[1].BaseIndex)
+
+	run = mergeCandidates(s, 401, 10000)
+	require.Len(t, run, 3)
+
+	require.Nil(t, mergeCandidates(s, 401, 799))
+}
+
+func TestMergeCandidatesTruncatedSegments(t *testing.T) {
+	// A segment sealed by TruncateBack after most of it was written has few
+	// entries but is as big as a full one so mustn't be merged.
+	_, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segTruncated(10, 8000), segFull(), segFull(), segTail(10)}, nil, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	s := w.loadState()
+	run := mergeCandidates(s, 1000, 1000)
+	require.Len(t, run, 2)
+	require.Equal(t, uint64(111), run[0].BaseIndex)
+	require.Equal(t, uint64(211), run[1].BaseIndex)
+}
+
+// segTruncated adds a sealed segment with n entries that takes up size bytes on
+// disk.
+func segTruncated(n int, size uint64) testStorageOpt {
+	return func(ts *testStorage) {
+		segFull()(ts)
+		last := len(ts.metaState.Segments) - 1
+		info := ts.metaState.Segments[last]
+		info.MaxIndex = info.BaseIndex + uint64(n) - 1
+		info.Size = size
+		ts.metaState.Segments[last] = info
+		ts.segments[info.ID].mutate(func(newState *testSegmentState) error {
+			newState.info = info
+			return nil
+		})
+		ts.setupMaxIndex = info.MaxIndex + 1
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package conformance provides reusable tests that check implementations of
+// the storage interfaces in the types package against their documented
+// contracts. Anyone writing an alternative VFS, SegmentFiler or MetaStore can
+// call the relevant function from their own tests:
+//
+//	func TestMyVFS(t *testing.T) {
+//		conformance.TestVFS(t, func(t *testing.T) (types.VFS, string) {
+//			return mypkg.New(), t.TempDir()
+//		})
+//	}
+package conformance
@@ -0,0 +1,231 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package conformance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// MetaStoreFactory returns the directory to Load from and a function that
+// returns a new, unopened MetaStore instance. Every instance must see the state
+// committed through earlier instances for the same dir once those have been
+// closed, just like a real store reopened after a restart. It's called once
+// per subtest.
+type MetaStoreFactory func(t *testing.T) (dir string, open func() types.MetaStore)
+
+// MetaStoreOption enables optional checks in TestMetaStore.
+type MetaStoreOption func(*metaStoreOptions)
+
+type metaStoreOptions struct {
+	crash func(t *testing.T, dir string)
+}
+
+// WithCrash enables checking that commits are atomic. crash is called with the
+// dir of a closed store and must damage what the last commit wrote the same way
+// a crash or failed write part way through it would, for example by truncating
+// the file it wrote to. The store must then load the state from before that
+// commit.
+func WithCrash(crash func(t *testing.T, dir string)) MetaStoreOption {
+	return func(o *metaStoreOptions) {
+		o.crash = crash
+	}
+}
+
+// TestMetaStore checks that the MetaStore returned by newStore meets the
+// types.MetaStore contract.
+func TestMetaStore(t *testing.T, newStore MetaStoreFactory, opts ...MetaStoreOption) {
+	var o metaStoreOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	t.Run("LoadEmpty", func(t *testing.T) {
+		dir, open := newStore(t)
+		ms := open()
+		defer ms.Close()
+
+		state, err := ms.Load(dir)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), state.NextSegmentID)
+		require.Empty(t, state.Segments)
+		require.Empty(t, state.Cursors)
+	})
+
+	t.Run("CommitAndReload", func(t *testing.T) {
+		dir, open := newStore(t)
+		ms := open()
+
+		_, err := ms.Load(dir)
+		require.NoError(t, err)
+
+		want := testPersistentState(3)
+		require.NoError(t, ms.CommitState(want))
+
+		got, err := ms.Load(dir)
+		require.NoError(t, err)
+		requireStateEqual(t, want, got)
+
+		require.NoError(t, ms.Close())
+
+		// A new instance sees the committed state.
+		ms = open()
+		defer ms.Close()
+		got, err = ms.Load(dir)
+		require.NoError(t, err)
+		requireStateEqual(t, want, got)
+	})
+
+	t.Run("CommitReplaces", func(t *testing.T) {
+		dir, open := newStore(t)
+		ms := open()
+
+		_, err := ms.Load(dir)
+		require.NoError(t, err)
+
+		// Each commit must replace the whole state, not merge with the previous
+		// one, so removed segments and cursors don't reappear.
+		require.NoError(t, ms.CommitState(testPersistentState(5)))
+		want := testPersistentState(2)
+		want.Cursors = map[string]uint64{"b": 7}
+		require.NoError(t, ms.CommitState(want))
+		require.NoError(t, ms.Close())
+
+		ms = open()
+		defer ms.Close()
+		got, err := ms.Load(dir)
+		require.NoError(t, err)
+		requireStateEqual(t, want, got)
+	})
+
+	t.Run("Stable", func(t *testing.T) {
+		dir, open := newStore(t)
+		ms := open()
+
+		_, err := ms.Load(dir)
+		require.NoError(t, err)
+
+		got, err := ms.GetStable([]byte("term"))
+		require.NoError(t, err)
+		require.Nil(t, got, "GetStable must return nil for a missing key")
+
+		require.NoError(t, ms.SetStable([]byte("term"), []byte("1")))
+		require.NoError(t, ms.SetStable([]byte("vote"), []byte("node-a")))
+
+		// Committing state must not affect stable values and vice versa.
+		want := testPersistentState(2)
+		require.NoError(t, ms.CommitState(want))
+		require.NoError(t, ms.SetStable([]byte("term"), []byte("2")))
+
+		// A nil value removes the key.
+		require.NoError(t, ms.SetStable([]byte("vote"), nil))
+
+		got, err = ms.GetStable([]byte("term"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("2"), got)
+		require.NoError(t, ms.Close())
+
+		ms = open()
+		defer ms.Close()
+		state, err := ms.Load(dir)
+		require.NoError(t, err)
+		requireStateEqual(t, want, state)
+
+		got, err = ms.GetStable([]byte("term"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("2"), got)
+
+		got, err = ms.GetStable([]byte("vote"))
+		require.NoError(t, err)
+		require.Nil(t, got)
+	})
+
+	t.Run("Atomicity", func(t *testing.T) {
+		if o.crash == nil {
+			t.Skip("no crash simulation provided")
+		}
+		dir, open := newStore(t)
+		ms := open()
+
+		_, err := ms.Load(dir)
+		require.NoError(t, err)
+
+		require.NoError(t, ms.SetStable([]byte("term"), []byte("1")))
+		want := testPersistentState(3)
+		require.NoError(t, ms.CommitState(want))
+		require.NoError(t, ms.CommitState(testPersistentState(4)))
+		require.NoError(t, ms.Close())
+
+		// The last commit never completed so the state from before it loads,
+		// including stable values.
+		o.crash(t, dir)
+		ms = open()
+		got, err := ms.Load(dir)
+		require.NoError(t, err)
+		requireStateEqual(t, want, got)
+		term, err := ms.GetStable([]byte("term"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), term)
+
+		// And the store can still be committed to.
+		want = testPersistentState(5)
+		require.NoError(t, ms.CommitState(want))
+		require.NoError(t, ms.Close())
+
+		ms = open()
+		defer ms.Close()
+		got, err = ms.Load(dir)
+		require.NoError(t, err)
+		requireStateEqual(t, want, got)
+	})
+}
+
+func testPersistentState(nSegs int) types.PersistentState {
+	now := time.Now().UTC().Truncate(time.Second)
+	state := types.PersistentState{
+		NextSegmentID: uint64(nSegs + 1),
+		Cursors:       map[string]uint64{"a": 12, "b": 3},
+	}
+	for i := 0; i < nSegs; i++ {
+		si := types.SegmentInfo{
+			ID:         uint64(i + 1),
+			BaseIndex:  uint64(i*1000 + 1),
+			MinIndex:   uint64(i*1000 + 1),
+			CreateTime: now,
+			SizeLimit:  64 * 1024 * 1024,
+		}
+		if i < nSegs-1 {
+			si.MaxIndex = uint64((i + 1) * 1000)
+			si.IndexStart = 12345
+			si.SealTime = now
+		}
+		state.Segments = append(state.Segments, si)
+	}
+	return state
+}
+
+// requireStateEqual compares states allowing for time values that went through
+// serialization and so may differ in monotonic clock or location.
+func requireStateEqual(t *testing.T, want, got types.PersistentState) {
+	t.Helper()
+	require.Equal(t, want.NextSegmentID, got.NextSegmentID)
+	require.Len(t, got.Segments, len(want.Segments))
+	for i := range want.Segments {
+		w, g := want.Segments[i], got.Segments[i]
+		require.True(t, w.CreateTime.Equal(g.CreateTime), "segment %d CreateTime", i)
+		require.True(t, w.SealTime.Equal(g.SealTime), "segment %d SealTime", i)
+		w.CreateTime, g.CreateTime = time.Time{}, time.Time{}
+		w.SealTime, g.SealTime = time.Time{}, time.Time{}
+		require.Equal(t, w, g, "segment %d", i)
+	}
+	if len(want.Cursors) == 0 {
+		require.Empty(t, got.Cursors)
+	} else {
+		require.Equal(t, want.Cursors, got.Cursors)
+	}
+}
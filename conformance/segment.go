@@ -0,0 +1,173 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package conformance
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// SegmentFilerFactory returns a new SegmentFiler with no segments. It's called
+// once per subtest.
+type SegmentFilerFactory func(t *testing.T) types.SegmentFiler
+
+// TestSegmentFiler checks that the SegmentFiler returned by newFiler meets the
+// types.SegmentFiler, types.SegmentWriter and types.SegmentReader contracts.
+func TestSegmentFiler(t *testing.T, newFiler SegmentFilerFactory) {
+	t.Run("AppendAndRead", func(t *testing.T) {
+		sf := newFiler(t)
+		info := testSegmentInfo(1, 1)
+
+		w, err := sf.Create(info)
+		require.NoError(t, err)
+		defer w.Close()
+
+		require.Equal(t, uint64(0), w.LastIndex(), "empty segment must have LastIndex zero")
+		sealed, _, err := w.Sealed()
+		require.NoError(t, err)
+		require.False(t, sealed)
+
+		require.NoError(t, w.Append(testEntries(1, 10)))
+		require.Equal(t, uint64(10), w.LastIndex())
+		require.NoError(t, w.Append(testEntries(11, 1)))
+		require.Equal(t, uint64(11), w.LastIndex())
+
+		requireEntries(t, w, 1, 11)
+
+		var le types.LogEntry
+		require.ErrorIs(t, w.GetLog(12, &le), types.ErrNotFound)
+	})
+
+	t.Run("RecoverTailMissing", func(t *testing.T) {
+		sf := newFiler(t)
+
+		_, err := sf.RecoverTail(testSegmentInfo(1, 1))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("RecoverTail", func(t *testing.T) {
+		sf := newFiler(t)
+		info := testSegmentInfo(1, 1)
+
+		w, err := sf.Create(info)
+		require.NoError(t, err)
+		require.NoError(t, w.Append(testEntries(1, 5)))
+		require.NoError(t, w.Close())
+
+		w, err = sf.RecoverTail(info)
+		require.NoError(t, err)
+		defer w.Close()
+
+		require.Equal(t, uint64(5), w.LastIndex())
+		requireEntries(t, w, 1, 5)
+
+		// The recovered writer accepts further appends.
+		require.NoError(t, w.Append(testEntries(6, 5)))
+		requireEntries(t, w, 1, 10)
+	})
+
+	t.Run("SealAndOpen", func(t *testing.T) {
+		sf := newFiler(t)
+		info := testSegmentInfo(100, 7)
+
+		w, err := sf.Create(info)
+		require.NoError(t, err)
+		defer w.Close()
+
+		// Append until the segment seals itself.
+		idx := info.BaseIndex
+		var indexStart uint64
+		for {
+			require.NoError(t, w.Append(testEntries(idx, 1)))
+			idx++
+
+			var sealed bool
+			sealed, indexStart, err = w.Sealed()
+			require.NoError(t, err)
+			if sealed {
+				break
+			}
+			require.Less(t, idx-info.BaseIndex, uint64(10_000), "segment never sealed")
+		}
+		last := idx - 1
+		require.Equal(t, last, w.LastIndex())
+
+		info.MaxIndex = last
+		info.IndexStart = indexStart
+		info.SealTime = time.Now()
+
+		r, err := sf.Open(info)
+		require.NoError(t, err)
+		defer r.Close()
+
+		requireEntries(t, r, info.BaseIndex, last)
+
+		var le types.LogEntry
+		require.ErrorIs(t, r.GetLog(info.BaseIndex-1, &le), types.ErrNotFound)
+		require.ErrorIs(t, r.GetLog(last+1, &le), types.ErrNotFound)
+	})
+
+	t.Run("ListAndDelete", func(t *testing.T) {
+		sf := newFiler(t)
+
+		segs, err := sf.List()
+		require.NoError(t, err)
+		require.Empty(t, segs)
+
+		expect := map[uint64]uint64{1: 1, 2: 1000, 3: 2000}
+		for id, base := range expect {
+			w, err := sf.Create(testSegmentInfo(base, id))
+			require.NoError(t, err)
+			require.NoError(t, w.Append(testEntries(base, 1)))
+			require.NoError(t, w.Close())
+		}
+
+		segs, err = sf.List()
+		require.NoError(t, err)
+		require.Equal(t, expect, segs)
+
+		require.NoError(t, sf.Delete(1000, 2))
+		delete(expect, 2)
+
+		segs, err = sf.List()
+		require.NoError(t, err)
+		require.Equal(t, expect, segs)
+	})
+}
+
+func testSegmentInfo(baseIndex, id uint64) types.SegmentInfo {
+	return types.SegmentInfo{
+		ID:         id,
+		BaseIndex:  baseIndex,
+		MinIndex:   baseIndex,
+		CreateTime: time.Now(),
+		SizeLimit:  16 * 1024,
+	}
+}
+
+func testEntries(start uint64, n int) []types.LogEntry {
+	entries := make([]types.LogEntry, 0, n)
+	for idx := start; idx < start+uint64(n); idx++ {
+		entries = append(entries, types.LogEntry{
+			Index: idx,
+			Data:  []byte(fmt.Sprintf("Log entry %d", idx)),
+		})
+	}
+	return entries
+}
+
+func requireEntries(t *testing.T, r types.SegmentReader, first, last uint64) {
+	t.Helper()
+	for idx := first; idx <= last; idx++ {
+		var le types.LogEntry
+		require.NoError(t, r.GetLog(idx, &le), "reading index %d", idx)
+		require.Equal(t, fmt.Sprintf("Log entry %d", idx), string(le.Data))
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package conformance
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// VFSFactory returns a new VFS along with an existing, empty directory in it
+// that tests may use. It's called once per subtest.
+type VFSFactory func(t *testing.T) (vfs types.VFS, dir string)
+
+// TestVFS checks that the VFS returned by newVFS meets the types.VFS,
+// types.WritableFile and types.ReadableFile contracts.
+func TestVFS(t *testing.T, newVFS VFSFactory) {
+	t.Run("ListDir", func(t *testing.T) {
+		vfs, dir := newVFS(t)
+
+		// An empty dir lists no files and no error.
+		files, err := vfs.ListDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, files)
+
+		// Files are listed in lexicographical order, not creation order.
+		for _, name := range []string{"b", "c", "a", "00010", "00002"} {
+			f, err := vfs.Create(dir, name, 0)
+			require.NoError(t, err)
+			require.NoError(t, f.Sync())
+			require.NoError(t, f.Close())
+		}
+		files, err = vfs.ListDir(dir)
+		require.NoError(t, err)
+		require.Equal(t, []string{"00002", "00010", "a", "b", "c"}, files)
+	})
+
+	t.Run("MissingDir", func(t *testing.T) {
+		vfs, dir := newVFS(t)
+		missing := filepath.Join(dir, "not-a-dir")
+
+		_, err := vfs.ListDir(missing)
+		require.Error(t, err, "ListDir must fail on a missing dir")
+
+		_, err = vfs.Create(missing, "foo", 0)
+		require.Error(t, err, "Create must fail in a missing dir")
+
+		_, err = vfs.OpenReader(missing, "foo")
+		require.Error(t, err, "OpenReader must fail in a missing dir")
+
+		_, err = vfs.OpenWriter(missing, "foo")
+		require.Error(t, err, "OpenWriter must fail in a missing dir")
+	})
+
+	t.Run("MissingFile", func(t *testing.T) {
+		vfs, dir := newVFS(t)
+
+		// SegmentFiler.RecoverTail must return an error wrapping os.ErrNotExist
+		// for a missing file which the VFS needs to make possible.
+		_, err := vfs.OpenReader(dir, "foo")
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		_, err = vfs.OpenWriter(dir, "foo")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("CreateExisting", func(t *testing.T) {
+		vfs, dir := newVFS(t)
+
+		f, err := vfs.Create(dir, "foo", 0)
+		require.NoError(t, err)
+		defer f.Close()
+
+		_, err = vfs.Create(dir, "foo", 0)
+		require.Error(t, err, "Create must fail if the file exists")
+	})
+
+	t.Run("ReadWrite", func(t *testing.T) {
+		vfs, dir := newVFS(t)
+
+		const size = 64 * 1024
+		wf, err := vfs.Create(dir, "foo", size)
+		require.NoError(t, err)
+		defer wf.Close()
+
+		// Writes may happen in any order and past the preallocated size.
+		writeAt(t, wf, '2', 1024, 1024)
+		writeAt(t, wf, '1', 1024, 0)
+		writeAt(t, wf, '3', 1024, size)
+		require.NoError(t, wf.Sync())
+
+		rf, err := vfs.OpenReader(dir, "foo")
+		require.NoError(t, err)
+		defer rf.Close()
+
+		requireRead(t, rf, '1', 1024, 0)
+		requireRead(t, rf, '2', 1024, 1024)
+		requireRead(t, rf, '3', 1024, size)
+
+		// Reading off the end returns io.EOF.
+		var buf [1024]byte
+		_, err = rf.ReadAt(buf[:], size+4096)
+		require.ErrorIs(t, err, io.EOF)
+
+		// A partial read at the end returns what's there and io.EOF.
+		n, err := rf.ReadAt(buf[:], size+512)
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, 512, n)
+
+		// Reopening for write allows further writes that are visible to the
+		// existing reader and through the writer.
+		require.NoError(t, wf.Close())
+		wf, err = vfs.OpenWriter(dir, "foo")
+		require.NoError(t, err)
+		writeAt(t, wf, '4', 1024, 2048)
+		require.NoError(t, wf.Sync())
+
+		requireRead(t, wf, '4', 1024, 2048)
+		requireRead(t, rf, '4', 1024, 2048)
+		requireRead(t, rf, '2', 1024, 1024)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		vfs, dir := newVFS(t)
+
+		wf, err := vfs.Create(dir, "foo", 0)
+		require.NoError(t, err)
+		require.NoError(t, wf.Sync())
+		require.NoError(t, wf.Close())
+
+		require.NoError(t, vfs.Delete(dir, "foo"))
+
+		files, err := vfs.ListDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, files)
+
+		_, err = vfs.OpenReader(dir, "foo")
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		// The name can be reused.
+		wf, err = vfs.Create(dir, "foo", 0)
+		require.NoError(t, err)
+		require.NoError(t, wf.Close())
+	})
+
+	t.Run("Move", func(t *testing.T) {
+		vfs, dir := newVFS(t)
+		mv, ok := vfs.(types.FileMover)
+		if !ok {
+			t.Skip("VFS doesn't implement types.FileMover")
+		}
+		sub := filepath.Join(dir, "sub")
+
+		wf, err := vfs.Create(dir, "foo", 0)
+		require.NoError(t, err)
+		writeAt(t, wf, '1', 1024, 0)
+		require.NoError(t, wf.Sync())
+		require.NoError(t, wf.Close())
+
+		// The destination dir is created and isn't listed as a file.
+		require.NoError(t, mv.Move(dir, "foo", sub, "bar"))
+		files, err := vfs.ListDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, files)
+		files, err = vfs.ListDir(sub)
+		require.NoError(t, err)
+		require.Equal(t, []string{"bar"}, files)
+
+		rf, err := vfs.OpenReader(sub, "bar")
+		require.NoError(t, err)
+		requireRead(t, rf, '1', 1024, 0)
+		require.NoError(t, rf.Close())
+
+		// Moving a missing file or over an existing one fails.
+		require.ErrorIs(t, mv.Move(dir, "foo", sub, "baz"), os.ErrNotExist)
+		wf, err = vfs.Create(dir, "foo", 0)
+		require.NoError(t, err)
+		require.NoError(t, wf.Close())
+		require.ErrorIs(t, mv.Move(dir, "foo", sub, "bar"), os.ErrExist)
+
+		// And back again.
+		require.NoError(t, vfs.Delete(dir, "foo"))
+		require.NoError(t, mv.Move(sub, "bar", dir, "foo"))
+		files, err = vfs.ListDir(dir)
+		require.NoError(t, err)
+		require.Equal(t, []string{"foo"}, files)
+	})
+}
+
+func writeAt(t *testing.T, wf types.WritableFile, b byte, n int, off int64) {
+	t.Helper()
+	written, err := wf.WriteAt(bytes.Repeat([]byte{b}, n), off)
+	require.NoError(t, err)
+	require.Equal(t, n, written)
+}
+
+func requireRead(t *testing.T, rf io.ReaderAt, b byte, n int, off int64) {
+	t.Helper()
+	buf := make([]byte, n)
+	got, err := rf.ReadAt(buf, off)
+	// A read that ends exactly at the end of the file may return io.EOF.
+	if err != io.EOF {
+		require.NoError(t, err)
+	}
+	require.Equal(t, n, got)
+	require.Equal(t, bytes.Repeat([]byte{b}, n), buf)
+}
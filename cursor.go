@@ -0,0 +1,132 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrCursorNotFound is returned when committing to a cursor that has been
+	// removed.
+	ErrCursorNotFound = errors.New("cursor not found")
+
+	// ErrCursorBehind is returned by TruncateFront when WithCursorTruncationGuard
+	// is set and the truncation would remove entries a cursor hasn't committed.
+	ErrCursorBehind = errors.New("truncation blocked by cursor")
+)
+
+// Cursor tracks how far a named consumer of the WAL has got. Consumers Commit
+// the highest index they have finished processing. Cursors are stored durably
+// in the MetaStore along with the rest of the WAL metadata so they survive
+// restarts, which means several independent consumers can use the WAL as a
+// small durable queue. Background truncation (see WithRetention) never removes
+// entries a registered cursor hasn't committed yet, and neither does
+// TruncateFront if WithCursorTruncationGuard is set.
+type Cursor struct {
+	w    *WAL
+	name string
+}
+
+// Cursor returns the cursor with the given name, durably registering it if it
+// doesn't exist yet. A newly registered cursor has committed nothing so it
+// holds back truncation of every entry until it commits.
+func (w *WAL) Cursor(name string) (*Cursor, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	if _, ok := w.loadState().cursors[name]; ok {
+		return &Cursor{w: w, name: name}, nil
+	}
+
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	err := w.mutateStateLocked(func(newState *state) (func(), func() error, error) {
+		if _, ok := newState.cursors[name]; ok {
+			// Registered concurrently, nothing to do.
+			return nil, nil, nil
+		}
+		newState.cursors = newState.withCursor(name, 0)
+		return nil, nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{w: w, name: name}, nil
+}
+
+// Cursors returns the names of all registered cursors and their committed
+// indexes.
+func (w *WAL) Cursors() (map[string]uint64, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	s, release := w.acquireState()
+	defer release()
+
+	cursors := make(map[string]uint64, len(s.cursors))
+	for name, idx := range s.cursors {
+		cursors[name] = idx
+	}
+	return cursors, nil
+}
+
+// RemoveCursor durably unregisters the named cursor so that it no longer holds
+// back truncation. It is a no-op if the cursor doesn't exist.
+func (w *WAL) RemoveCursor(name string) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if _, ok := w.loadState().cursors[name]; !ok {
+		return nil
+	}
+	return w.mutateStateLocked(func(newState *state) (func(), func() error, error) {
+		newState.cursors = newState.withoutCursor(name)
+		return nil, nil, nil
+	})
+}
+
+// Name returns the name of the cursor.
+func (c *Cursor) Name() string {
+	return c.name
+}
+
+// Index returns the last committed index or zero if nothing has been committed
+// yet.
+func (c *Cursor) Index() uint64 {
+	s, release := c.w.acquireState()
+	defer release()
+	return s.cursors[c.name]
+}
+
+// Commit durably records that the consumer has finished processing all entries
+// up to and including index. It doesn't return until the new position is
+// persisted. Cursors may only move forwards.
+func (c *Cursor) Commit(index uint64) error {
+	if err := c.w.checkClosed(); err != nil {
+		return err
+	}
+	c.w.writeMu.Lock()
+	defer c.w.writeMu.Unlock()
+
+	old, ok := c.w.loadState().cursors[c.name]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrCursorNotFound, c.name)
+	}
+	if index < old {
+		return fmt.Errorf("cursor %q can't move backwards from %d to %d", c.name, old, index)
+	}
+	if index == old {
+		return nil
+	}
+	return c.w.mutateStateLocked(func(newState *state) (func(), func() error, error) {
+		newState.cursors = newState.withCursor(c.name, index)
+		return nil, nil, nil
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursorsPersisted(t *testing.T) {
+	ts, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segTail(10)}, nil, false)
+	require.NoError(t, err)
+
+	uploader, err := w.Cursor("uploader")
+	require.NoError(t, err)
+	indexer, err := w.Cursor("indexer")
+	require.NoError(t, err)
+
+	// Registration alone is persisted.
+	require.Equal(t, map[string]uint64{"uploader": 0, "indexer": 0}, ts.metaState.Cursors)
+
+	require.NoError(t, uploader.Commit(50))
+	require.NoError(t, indexer.Commit(105))
+	require.Equal(t, uint64(50), uploader.Index())
+
+	// Committing the same index again is a no-op that doesn't touch meta.
+	commits := ts.calls["CommitState"]
+	require.NoError(t, uploader.Commit(50))
+	require.Equal(t, commits, ts.calls["CommitState"])
+
+	require.Error(t, uploader.Commit(49))
+
+	require.Equal(t, map[string]uint64{"uploader": 50, "indexer": 105}, ts.metaState.Cursors)
+
+	// Cursor state survives other mutations of the state.
+	require.NoError(t, w.StoreLogs(makeLogEntries(111, 5)))
+	require.NoError(t, w.TruncateBack(112))
+	require.Equal(t, map[string]uint64{"uploader": 50, "indexer": 105}, ts.metaState.Cursors)
+
+	require.NoError(t, w.RemoveCursor("indexer"))
+	require.ErrorIs(t, indexer.Commit(110), ErrCursorNotFound)
+	require.Equal(t, map[string]uint64{"uploader": 50}, ts.metaState.Cursors)
+
+	require.NoError(t, w.Close())
+
+	// Re-open against the same storage and check the cursor was loaded.
+	w2, err := Open("test", stubStorage(ts))
+	require.NoError(t, err)
+	defer w2.Close()
+
+	cursors, err := w2.Cursors()
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"uploader": 50}, cursors)
+
+	c, err := w2.Cursor("uploader")
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), c.Index())
+}
+
+func TestCursorTruncationGuard(t *testing.T) {
+	_, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segTail(10)},
+		[]walOpt{WithCursorTruncationGuard()}, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// No cursors means no restrictions.
+	require.NoError(t, w.TruncateFront(10))
+
+	c, err := w.Cursor("replicator")
+	require.NoError(t, err)
+	require.NoError(t, c.Commit(40))
+
+	// Truncating up to and including the committed index is allowed.
+	require.NoError(t, w.TruncateFront(41))
+
+	err = w.TruncateFront(42)
+	require.ErrorIs(t, err, ErrCursorBehind)
+
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 41, int(first))
+}
@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// entryCache is an LRU cache of recently appended or read entries, bounded by
+// the total bytes of entry data it holds. It's filled by StoreLogs and by reads
+// that miss. Truncations remove the entries they make invalid.
+//
+// A read might load an entry from a state that's replaced by a truncation
+// before it adds the entry to the cache. To stop that re-adding a truncated
+// entry, truncations bump a generation counter and reads only add entries if
+// the generation hasn't changed since before they acquired their state.
+type entryCache struct {
+	mu     sync.Mutex
+	budget uint64
+	size   uint64
+	gen    uint64
+	// lru holds *cachedEntry with the most recently used at the front.
+	lru   *list.List
+	items map[uint64]*list.Element
+}
+
+type cachedEntry struct {
+	index uint64
+	data  []byte
+}
+
+func newEntryCache(budget uint64) *entryCache {
+	return &entryCache{
+		budget: budget,
+		lru:    list.New(),
+		items:  make(map[uint64]*list.Element),
+	}
+}
+
+// generation returns the current generation to pass to add.
+func (c *entryCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get copies the cached entry with the given index into le.Data.
+func (c *entryCache) get(index uint64, le *types.LogEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[index]
+	if !ok {
+		return false
+	}
+	c.lru.MoveToFront(e)
+	le.Data = append(le.Data[:0], e.Value.(*cachedEntry).data...)
+	return true
+}
+
+// add caches copies of entries, evicting the least recently used entries to
+// stay within budget. Nothing is added if the generation has changed since gen
+// was read.
+func (c *entryCache) add(gen uint64, entries ...types.LogEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	for _, le := range entries {
+		size := uint64(len(le.Data))
+		if size > c.budget {
+			continue
+		}
+		if e, ok := c.items[le.Index]; ok {
+			c.removeElementLocked(e)
+		}
+		for c.size+size > c.budget {
+			c.removeElementLocked(c.lru.Back())
+		}
+		data := make([]byte, len(le.Data))
+		copy(data, le.Data)
+		c.items[le.Index] = c.lru.PushFront(&cachedEntry{index: le.Index, data: data})
+		c.size += size
+	}
+}
+
+// removeBefore removes entries with indexes lower than index.
+func (c *entryCache) removeBefore(index uint64) {
+	c.removeIf(func(idx uint64) bool { return idx < index })
+}
+
+// removeAfter removes entries with indexes higher than index.
+func (c *entryCache) removeAfter(index uint64) {
+	c.removeIf(func(idx uint64) bool { return idx > index })
+}
+
+func (c *entryCache) removeIf(fn func(idx uint64) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for idx, e := range c.items {
+		if fn(idx) {
+			c.removeElementLocked(e)
+		}
+	}
+}
+
+func (c *entryCache) removeElementLocked(e *list.Element) {
+	entry := c.lru.Remove(e).(*cachedEntry)
+	delete(c.items, entry.index)
+	c.size -= uint64(len(entry.data))
+}
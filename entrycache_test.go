@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/types"
+)
+
+func TestEntryCache(t *testing.T) {
+	c := newEntryCache(30)
+	var le types.LogEntry
+
+	// Each entry is 11 bytes so only two fit.
+	c.add(c.generation(), makeLogEntries(1, 3)...)
+	require.False(t, c.get(1, &le))
+	require.True(t, c.get(2, &le))
+	require.Equal(t, "Log entry 2", string(le.Data))
+
+	// 3 is now the least recently used.
+	c.add(c.generation(), makeLogEntries(4, 1)...)
+	require.False(t, c.get(3, &le))
+	require.True(t, c.get(2, &le))
+	require.True(t, c.get(4, &le))
+	require.Equal(t, uint64(22), c.size)
+
+	// Adds from before a truncation are ignored.
+	gen := c.generation()
+	c.removeAfter(3)
+	require.False(t, c.get(4, &le))
+	c.add(gen, makeLogEntries(4, 1)...)
+	require.False(t, c.get(4, &le))
+
+	c.removeBefore(3)
+	require.False(t, c.get(2, &le))
+	require.Equal(t, 0, c.lru.Len())
+	require.Equal(t, uint64(0), c.size)
+
+	// Cached data is a copy.
+	entries := makeLogEntries(5, 1)
+	c.add(c.generation(), entries...)
+	entries[0].Data[0] = 'X'
+	require.True(t, c.get(5, &le))
+	require.Equal(t, "Log entry 5", string(le.Data))
+}
+
+func TestEntryCacheTruncations(t *testing.T) {
+	w, err := Open(t.TempDir(), WithSegmentSize(8*1024), WithEntryCache(64*1024))
+	require.NoError(t, err)
+	defer w.Close()
+
+	entries := func(start uint64, n int, prefix string) []types.LogEntry {
+		es := make([]types.LogEntry, n)
+		for i := range es {
+			idx := start + uint64(i)
+			es[i] = types.LogEntry{Index: idx, Data: []byte(fmt.Sprintf("%s %d", prefix, idx))}
+		}
+		return es
+	}
+	get := func(idx uint64) string {
+		t.Helper()
+		var le types.LogEntry
+		require.NoError(t, w.GetLog(idx, &le))
+		return string(le.Data)
+	}
+
+	require.NoError(t, w.StoreLogs(entries(1, 100, "first")))
+	require.Equal(t, "first 50", get(50))
+	require.Equal(t, 1.0, testutil.ToFloat64(w.metrics.EntryCacheHits))
+	require.Equal(t, 0.0, testutil.ToFloat64(w.metrics.EntryCacheMisses))
+
+	// Appending different entries after a TruncateBack must not serve the old
+	// ones from the cache.
+	require.NoError(t, w.TruncateBack(60))
+	var le types.LogEntry
+	require.ErrorIs(t, w.GetLog(61, &le), ErrNotFound)
+	require.NoError(t, w.StoreLogs(entries(61, 10, "second")))
+	require.Equal(t, "second 61", get(61))
+	require.Equal(t, "first 60", get(60))
+
+	// Truncated from the front.
+	require.NoError(t, w.TruncateFront(20))
+	require.ErrorIs(t, w.GetLog(19, &le), ErrNotFound)
+
+	// Emptying the log allows it to start again at a lower index.
+	require.NoError(t, w.TruncateFront(1000))
+	require.NoError(t, w.StoreLogs(entries(30, 10, "third")))
+	require.Equal(t, "third 30", get(30))
+	require.ErrorIs(t, w.GetLog(61, &le), ErrNotFound)
+}
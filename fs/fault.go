@@ -0,0 +1,426 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// ErrInjected is the error returned by FaultFS when a FaultRule fires and
+// doesn't specify its own error.
+var ErrInjected = errors.New("injected fault")
+
+// DefaultSectorSize is the granularity of torn writes when a FaultRule doesn't
+// specify a SectorSize.
+const DefaultSectorSize = 512
+
+// FaultOp identifies the VFS or file operation a FaultRule applies to.
+type FaultOp int
+
+const (
+	OpListDir FaultOp = iota
+	OpCreate
+	OpDelete
+	OpOpen
+	OpReadAt
+	OpWriteAt
+	OpSync
+	OpMove
+)
+
+func (o FaultOp) String() string {
+	switch o {
+	case OpListDir:
+		return "ListDir"
+	case OpCreate:
+		return "Create"
+	case OpDelete:
+		return "Delete"
+	case OpOpen:
+		return "Open"
+	case OpReadAt:
+		return "ReadAt"
+	case OpWriteAt:
+		return "WriteAt"
+	case OpSync:
+		return "Sync"
+	case OpMove:
+		return "Move"
+	default:
+		return "unknown"
+	}
+}
+
+// FaultKind is the type of failure a FaultRule injects.
+type FaultKind int
+
+const (
+	// FaultError fails the operation with the rule's Err without performing it.
+	FaultError FaultKind = iota
+
+	// FaultShortWrite writes only a prefix of the data and returns
+	// io.ErrShortWrite. It only applies to OpWriteAt.
+	FaultShortWrite
+
+	// FaultTornWrite writes a random subset of the sectors covered by the write
+	// and then fails with the rule's Err, like a device losing power part way
+	// through. It only applies to OpWriteAt.
+	FaultTornWrite
+
+	// FaultBitFlip flips a single random bit in the data returned by a
+	// successful read. It only applies to OpReadAt.
+	FaultBitFlip
+
+	// FaultLatency sleeps for the rule's Latency before performing the operation
+	// normally.
+	FaultLatency
+)
+
+// FaultRule describes when and how FaultFS should inject a failure. A rule
+// matches a call if the Op is the same and the file name matches File, which
+// for OpMove is the name of the file being moved. OpenMapped counts as OpOpen.
+// The
+// first After matching calls are let through, then the rule fires on each
+// matching call with the given Probability until it has fired Count times.
+//
+// A script is a list of rules with Probability left at zero, for example
+// {Op: OpSync, After: 3, Count: 1} fails only the fourth Sync.
+type FaultRule struct {
+	Op   FaultOp
+	Kind FaultKind
+
+	// File is a path.Match pattern matched against the file name (without the
+	// dir). Empty matches every file. It's ignored for OpListDir.
+	File string
+
+	// After is the number of matching calls to let through before the rule
+	// starts firing.
+	After int
+
+	// Count limits how many times the rule fires. Zero means no limit.
+	Count int
+
+	// Probability is the chance in (0, 1] that the rule fires on each eligible
+	// call. Zero means it always fires.
+	Probability float64
+
+	// Err is returned by FaultError and FaultTornWrite. Defaults to ErrInjected.
+	Err error
+
+	// Latency is how long FaultLatency sleeps.
+	Latency time.Duration
+
+	// SectorSize is the granularity of FaultTornWrite. Defaults to
+	// DefaultSectorSize.
+	SectorSize int
+}
+
+type faultRuleState struct {
+	FaultRule
+	seen, fired int
+}
+
+// FaultFS wraps a VFS and injects failures according to a set of FaultRules so
+// that error handling and recovery can be tested without special hardware or
+// privileges. It is safe for concurrent use and rules may be changed while it's
+// in use.
+//
+// FaultFS also implements types.FreeSpaceReporter, types.FileMapper and
+// types.FileMover by forwarding to the wrapped VFS. If the wrapped VFS doesn't
+// implement them OpenMapped falls back to OpenReader while FreeSpace and Move
+// return an error.
+type FaultFS struct {
+	vfs types.VFS
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	rules    []*faultRuleState
+	injected int
+}
+
+var (
+	_ types.VFS               = (*FaultFS)(nil)
+	_ types.FreeSpaceReporter = (*FaultFS)(nil)
+	_ types.FileMapper        = (*FaultFS)(nil)
+	_ types.FileMover         = (*FaultFS)(nil)
+	_ types.AlignedFile       = (*faultFile)(nil)
+)
+
+// NewFaultFS returns a FaultFS wrapping vfs. seed initializes the random source
+// used for probabilities, short and torn write lengths and bit flips so that
+// failing runs can be reproduced.
+func NewFaultFS(vfs types.VFS, seed int64, rules ...FaultRule) *FaultFS {
+	fs := &FaultFS{
+		vfs: vfs,
+		rnd: rand.New(rand.NewSource(seed)),
+	}
+	fs.AddRules(rules...)
+	return fs
+}
+
+// AddRules appends rules. Rules are evaluated in the order they were added.
+func (fs *FaultFS) AddRules(rules ...FaultRule) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, r := range rules {
+		if r.Err == nil {
+			r.Err = ErrInjected
+		}
+		if r.SectorSize <= 0 {
+			r.SectorSize = DefaultSectorSize
+		}
+		fs.rules = append(fs.rules, &faultRuleState{FaultRule: r})
+	}
+}
+
+// ClearRules removes all rules so that every operation succeeds from now on.
+func (fs *FaultFS) ClearRules() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.rules = nil
+}
+
+// Injected returns the number of faults injected so far, not counting latency.
+func (fs *FaultFS) Injected() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.injected
+}
+
+// fault sleeps for any latency rules that fire and returns the first other
+// rule that fires for the call, if any.
+func (fs *FaultFS) fault(op FaultOp, name string) *FaultRule {
+	var sleep time.Duration
+	var fired *FaultRule
+
+	fs.mu.Lock()
+	for _, r := range fs.rules {
+		if r.Op != op || !r.applies() {
+			continue
+		}
+		if r.File != "" && op != OpListDir {
+			if ok, _ := path.Match(r.File, name); !ok {
+				continue
+			}
+		}
+		r.seen++
+		if r.seen <= r.After || (r.Count > 0 && r.fired >= r.Count) {
+			continue
+		}
+		if r.Probability > 0 && fs.rnd.Float64() >= r.Probability {
+			continue
+		}
+		r.fired++
+		if r.Kind == FaultLatency {
+			sleep += r.Latency
+			continue
+		}
+		fs.injected++
+		rule := r.FaultRule
+		fired = &rule
+		break
+	}
+	fs.mu.Unlock()
+
+	if sleep > 0 {
+		time.Sleep(sleep)
+	}
+	return fired
+}
+
+// applies reports whether the rule's kind makes sense for its op. Rules that
+// don't are ignored.
+func (r *faultRuleState) applies() bool {
+	switch r.Kind {
+	case FaultShortWrite, FaultTornWrite:
+		return r.Op == OpWriteAt
+	case FaultBitFlip:
+		return r.Op == OpReadAt
+	}
+	return true
+}
+
+func (fs *FaultFS) intn(n int) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.rnd.Intn(n)
+}
+
+// ListDir implements types.VFS.
+func (fs *FaultFS) ListDir(dir string) ([]string, error) {
+	if r := fs.fault(OpListDir, ""); r != nil {
+		return nil, r.Err
+	}
+	return fs.vfs.ListDir(dir)
+}
+
+// Create implements types.VFS.
+func (fs *FaultFS) Create(dir string, name string, size uint64) (types.WritableFile, error) {
+	if r := fs.fault(OpCreate, name); r != nil {
+		return nil, r.Err
+	}
+	wf, err := fs.vfs.Create(dir, name, size)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, name: name, rf: wf, wf: wf}, nil
+}
+
+// Delete implements types.VFS.
+func (fs *FaultFS) Delete(dir string, name string) error {
+	if r := fs.fault(OpDelete, name); r != nil {
+		return r.Err
+	}
+	return fs.vfs.Delete(dir, name)
+}
+
+// OpenReader implements types.VFS.
+func (fs *FaultFS) OpenReader(dir string, name string) (types.ReadableFile, error) {
+	if r := fs.fault(OpOpen, name); r != nil {
+		return nil, r.Err
+	}
+	rf, err := fs.vfs.OpenReader(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, name: name, rf: rf}, nil
+}
+
+// OpenWriter implements types.VFS.
+func (fs *FaultFS) OpenWriter(dir string, name string) (types.WritableFile, error) {
+	if r := fs.fault(OpOpen, name); r != nil {
+		return nil, r.Err
+	}
+	wf, err := fs.vfs.OpenWriter(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, name: name, rf: wf, wf: wf}, nil
+}
+
+// OpenMapped implements types.FileMapper.
+func (fs *FaultFS) OpenMapped(dir string, name string) (types.ReadableFile, error) {
+	fm, ok := fs.vfs.(types.FileMapper)
+	if !ok {
+		return fs.OpenReader(dir, name)
+	}
+	if r := fs.fault(OpOpen, name); r != nil {
+		return nil, r.Err
+	}
+	rf, err := fm.OpenMapped(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, name: name, rf: rf}, nil
+}
+
+// Move implements types.FileMover.
+func (fs *FaultFS) Move(dir, name, newDir, newName string) error {
+	mv, ok := fs.vfs.(types.FileMover)
+	if !ok {
+		return fmt.Errorf("VFS %T can't move files", fs.vfs)
+	}
+	if r := fs.fault(OpMove, name); r != nil {
+		return r.Err
+	}
+	return mv.Move(dir, name, newDir, newName)
+}
+
+// FreeSpace implements types.FreeSpaceReporter.
+func (fs *FaultFS) FreeSpace(dir string) (uint64, error) {
+	fsr, ok := fs.vfs.(types.FreeSpaceReporter)
+	if !ok {
+		return 0, fmt.Errorf("VFS %T can't report free space", fs.vfs)
+	}
+	return fsr.FreeSpace(dir)
+}
+
+// faultFile wraps a file opened through FaultFS. wf is nil for files opened
+// with OpenReader.
+type faultFile struct {
+	fs   *FaultFS
+	name string
+	rf   types.ReadableFile
+	wf   types.WritableFile
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	r := f.fs.fault(OpReadAt, f.name)
+	if r != nil && r.Kind == FaultError {
+		return 0, r.Err
+	}
+	n, err := f.rf.ReadAt(p, off)
+	if r != nil && n > 0 {
+		// FaultBitFlip
+		bit := f.fs.intn(n * 8)
+		p[bit/8] ^= 1 << (bit % 8)
+	}
+	return n, err
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	r := f.fs.fault(OpWriteAt, f.name)
+	if r == nil {
+		return f.wf.WriteAt(p, off)
+	}
+	switch r.Kind {
+	case FaultShortWrite:
+		if len(p) == 0 {
+			return 0, io.ErrShortWrite
+		}
+		n, err := f.wf.WriteAt(p[:f.fs.intn(len(p))], off)
+		if err != nil {
+			return n, err
+		}
+		return n, io.ErrShortWrite
+
+	case FaultTornWrite:
+		// Write a random subset of the sectors the write touches. Sectors are
+		// aligned to the file offset, not the start of p.
+		ss := int64(r.SectorSize)
+		end := off + int64(len(p))
+		for start := off; start < end; {
+			sectorEnd := (start/ss + 1) * ss
+			if sectorEnd > end {
+				sectorEnd = end
+			}
+			if f.fs.intn(2) == 0 {
+				if _, err := f.wf.WriteAt(p[start-off:sectorEnd-off], start); err != nil {
+					return 0, err
+				}
+			}
+			start = sectorEnd
+		}
+		return 0, r.Err
+	}
+	return 0, r.Err
+}
+
+func (f *faultFile) Sync() error {
+	if r := f.fs.fault(OpSync, f.name); r != nil {
+		return r.Err
+	}
+	return f.wf.Sync()
+}
+
+// WriteAlignment implements types.AlignedFile. It's zero if the wrapped file
+// doesn't implement it.
+func (f *faultFile) WriteAlignment() int {
+	if af, ok := f.wf.(types.AlignedFile); ok {
+		return af.WriteAlignment()
+	}
+	return 0
+}
+
+func (f *faultFile) Close() error {
+	return f.rf.Close()
+}
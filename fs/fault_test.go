@@ -0,0 +1,227 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/conformance"
+	"github.com/polarsignals/wal/types"
+)
+
+func newTestFaultFS(t *testing.T, rules ...FaultRule) (*MemFS, *FaultFS) {
+	t.Helper()
+	mem := NewMemFS()
+	mem.Mkdir("/wal")
+	return mem, NewFaultFS(mem, 1, rules...)
+}
+
+func TestFaultFSScript(t *testing.T) {
+	errBoom := errors.New("boom")
+	_, fs := newTestFaultFS(t,
+		FaultRule{Op: OpListDir, Count: 1},
+		FaultRule{Op: OpCreate, File: "*.wal", Count: 1, Err: errBoom},
+		FaultRule{Op: OpSync, After: 2, Count: 1},
+		FaultRule{Op: OpDelete, File: "a.wal"},
+		FaultRule{Op: OpOpen, File: "b.wal"},
+	)
+
+	_, err := fs.ListDir("/wal")
+	require.ErrorIs(t, err, ErrInjected)
+	_, err = fs.ListDir("/wal")
+	require.NoError(t, err)
+
+	// Only files matching the pattern fail.
+	_, err = fs.Create("/wal", "meta", 0)
+	require.NoError(t, err)
+	_, err = fs.Create("/wal", "a.wal", 0)
+	require.ErrorIs(t, err, errBoom)
+	wf, err := fs.Create("/wal", "a.wal", 0)
+	require.NoError(t, err)
+
+	// Third Sync fails, the others succeed.
+	require.NoError(t, wf.Sync())
+	require.NoError(t, wf.Sync())
+	require.ErrorIs(t, wf.Sync(), ErrInjected)
+	require.NoError(t, wf.Sync())
+
+	require.ErrorIs(t, fs.Delete("/wal", "a.wal"), ErrInjected)
+	require.NoError(t, fs.Delete("/wal", "meta"))
+
+	_, err = fs.Create("/wal", "b.wal", 0)
+	require.NoError(t, err)
+	_, err = fs.OpenReader("/wal", "b.wal")
+	require.ErrorIs(t, err, ErrInjected)
+	_, err = fs.OpenWriter("/wal", "a.wal")
+	require.NoError(t, err)
+
+	require.Equal(t, 5, fs.Injected())
+
+	fs.ClearRules()
+	require.NoError(t, fs.Delete("/wal", "a.wal"))
+}
+
+func TestFaultFSProbability(t *testing.T) {
+	_, fs := newTestFaultFS(t, FaultRule{Op: OpListDir, Probability: 0.5})
+
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := fs.ListDir("/wal"); err != nil {
+			failed++
+		}
+	}
+	require.InDelta(t, 500, failed, 100)
+	require.Equal(t, failed, fs.Injected())
+}
+
+func TestFaultFSWrites(t *testing.T) {
+	mem, fs := newTestFaultFS(t)
+
+	wf, err := fs.Create("/wal", "a.wal", 0)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte{'x'}, 4096)
+
+	fs.AddRules(FaultRule{Op: OpWriteAt, Kind: FaultShortWrite, Count: 1})
+	n, err := wf.WriteAt(data, 0)
+	require.ErrorIs(t, err, io.ErrShortWrite)
+	require.Less(t, n, len(data))
+
+	// Torn writes leave some sectors written and others not. Start with a file
+	// of zeros so we can tell which.
+	fs.ClearRules()
+	_, err = wf.WriteAt(make([]byte, 8192), 0)
+	require.NoError(t, err)
+
+	fs.AddRules(FaultRule{Op: OpWriteAt, Kind: FaultTornWrite, Count: 1, SectorSize: 1024})
+	_, err = wf.WriteAt(data, 512)
+	require.ErrorIs(t, err, ErrInjected)
+
+	rf, err := mem.OpenReader("/wal", "a.wal")
+	require.NoError(t, err)
+	got := make([]byte, 8192)
+	_, err = rf.ReadAt(got, 0)
+	require.NoError(t, err)
+
+	require.Equal(t, make([]byte, 512), got[:512], "data before the write must be untouched")
+	require.Equal(t, make([]byte, 8192-4608), got[4608:], "data after the write must be untouched")
+	// Each sector is either entirely old or entirely new.
+	written := 0
+	for _, r := range [][2]int{{512, 1024}, {1024, 2048}, {2048, 3072}, {3072, 4096}, {4096, 4608}} {
+		sector := got[r[0]:r[1]]
+		switch {
+		case bytes.Equal(sector, data[:len(sector)]):
+			written++
+		case bytes.Equal(sector, make([]byte, len(sector))):
+		default:
+			t.Fatalf("sector %v was partially written", r)
+		}
+	}
+	require.Greater(t, written, 0, "seed should write some sectors")
+	require.Less(t, written, 5, "seed should skip some sectors")
+}
+
+func TestFaultFSReads(t *testing.T) {
+	_, fs := newTestFaultFS(t)
+
+	wf, err := fs.Create("/wal", "a.wal", 0)
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte{'x'}, 64)
+	_, err = wf.WriteAt(data, 0)
+	require.NoError(t, err)
+
+	fs.AddRules(
+		FaultRule{Op: OpReadAt, Kind: FaultBitFlip, Count: 1},
+		FaultRule{Op: OpReadAt, Count: 1},
+	)
+	got := make([]byte, 64)
+	n, err := wf.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, 64, n)
+
+	diff := 0
+	for i := range got {
+		for b := got[i] ^ data[i]; b != 0; b &= b - 1 {
+			diff++
+		}
+	}
+	require.Equal(t, 1, diff)
+
+	_, err = wf.ReadAt(got, 0)
+	require.ErrorIs(t, err, ErrInjected)
+
+	_, err = wf.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestFaultFSLatency(t *testing.T) {
+	_, fs := newTestFaultFS(t,
+		FaultRule{Op: OpListDir, Kind: FaultLatency, Latency: 50 * time.Millisecond, Count: 1},
+		// Rules with a kind that doesn't apply to the op are ignored.
+		FaultRule{Op: OpListDir, Kind: FaultBitFlip},
+	)
+
+	start := time.Now()
+	_, err := fs.ListDir("/wal")
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Equal(t, 0, fs.Injected())
+}
+
+func TestFaultFSOptionalInterfaces(t *testing.T) {
+	mem, fs := newTestFaultFS(t, FaultRule{Op: OpMove, File: "a.wal", Count: 1})
+
+	wf, err := fs.Create("/wal", "a.wal", 0)
+	require.NoError(t, err)
+	_, err = wf.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, wf.(types.AlignedFile).WriteAlignment())
+	require.NoError(t, wf.Close())
+
+	// Faults are injected on Move and then it's forwarded.
+	require.ErrorIs(t, fs.Move("/wal", "a.wal", "/wal/q", "b.wal"), ErrInjected)
+	require.NoError(t, fs.Move("/wal", "a.wal", "/wal/q", "b.wal"))
+	names, err := mem.ListDir("/wal/q")
+	require.NoError(t, err)
+	require.Equal(t, []string{"b.wal"}, names)
+
+	// MemFS can't map files so OpenMapped falls back to OpenReader, including
+	// its faults.
+	fs.AddRules(FaultRule{Op: OpOpen, Count: 1})
+	_, err = fs.OpenMapped("/wal/q", "b.wal")
+	require.ErrorIs(t, err, ErrInjected)
+	rf, err := fs.OpenMapped("/wal/q", "b.wal")
+	require.NoError(t, err)
+	got := make([]byte, 5)
+	_, err = rf.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(got))
+	require.NoError(t, rf.Close())
+
+	// Nor report free space.
+	_, err = fs.FreeSpace("/wal")
+	require.Error(t, err)
+
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("free space reporting not supported on", runtime.GOOS)
+	}
+	free, err := NewFaultFS(New(), 1).FreeSpace(t.TempDir())
+	require.NoError(t, err)
+	require.Greater(t, free, uint64(0))
+}
+
+func TestFaultFSConformance(t *testing.T) {
+	// With no rules FaultFS must behave exactly like the VFS it wraps.
+	conformance.TestVFS(t, func(t *testing.T) (types.VFS, string) {
+		_, fs := newTestFaultFS(t)
+		return fs, "/wal"
+	})
+}
@@ -6,11 +6,15 @@ package fs
 import (
 	"os"
 	"sync/atomic"
+	"unsafe"
 
 	"github.com/polarsignals/wal/types"
 )
 
-var _ types.WritableFile = &File{}
+var (
+	_ types.WritableFile = &File{}
+	_ types.AlignedFile  = &File{}
+)
 
 // File wraps an os.File and implements types.WritableFile. It ensures that the
 // first time Sync is called on the file, that the parent directory is also
@@ -20,17 +24,59 @@ var _ types.WritableFile = &File{}
 // but still ensure all required fsyncs are done by the time we acknowledge
 // committed data in the new file.
 type File struct {
-	new uint32 // atomically accessed, keep it aligned!
-	dir string
+	new  uint32 // atomically accessed, keep it aligned!
+	dir  string
+	sync SyncMode
+	// direct is the same file opened with O_DIRECT if direct I/O is enabled.
+	direct *os.File
 	os.File
 }
 
-// Sync calls fsync on the underlying file. If this is the first call to Sync
-// since creation it also fsyncs the parent dir.
+// WriteAt implements io.WriterAt. Running out of space is reported as an
+// error wrapping types.ErrDiskFull. With direct I/O, writes aligned to
+// DirectIOAlignment bypass the page cache and others go through it.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if f.direct != nil && isAligned(p, off) {
+		n, err := f.direct.WriteAt(p, off)
+		return n, mapDiskFull(err)
+	}
+	n, err := f.File.WriteAt(p, off)
+	return n, mapDiskFull(err)
+}
+
+// WriteAlignment implements types.AlignedFile. It's DirectIOAlignment if
+// direct I/O is enabled and zero otherwise.
+func (f *File) WriteAlignment() int {
+	if f.direct == nil {
+		return 0
+	}
+	return DirectIOAlignment
+}
+
+// Close closes the file, including the direct I/O handle if there is one.
+func (f *File) Close() error {
+	if f.direct != nil {
+		f.direct.Close()
+	}
+	return f.File.Close()
+}
+
+// Sync makes everything written so far durable using the configured SyncMode.
+// If this is the first call to Sync since creation it also fsyncs the parent
+// dir.
 func (f *File) Sync() error {
-	// Sync the underlying file
-	if err := f.File.Sync(); err != nil {
-		return err
+	// Sync the underlying file. O_DSYNC already made every write durable. Even
+	// with direct I/O the device cache still has to be flushed.
+	var err error
+	switch f.sync {
+	case SyncData:
+		err = fdatasync(&f.File)
+	case SyncDSync:
+	default:
+		err = f.File.Sync()
+	}
+	if err != nil {
+		return mapDiskFull(err)
 	}
 	new := atomic.SwapUint32(&f.new, 1)
 	if new == 0 {
@@ -38,3 +84,9 @@ func (f *File) Sync() error {
 	}
 	return nil
 }
+
+// isAligned returns whether p can be written at off with O_DIRECT.
+func isAligned(p []byte, off int64) bool {
+	return len(p) > 0 && len(p)%DirectIOAlignment == 0 && off%DirectIOAlignment == 0 &&
+		uintptr(unsafe.Pointer(&p[0]))%DirectIOAlignment == 0
+}
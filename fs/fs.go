@@ -4,11 +4,13 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/polarsignals/wal/types"
 )
@@ -19,8 +21,11 @@ import (
 // TODO if we changed the interface to be Dir centric we could cache the open
 // dir handle and save some time opening it on each Create in order to fsync.
 type FS struct {
+	opts Options
 }
 
+// New returns an FS that syncs with fsync and writes through the page cache.
+// Use NewWithOptions to change that.
 func New() *FS {
 	return &FS{}
 }
@@ -34,12 +39,13 @@ func (fs *FS) ListDir(dir string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	names := make([]string, len(files))
-	for i, f := range files {
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		// Subdirectories such as the segment quarantine aren't files.
 		if f.IsDir() {
 			continue
 		}
-		names[i] = f.Name()
+		names = append(names, f.Name())
 	}
 	return names, nil
 }
@@ -50,19 +56,22 @@ func (fs *FS) ListDir(dir string) ([]string, error) {
 // that size. The dir must already exist and be writable to the current
 // process.
 func (fs *FS) Create(dir string, name string, size uint64) (types.WritableFile, error) {
-	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_RDWR, os.FileMode(0644))
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_RDWR|fs.syncFlag(), os.FileMode(0644))
 	if err != nil {
 		return nil, err
 	}
 	// We just created the file. Preallocate it's size.
 	if size > 0 {
-		if size > math.MaxInt32 {
-			return nil, fmt.Errorf("maximum file size is %d bytes", math.MaxInt32)
+		if size > math.MaxInt64 {
+			return nil, fmt.Errorf("maximum file size is %d bytes", int64(math.MaxInt64))
 		}
 
 		if err := prealloc(f, int64(size), true); err != nil {
+			// Don't leave a partially allocated file behind, otherwise a retry
+			// once space has been freed would fail because the file exists.
 			f.Close()
-			return nil, err
+			os.Remove(f.Name())
+			return nil, mapDiskFull(err)
 		}
 	}
 	// We don't fsync here for performance reasons. Technically we need to fsync
@@ -79,10 +88,11 @@ func (fs *FS) Create(dir string, name string, size uint64) (types.WritableFile,
 	//
 	// To handle that, we return a wrapped io.File that will fsync the parent dir
 	// as well the first time Sync is called (and only the first time),
-	fi := &File{
-		new:  0,
-		dir:  dir,
-		File: *f,
+	fi, err := fs.newFile(f, dir, 0)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
 	}
 	return fi, nil
 }
@@ -111,5 +121,82 @@ func (fs *FS) OpenReader(dir string, name string) (types.ReadableFile, error) {
 // about the well-formedness of the file, it may be empty, the wrong size or
 // corrupt in arbitrary ways.
 func (fs *FS) OpenWriter(dir string, name string) (types.WritableFile, error) {
-	return os.OpenFile(filepath.Join(dir, name), os.O_RDWR, os.FileMode(0644))
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|fs.syncFlag(), os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+	// The file already existed so there is no need to fsync the parent dir.
+	fi, err := fs.newFile(f, dir, 1)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fi, nil
+}
+
+// newFile wraps f, which was opened read-write, opening it again with O_DIRECT
+// if direct I/O is enabled.
+func (fs *FS) newFile(f *os.File, dir string, new uint32) (*File, error) {
+	fi := &File{
+		new:  new,
+		dir:  dir,
+		sync: fs.opts.Sync,
+		File: *f,
+	}
+	if fs.opts.DirectIO {
+		df, err := os.OpenFile(f.Name(), os.O_WRONLY|directFlag|fs.syncFlag(), 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s for direct I/O: %w", f.Name(), err)
+		}
+		fi.direct = df
+	}
+	return fi, nil
+}
+
+// syncFlag returns the extra flag files opened for writing need for the sync
+// mode.
+func (fs *FS) syncFlag() int {
+	if fs.opts.Sync == SyncDSync {
+		return dsyncFlag
+	}
+	return 0
+}
+
+// Move implements types.FileMover. It renames name in dir to newName in
+// newDir, creating newDir if it doesn't exist, and fsyncs both directories.
+// Both directories must be on the same file system.
+func (fs *FS) Move(dir, name, newDir, newName string) error {
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(newDir, newName)
+	// Rename silently replaces an existing file which we never want.
+	if _, err := os.Lstat(dst); err == nil {
+		return &os.PathError{Op: "rename", Path: dst, Err: os.ErrExist}
+	}
+	if err := os.Rename(filepath.Join(dir, name), dst); err != nil {
+		return err
+	}
+	if err := syncDir(newDir); err != nil {
+		return err
+	}
+	if filepath.Clean(dir) == filepath.Clean(newDir) {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// FreeSpace implements types.FreeSpaceReporter. It returns the number of bytes
+// available to unprivileged users on the file system containing dir.
+func (fs *FS) FreeSpace(dir string) (uint64, error) {
+	return freeSpace(dir)
+}
+
+// mapDiskFull wraps errors caused by the device running out of space so that
+// they match types.ErrDiskFull while still matching the original error too.
+func mapDiskFull(err error) error {
+	if err != nil && errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %w", types.ErrDiskFull, err)
+	}
+	return err
 }
@@ -5,12 +5,21 @@ package fs
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
 	"testing"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/conformance"
+	"github.com/polarsignals/wal/types"
 )
 
 func TestFS(t *testing.T) {
@@ -129,3 +138,140 @@ func TestRealFSNoDir(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, strings.ToLower(err.Error()), "no such file or directory")
 }
+
+func TestMapDiskFull(t *testing.T) {
+	err := mapDiskFull(&os.PathError{Op: "write", Path: "foo", Err: syscall.ENOSPC})
+	require.ErrorIs(t, err, types.ErrDiskFull)
+	require.ErrorIs(t, err, syscall.ENOSPC)
+
+	err = mapDiskFull(os.ErrPermission)
+	require.NotErrorIs(t, err, types.ErrDiskFull)
+
+	require.NoError(t, mapDiskFull(nil))
+}
+
+func TestFreeSpace(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("free space reporting not supported on", runtime.GOOS)
+	}
+	free, err := New().FreeSpace(t.TempDir())
+	require.NoError(t, err)
+	require.Greater(t, free, uint64(0))
+}
+
+func TestFSConformance(t *testing.T) {
+	conformance.TestVFS(t, func(t *testing.T) (types.VFS, string) {
+		return New(), t.TempDir()
+	})
+}
+
+func TestOpenMapped(t *testing.T) {
+	fm, ok := interface{}(New()).(types.FileMapper)
+	if !ok {
+		t.Skip("mmap not supported on", runtime.GOOS)
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "f"), []byte("hello mapped world"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "empty"), nil, 0644))
+
+	rf, err := fm.OpenMapped(dir, "f")
+	require.NoError(t, err)
+
+	buf := make([]byte, 6)
+	n, err := rf.ReadAt(buf, 6)
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	require.Equal(t, "mapped", string(buf))
+
+	// Short reads at the end of the file return EOF.
+	n, err = rf.ReadAt(buf, 13)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, "world", string(buf[:n]))
+	_, err = rf.ReadAt(buf, 100)
+	require.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, rf.Close())
+	_, err = rf.ReadAt(buf, 0)
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	rf, err = fm.OpenMapped(dir, "empty")
+	require.NoError(t, err)
+	_, err = rf.ReadAt(buf, 0)
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, rf.Close())
+
+	_, err = fm.OpenMapped(dir, "missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFSOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		_, err := NewWithOptions(Options{Sync: SyncData})
+		require.Error(t, err)
+		_, err = NewWithOptions(Options{DirectIO: true})
+		require.Error(t, err)
+		t.Skip("sync modes and direct I/O not supported on", runtime.GOOS)
+	}
+	_, err := NewWithOptions(Options{Sync: SyncMode(42)})
+	require.ErrorContains(t, err, "unknown sync mode")
+
+	for _, opts := range []Options{
+		{Sync: SyncData},
+		{Sync: SyncDSync},
+		{Sync: SyncFull, DirectIO: true},
+		{Sync: SyncData, DirectIO: true},
+		{Sync: SyncDSync, DirectIO: true},
+	} {
+		opts := opts
+		t.Run(fmt.Sprintf("%s/direct=%v", opts.Sync, opts.DirectIO), func(t *testing.T) {
+			fs, err := NewWithOptions(opts)
+			require.NoError(t, err)
+			dir := t.TempDir()
+
+			wf, err := fs.Create(dir, "seg.wal", 64*1024)
+			if opts.DirectIO && errors.Is(err, syscall.EINVAL) {
+				t.Skip("file system doesn't support O_DIRECT")
+			}
+			require.NoError(t, err)
+
+			wantAlign := 0
+			if opts.DirectIO {
+				wantAlign = DirectIOAlignment
+			}
+			require.Equal(t, wantAlign, wf.(types.AlignedFile).WriteAlignment())
+
+			// Aligned and unaligned writes both work.
+			aligned := alignedTestBuffer(DirectIOAlignment)
+			copy(aligned, bytes.Repeat([]byte{'a'}, DirectIOAlignment))
+			n, err := wf.WriteAt(aligned, DirectIOAlignment)
+			require.NoError(t, err)
+			require.Equal(t, DirectIOAlignment, n)
+			n, err = wf.WriteAt([]byte("unaligned"), 3)
+			require.NoError(t, err)
+			require.Equal(t, 9, n)
+			require.NoError(t, wf.Sync())
+			require.NoError(t, wf.Close())
+
+			wf, err = fs.OpenWriter(dir, "seg.wal")
+			require.NoError(t, err)
+			buf := make([]byte, DirectIOAlignment)
+			_, err = wf.ReadAt(buf, DirectIOAlignment)
+			require.NoError(t, err)
+			require.Equal(t, aligned, buf)
+			_, err = wf.ReadAt(buf[:9], 3)
+			require.NoError(t, err)
+			require.Equal(t, "unaligned", string(buf[:9]))
+			require.NoError(t, wf.Close())
+
+			conformance.TestVFS(t, func(t *testing.T) (types.VFS, string) {
+				return fs, t.TempDir()
+			})
+		})
+	}
+}
+
+func alignedTestBuffer(n int) []byte {
+	buf := make([]byte, n+DirectIOAlignment)
+	off := DirectIOAlignment - int(uintptr(unsafe.Pointer(&buf[0]))%DirectIOAlignment)
+	return buf[off : off+n]
+}
@@ -0,0 +1,355 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// MemFS implements types.VFS entirely in memory. It's intended for tests that
+// want to exercise the WAL without touching disk. Directories must be created
+// with Mkdir before files can be created in them, just like with FS.
+//
+// MemFS tracks which data has been synced so that Crash can simulate a power
+// loss where everything written since the last Sync of each file is lost.
+type MemFS struct {
+	mu   sync.Mutex
+	dirs map[string]map[string]*memFile
+
+	// gen is incremented on every Crash so that handles opened before the crash
+	// stop working.
+	gen uint64
+}
+
+var (
+	_ types.VFS          = (*MemFS)(nil)
+	_ types.WritableFile = (*memHandle)(nil)
+)
+
+// NewMemFS returns an empty in-memory file system.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		dirs: make(map[string]map[string]*memFile),
+	}
+}
+
+// Mkdir creates an empty directory. It's a no-op if the directory already
+// exists.
+func (fs *MemFS) Mkdir(dir string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir = filepath.Clean(dir)
+	if _, ok := fs.dirs[dir]; !ok {
+		fs.dirs[dir] = make(map[string]*memFile)
+	}
+}
+
+// ListDir returns a list of all files in the specified dir in lexicographical
+// order. If the dir doesn't exist, it must return an error. Empty array with
+// nil error is assumed to mean that the directory exists and was readable,
+// but contains no files.
+func (fs *MemFS) ListDir(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	files, err := fs.dirLocked("open", dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Create creates a new file with the given name. If a file with the same name
+// already exists an error is returned. If a non-zero size is given the file is
+// zero-filled to that size. The dir must already exist.
+func (fs *MemFS) Create(dir string, name string, size uint64) (types.WritableFile, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	files, err := fs.dirLocked("open", dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := files[name]; ok {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(dir, name), Err: syscall.EEXIST}
+	}
+	f := &memFile{
+		name: filepath.Join(dir, name),
+		data: make([]byte, size),
+	}
+	files[name] = f
+	return &memHandle{fs: fs, f: f, gen: fs.gen}, nil
+}
+
+// Delete removes the file. Like FS.Delete the removal is durable as soon as it
+// returns. Handles that are already open can still be used, as on unix.
+func (fs *MemFS) Delete(dir string, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	files, err := fs.dirLocked("remove", dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: filepath.Join(dir, name), Err: syscall.ENOENT}
+	}
+	delete(files, name)
+	return nil
+}
+
+// Move implements types.FileMover. newDir is created if it doesn't exist.
+// Like Delete the move is durable as soon as it returns.
+func (fs *MemFS) Move(dir, name, newDir, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	files, err := fs.dirLocked("rename", dir)
+	if err != nil {
+		return err
+	}
+	f, ok := files[name]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: filepath.Join(dir, name), Err: syscall.ENOENT}
+	}
+	newDir = filepath.Clean(newDir)
+	newFiles, ok := fs.dirs[newDir]
+	if !ok {
+		newFiles = make(map[string]*memFile)
+		fs.dirs[newDir] = newFiles
+	}
+	if _, ok := newFiles[newName]; ok {
+		return &os.PathError{Op: "rename", Path: filepath.Join(newDir, newName), Err: syscall.EEXIST}
+	}
+	delete(files, name)
+	f.name = filepath.Join(newDir, newName)
+	newFiles[newName] = f
+	return nil
+}
+
+// OpenReader opens an existing file in read-only mode. If the file doesn't
+// exist an error is returned.
+func (fs *MemFS) OpenReader(dir string, name string) (types.ReadableFile, error) {
+	return fs.open(dir, name, true)
+}
+
+// OpenWriter opens an existing file in read-write mode. If the file doesn't
+// exist an error is returned.
+func (fs *MemFS) OpenWriter(dir string, name string) (types.WritableFile, error) {
+	return fs.open(dir, name, false)
+}
+
+func (fs *MemFS) open(dir, name string, readOnly bool) (*memHandle, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	files, err := fs.dirLocked("open", dir)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(dir, name), Err: syscall.ENOENT}
+	}
+	return &memHandle{fs: fs, f: f, gen: fs.gen, readOnly: readOnly}, nil
+}
+
+// Crash simulates the machine losing power. Every write made since the last
+// Sync of each file is undone and files that were created but never synced
+// disappear. All handles opened before the crash return os.ErrClosed from then
+// on, as if the process died with them.
+func (fs *MemFS) Crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.gen++
+	for _, files := range fs.dirs {
+		for name, f := range files {
+			if !f.crash() {
+				delete(files, name)
+			}
+		}
+	}
+}
+
+func (fs *MemFS) dirLocked(op, dir string) (map[string]*memFile, error) {
+	files, ok := fs.dirs[filepath.Clean(dir)]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: dir, Err: syscall.ENOENT}
+	}
+	return files, nil
+}
+
+func (fs *MemFS) generation() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.gen
+}
+
+// memFile is the contents of a file in a MemFS.
+type memFile struct {
+	name string
+
+	mu      sync.RWMutex
+	data    []byte
+	durable bool
+	// undo records the prior contents of every range written since the last
+	// Sync, oldest first, so Crash can roll them back.
+	undo []memUndo
+}
+
+type memUndo struct {
+	off int64
+	old []byte
+	len int
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off < 0 {
+		return 0, syscall.EINVAL
+	}
+	u := memUndo{off: off, len: len(f.data)}
+	end := off + int64(len(p))
+	if off < int64(len(f.data)) {
+		oldEnd := end
+		if oldEnd > int64(len(f.data)) {
+			oldEnd = int64(len(f.data))
+		}
+		u.old = append([]byte(nil), f.data[off:oldEnd]...)
+	}
+	if end > int64(len(f.data)) {
+		if end <= int64(cap(f.data)) {
+			f.data = f.data[:end]
+		} else {
+			nb := make([]byte, end, end*2)
+			copy(nb, f.data)
+			f.data = nb
+		}
+	}
+	copy(f.data[off:], p)
+	f.undo = append(f.undo, u)
+	return len(p), nil
+}
+
+func (f *memFile) sync() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.undo = nil
+	f.durable = true
+}
+
+// crash rolls back unsynced writes. It returns false if the file itself was
+// never synced and so wouldn't exist after a crash.
+func (f *memFile) crash() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.durable {
+		return false
+	}
+	for i := len(f.undo) - 1; i >= 0; i-- {
+		u := f.undo[i]
+		copy(f.data[u.off:], u.old)
+		// Zero anything past the old length before shrinking so that a later
+		// extension doesn't resurrect the lost bytes.
+		for j := u.len; j < len(f.data); j++ {
+			f.data[j] = 0
+		}
+		f.data = f.data[:u.len]
+	}
+	f.undo = nil
+	return true
+}
+
+// memHandle is an open MemFS file.
+type memHandle struct {
+	fs       *MemFS
+	f        *memFile
+	gen      uint64
+	readOnly bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (h *memHandle) check(op string) error {
+	h.mu.Lock()
+	closed := h.closed
+	h.mu.Unlock()
+	if closed || h.fs.generation() != h.gen {
+		return &os.PathError{Op: op, Path: h.f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+// ReadAt implements io.ReaderAt with the same semantics as os.File.
+func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
+	if err := h.check("read"); err != nil {
+		return 0, err
+	}
+	return h.f.readAt(p, off)
+}
+
+// WriteAt implements io.WriterAt. Writes past the end of the file extend it.
+func (h *memHandle) WriteAt(p []byte, off int64) (int, error) {
+	if err := h.check("write"); err != nil {
+		return 0, err
+	}
+	if h.readOnly {
+		return 0, &os.PathError{Op: "write", Path: h.f.name, Err: syscall.EBADF}
+	}
+	return h.f.writeAt(p, off)
+}
+
+// Sync makes all writes to the file so far survive a Crash.
+func (h *memHandle) Sync() error {
+	if err := h.check("sync"); err != nil {
+		return err
+	}
+	h.f.sync()
+	return nil
+}
+
+// Close closes the handle. Further operations on it return os.ErrClosed.
+func (h *memHandle) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return &os.PathError{Op: "close", Path: h.f.name, Err: os.ErrClosed}
+	}
+	h.closed = true
+	return nil
+}
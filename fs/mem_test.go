@@ -0,0 +1,196 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/conformance"
+	"github.com/polarsignals/wal/types"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	fs.Mkdir("/wal")
+
+	// List should return nothing
+	files, err := fs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{}, files)
+
+	// Create a new file
+	wf, err := fs.Create("/wal", "00002-abcd1234.wal", 4096)
+	require.NoError(t, err)
+	defer wf.Close()
+
+	// Creating it again fails.
+	_, err = fs.Create("/wal", "00002-abcd1234.wal", 4096)
+	require.ErrorIs(t, err, os.ErrExist)
+
+	// Preallocated space reads as zeros.
+	var buf [1024]byte
+	buf[0] = 'x'
+	n, err := wf.ReadAt(buf[:], 3072)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, byte(0), buf[0])
+
+	// Should be able to write data in any order and past the preallocated end.
+	_, err = wf.WriteAt(bytes.Repeat([]byte{'2'}, 1024), 1024)
+	require.NoError(t, err)
+	_, err = wf.WriteAt(bytes.Repeat([]byte{'1'}, 1024), 0)
+	require.NoError(t, err)
+	n, err = wf.WriteAt(bytes.Repeat([]byte{'3'}, 1024), 4096)
+	require.NoError(t, err)
+	require.Equal(t, 1024, n)
+	require.NoError(t, wf.Sync())
+
+	rf, err := fs.OpenReader("/wal", "00002-abcd1234.wal")
+	require.NoError(t, err)
+	defer rf.Close()
+
+	n, err = rf.ReadAt(buf[:], 1024)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, byte('2'), buf[0])
+
+	n, err = rf.ReadAt(buf[:], 4096)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, byte('3'), buf[0])
+
+	// Short read at the end returns EOF along with the data.
+	n, err = rf.ReadAt(buf[:], 4608)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 512, n)
+
+	// Read off end is an error
+	_, err = rf.ReadAt(buf[:], 8192)
+	require.ErrorIs(t, err, io.EOF)
+
+	// Readers can't write.
+	_, err = rf.(*memHandle).WriteAt([]byte{1}, 0)
+	require.Error(t, err)
+
+	// Re-open writable and write more which the open reader can see.
+	require.NoError(t, wf.Close())
+	_, err = wf.WriteAt([]byte{1}, 0)
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	wf, err = fs.OpenWriter("/wal", "00002-abcd1234.wal")
+	require.NoError(t, err)
+	_, err = wf.WriteAt(bytes.Repeat([]byte{'4'}, 1024), 2048)
+	require.NoError(t, err)
+
+	n, err = rf.ReadAt(buf[:], 2047)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, byte('2'), buf[0])
+	require.Equal(t, byte('4'), buf[1])
+
+	// List is sorted.
+	_, err = fs.Create("/wal", "00001-abcd1234.wal", 0)
+	require.NoError(t, err)
+	files, err = fs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{"00001-abcd1234.wal", "00002-abcd1234.wal"}, files)
+
+	// Delete should work and leave open handles readable.
+	require.NoError(t, fs.Delete("/wal", "00002-abcd1234.wal"))
+	files, err = fs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{"00001-abcd1234.wal"}, files)
+
+	_, err = rf.ReadAt(buf[:], 0)
+	require.NoError(t, err)
+
+	_, err = fs.OpenReader("/wal", "00002-abcd1234.wal")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorIs(t, fs.Delete("/wal", "00002-abcd1234.wal"), os.ErrNotExist)
+}
+
+func TestMemFSNoDir(t *testing.T) {
+	fs := NewMemFS()
+
+	_, err := fs.ListDir("/not-a-real-dir")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.Contains(t, strings.ToLower(err.Error()), "no such file or directory")
+
+	_, err = fs.Create("/not-a-real-dir", "foo", 1024)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = fs.OpenReader("/not-a-real-dir", "foo")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = fs.OpenWriter("/not-a-real-dir", "foo")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	require.ErrorIs(t, fs.Delete("/not-a-real-dir", "foo"), os.ErrNotExist)
+}
+
+func TestMemFSCrash(t *testing.T) {
+	fs := NewMemFS()
+	fs.Mkdir("/wal")
+
+	// A file that is never synced doesn't survive.
+	_, err := fs.Create("/wal", "unsynced", 0)
+	require.NoError(t, err)
+
+	wf, err := fs.Create("/wal", "synced", 16)
+	require.NoError(t, err)
+	_, err = wf.WriteAt([]byte("hello"), 0)
+	require.NoError(t, err)
+	require.NoError(t, wf.Sync())
+
+	// Overwrite synced data and extend the file without syncing.
+	_, err = wf.WriteAt([]byte("HE"), 0)
+	require.NoError(t, err)
+	_, err = wf.WriteAt([]byte("world"), 14)
+	require.NoError(t, err)
+	_, err = wf.WriteAt([]byte("!!"), 20)
+	require.NoError(t, err)
+
+	fs.Crash()
+
+	// Old handles are dead.
+	_, err = wf.WriteAt([]byte("x"), 0)
+	require.ErrorIs(t, err, os.ErrClosed)
+	require.ErrorIs(t, wf.Sync(), os.ErrClosed)
+
+	files, err := fs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{"synced"}, files)
+
+	rf, err := fs.OpenReader("/wal", "synced")
+	require.NoError(t, err)
+	buf := make([]byte, 32)
+	n, err := rf.ReadAt(buf, 0)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 16, n)
+	require.Equal(t, append([]byte("hello"), make([]byte, 11)...), buf[:n])
+
+	// Extending the file again doesn't resurrect lost bytes.
+	wf, err = fs.OpenWriter("/wal", "synced")
+	require.NoError(t, err)
+	_, err = wf.WriteAt([]byte("?"), 23)
+	require.NoError(t, err)
+	n, err = wf.ReadAt(buf, 0)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 24, n)
+	require.Equal(t, make([]byte, 7), buf[16:23])
+}
+
+func TestMemFSConformance(t *testing.T) {
+	conformance.TestVFS(t, func(t *testing.T) (types.VFS, string) {
+		fs := NewMemFS()
+		fs.Mkdir("/wal")
+		return fs, "/wal"
+	})
+}
@@ -0,0 +1,91 @@
+//go:build linux || darwin
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/polarsignals/wal/types"
+)
+
+var _ types.FileMapper = &FS{}
+
+// OpenMapped implements types.FileMapper. It maps the whole file read-only
+// into memory. Later writes to the file, for example by another process, are
+// visible through the mapping but growing it is not.
+func (fs *FS) OpenMapped(dir string, name string) (types.ReadableFile, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	// The mapping stays valid after the file is closed.
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		// mmap fails for empty files, there's nothing to read anyway.
+		return &mappedFile{}, nil
+	}
+	if fi.Size() > math.MaxInt {
+		return nil, fmt.Errorf("file %s is too large to map: %d bytes", name, fi.Size())
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: err}
+	}
+	return &mappedFile{data: data}, nil
+}
+
+// mappedFile serves reads from a read-only memory mapping of a file.
+type mappedFile struct {
+	// mu stops the mapping being unmapped while a read is copying from it.
+	mu     sync.RWMutex
+	data   []byte
+	closed bool
+}
+
+// ReadAt implements io.ReaderAt.
+func (m *mappedFile) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close unmaps the file. It must only be called once nothing else can read
+// from it.
+func (m *mappedFile) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return os.ErrClosed
+	}
+	m.closed = true
+	if m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
@@ -0,0 +1,78 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package fs
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// SyncMode selects how a File makes written data durable.
+type SyncMode int
+
+const (
+	// SyncFull makes Sync call fsync. It's the default and works everywhere.
+	SyncFull SyncMode = iota
+
+	// SyncData makes Sync call fdatasync, which skips flushing metadata that
+	// isn't needed to read the data back such as the modification time. It's
+	// cheaper than fsync when appending to preallocated files since their size
+	// doesn't change. Linux only.
+	SyncData
+
+	// SyncDSync opens files with O_DSYNC so every write is durable once it
+	// returns and Sync only needs to persist the directory entry of a new
+	// file. Linux only.
+	SyncDSync
+)
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncFull:
+		return "fsync"
+	case SyncData:
+		return "fdatasync"
+	case SyncDSync:
+		return "dsync"
+	}
+	return fmt.Sprintf("SyncMode(%d)", int(m))
+}
+
+// Options configures how FS opens and syncs files it writes to. The zero value
+// is what New uses.
+type Options struct {
+	// Sync selects how written data is made durable.
+	Sync SyncMode
+
+	// DirectIO opens writable files a second time with O_DIRECT and sends
+	// writes that are aligned to DirectIOAlignment through it so they bypass
+	// the page cache. That stops appends evicting data other readers need on
+	// nodes that read heavily. Other writes and all reads still use the page
+	// cache, see types.AlignedFile. The file system must support O_DIRECT,
+	// tmpfs for example doesn't. Linux only.
+	DirectIO bool
+}
+
+// DirectIOAlignment is the alignment writes need to go through O_DIRECT when
+// Options.DirectIO is set. It's a multiple of the logical block size of any
+// device we expect to run on.
+const DirectIOAlignment = 4096
+
+// NewWithOptions returns an FS configured by opts. It returns an error if opts
+// aren't supported on this platform.
+func NewWithOptions(opts Options) (*FS, error) {
+	switch opts.Sync {
+	case SyncFull:
+	case SyncData, SyncDSync:
+		if !syncModesSupported {
+			return nil, fmt.Errorf("sync mode %s is not supported on %s", opts.Sync, runtime.GOOS)
+		}
+	default:
+		return nil, fmt.Errorf("unknown sync mode %d", int(opts.Sync))
+	}
+	if opts.DirectIO && !directIOSupported {
+		return nil, fmt.Errorf("direct I/O is not supported on %s", runtime.GOOS)
+	}
+	return &FS{opts: opts}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package fs
+
+import "errors"
+
+var errFreeSpaceUnsupported = errors.New("free space reporting is not supported on this platform")
+
+func freeSpace(_ string) (uint64, error) {
+	return 0, errFreeSpaceUnsupported
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	syncModesSupported = true
+	directIOSupported  = true
+
+	dsyncFlag  = syscall.O_DSYNC
+	directFlag = syscall.O_DIRECT
+)
+
+func fdatasync(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var syncErr error
+	if err := rc.Control(func(fd uintptr) {
+		syncErr = syscall.Fdatasync(int(fd))
+	}); err != nil {
+		return err
+	}
+	if syncErr != nil {
+		return &os.PathError{Op: "fdatasync", Path: f.Name(), Err: syncErr}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package fs
+
+import "os"
+
+const (
+	syncModesSupported = false
+	directIOSupported  = false
+
+	dsyncFlag  = 0
+	directFlag = 0
+)
+
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
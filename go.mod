@@ -13,6 +13,7 @@ require (
 	github.com/prometheus/client_golang v1.15.0
 	github.com/stretchr/testify v1.8.2
 	go.etcd.io/bbolt v1.3.6
+	google.golang.org/protobuf v1.30.0
 )
 
 require (
@@ -33,6 +34,5 @@ require (
 	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/time v0.1.0 // indirect
 	gonum.org/v1/gonum v0.12.0 // indirect
-	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
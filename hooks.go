@@ -0,0 +1,159 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"sync"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// Hooks is a set of optional callbacks that are invoked when lifecycle events
+// happen in the WAL. Any of the funcs may be nil. Callbacks are always invoked
+// from a single background goroutine in the order the events happened and
+// never while the WAL's write lock is held, so a slow hook can't stall appends.
+// It is safe for hooks to call methods on the WAL, although a hook that blocks
+// forever will prevent later hooks from being delivered.
+type Hooks struct {
+	// OnRotate is called after the tail segment has been sealed and a new tail
+	// segment created. sealed is the final metadata for the old tail and next is
+	// the new tail segment.
+	OnRotate func(sealed, next types.SegmentInfo)
+
+	// OnTruncate is called after a successful truncation. typ is "front",
+	// "back" or "retention" matching the labels used by the truncation metrics,
+	// index is the new first index for front truncations or the new last index
+	// for back truncations and segments is the set of segments that make up the
+	// log after the truncation was committed.
+	OnTruncate func(typ string, index uint64, segments []types.SegmentInfo)
+
+	// OnSegmentDeleted is called after a segment file has been deleted, either
+	// because it was truncated or because it was found to be orphaned during
+	// Open. For orphaned segments only the ID and BaseIndex are known.
+	OnSegmentDeleted func(info types.SegmentInfo)
+
+	// OnRecover is called once at the end of Open with the segments that make up
+	// the recovered log.
+	OnRecover func(segments []types.SegmentInfo)
+}
+
+func (h Hooks) empty() bool {
+	return h.OnRotate == nil && h.OnTruncate == nil &&
+		h.OnSegmentDeleted == nil && h.OnRecover == nil
+}
+
+// hookRunner delivers hook invocations from a single goroutine. Events are
+// queued without blocking the caller so it's safe to enqueue while holding the
+// write lock or from a state finalizer. A nil *hookRunner is valid and drops all
+// events which is what we use when no hooks are configured.
+type hookRunner struct {
+	hooks Hooks
+
+	mu     sync.Mutex
+	queue  []func()
+	closed bool
+
+	// notify is 1-buffered and signals that the queue is non-empty.
+	notify chan struct{}
+	done   chan struct{}
+}
+
+func newHookRunner(h Hooks) *hookRunner {
+	if h.empty() {
+		return nil
+	}
+	r := &hookRunner{
+		hooks:  h,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *hookRunner) enqueue(fn func()) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.queue = append(r.queue, fn)
+	r.mu.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+		// Already signalled
+	}
+}
+
+func (r *hookRunner) run() {
+	defer close(r.done)
+	for {
+		<-r.notify
+		r.mu.Lock()
+		queue := r.queue
+		r.queue = nil
+		closed := r.closed
+		r.mu.Unlock()
+
+		for _, fn := range queue {
+			fn()
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// close stops accepting new events and waits until all queued events have
+// been delivered. It must not be called while holding the WAL's write lock
+// since hooks may call back into the WAL.
+func (r *hookRunner) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		<-r.done
+		return
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	<-r.done
+}
+
+func (r *hookRunner) rotated(sealed, next types.SegmentInfo) {
+	if r == nil || r.hooks.OnRotate == nil {
+		return
+	}
+	r.enqueue(func() { r.hooks.OnRotate(sealed, next) })
+}
+
+func (r *hookRunner) truncated(typ string, index uint64, segments []types.SegmentInfo) {
+	if r == nil || r.hooks.OnTruncate == nil {
+		return
+	}
+	r.enqueue(func() { r.hooks.OnTruncate(typ, index, segments) })
+}
+
+func (r *hookRunner) segmentDeleted(info types.SegmentInfo) {
+	if r == nil || r.hooks.OnSegmentDeleted == nil {
+		return
+	}
+	r.enqueue(func() { r.hooks.OnSegmentDeleted(info) })
+}
+
+func (r *hookRunner) recovered(segments []types.SegmentInfo) {
+	if r == nil || r.hooks.OnRecover == nil {
+		return
+	}
+	r.enqueue(func() { r.hooks.OnRecover(segments) })
+}
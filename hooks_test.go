@@ -0,0 +1,126 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/types"
+)
+
+type hookRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *hookRecorder) record(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *hookRecorder) hooks() Hooks {
+	return Hooks{
+		OnRotate: func(sealed, next types.SegmentInfo) {
+			r.record("rotate sealed=%d max=%d next=%d", sealed.BaseIndex, sealed.MaxIndex, next.BaseIndex)
+		},
+		OnTruncate: func(typ string, index uint64, segments []types.SegmentInfo) {
+			r.record("truncate %s index=%d segments=%d", typ, index, len(segments))
+		},
+		OnSegmentDeleted: func(info types.SegmentInfo) {
+			r.record("deleted base=%d", info.BaseIndex)
+		},
+		OnRecover: func(segments []types.SegmentInfo) {
+			r.record("recover segments=%d", len(segments))
+		},
+	}
+}
+
+func TestHooks(t *testing.T) {
+	var rec hookRecorder
+
+	_, w, err := testOpenWAL(t, []testStorageOpt{
+		segFull(),
+		segTail(99),
+	}, []walOpt{WithHooks(rec.hooks())}, false)
+	require.NoError(t, err)
+
+	// Fill the tail so it rotates.
+	require.NoError(t, w.StoreLogs(makeLogEntries(200, 1)))
+	// Append again to ensure the rotation completed.
+	require.NoError(t, w.StoreLogs(makeLogEntries(201, 1)))
+
+	// Delete the first segment entirely.
+	require.NoError(t, w.TruncateFront(150))
+
+	// Truncate the tail back into the previous segment.
+	require.NoError(t, w.TruncateBack(180))
+
+	// Close waits for all hooks to be delivered.
+	require.NoError(t, w.Close())
+
+	require.Equal(t, []string{
+		"recover segments=2",
+		"rotate sealed=101 max=200 next=201",
+		"truncate front index=150 segments=2",
+		"deleted base=1",
+		"truncate back index=180 segments=2",
+		"deleted base=201",
+	}, rec.events)
+}
+
+func TestHooksOrphanDeleted(t *testing.T) {
+	var rec hookRecorder
+
+	_, w, err := testOpenWAL(t, []testStorageOpt{
+		segFull(),
+		segTail(10),
+		func(ts *testStorage) {
+			// Add a segment "file" that isn't in meta so it's an orphan.
+			seg := makeTestSegment(5000)
+			ts.segments[seg.info().ID] = seg
+		},
+	}, []walOpt{WithHooks(rec.hooks())}, false)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.Equal(t, []string{
+		"deleted base=5000",
+		"recover segments=2",
+	}, rec.events)
+}
+
+func TestHooksMayCallWAL(t *testing.T) {
+	var w *WAL
+	lastCh := make(chan uint64, 1)
+	h := Hooks{
+		OnRotate: func(sealed, next types.SegmentInfo) {
+			// Hooks run outside the write lock so calling back into the WAL must
+			// not deadlock.
+			l, err := w.LastIndex()
+			if err != nil {
+				panic(err)
+			}
+			lastCh <- l
+		},
+	}
+
+	_, w, err := testOpenWAL(t, []testStorageOpt{segTail(99)}, []walOpt{WithHooks(h)}, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(100, 1)))
+
+	select {
+	case last := <-lastCh:
+		require.Equal(t, uint64(100), last)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for OnRotate")
+	}
+}
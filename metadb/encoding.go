@@ -0,0 +1,237 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// Encoding selects how a MetaStore in this package encodes PersistentState on
+// commit. Load always accepts either encoding regardless of this setting, so
+// migrating is a matter of first deploying a version that can read the binary
+// encoding everywhere and then switching Encoding to EncodingBinary. The state
+// is rewritten in the new encoding on the next commit (i.e. the next rotation
+// or truncation). Switching back to EncodingJSON works the same way.
+type Encoding int
+
+const (
+	// EncodingJSON encodes state as JSON. It's the default for backwards
+	// compatibility with older versions that can only read JSON.
+	EncodingJSON Encoding = iota
+
+	// EncodingBinary encodes state in a compact, versioned binary format with
+	// a checksum. See encodeStateBinary for the layout.
+	EncodingBinary
+)
+
+const (
+	stateMagic   = 0x53574c57 // "WLWS" little endian
+	stateVersion = 1
+
+	// stateHeaderLen is the magic plus version byte.
+	stateHeaderLen = 5
+	stateCRCLen    = 4
+)
+
+var errStateTruncated = errors.New("unexpected end of encoded state")
+
+// encodeState encodes state with the given encoding.
+func encodeState(state types.PersistentState, enc Encoding) ([]byte, error) {
+	switch enc {
+	case EncodingJSON:
+		return json.Marshal(state)
+	case EncodingBinary:
+		return encodeStateBinary(state), nil
+	default:
+		return nil, fmt.Errorf("unknown state encoding %d", enc)
+	}
+}
+
+// decodeState decodes state encoded with any supported encoding. JSON is
+// detected by its leading '{' since the binary encoding always starts with the
+// magic number.
+func decodeState(raw []byte) (types.PersistentState, error) {
+	var state types.PersistentState
+	if len(raw) > 0 && raw[0] == '{' {
+		if err := json.Unmarshal(raw, &state); err != nil {
+			return state, fmt.Errorf("%w: failed to parse persisted state: %s", types.ErrCorrupt, err)
+		}
+		return state, nil
+	}
+	state, err := decodeStateBinary(raw)
+	if err != nil {
+		return state, fmt.Errorf("%w: failed to parse persisted state: %s", types.ErrCorrupt, err)
+	}
+	return state, nil
+}
+
+// encodeStateBinary encodes state in the binary format:
+//
+//	magic (4 bytes) | version (1 byte) | body | crc32c of everything before (4 bytes)
+//
+// Version 1 body is a sequence of uvarints (and varints for times):
+//
+//	NextSegmentID
+//	len(Segments)
+//	for each segment:
+//	  ID, BaseIndex, MinIndex, MaxIndex, IndexStart, SizeLimit, Size,
+//	  CreateTime, SealTime (varint unix nanoseconds, zero for the zero time)
+//	len(Cursors)
+//	for each cursor: len(name), name bytes, index
+//
+// Using varints throughout keeps the encoding compact and means widening a
+// field's type doesn't change the format.
+func encodeStateBinary(state types.PersistentState) []byte {
+	buf := make([]byte, stateHeaderLen, stateHeaderLen+16+len(state.Segments)*48+len(state.Cursors)*24)
+	binary.LittleEndian.PutUint32(buf[0:4], stateMagic)
+	buf[4] = stateVersion
+
+	buf = binary.AppendUvarint(buf, state.NextSegmentID)
+	buf = binary.AppendUvarint(buf, uint64(len(state.Segments)))
+	for _, si := range state.Segments {
+		buf = binary.AppendUvarint(buf, si.ID)
+		buf = binary.AppendUvarint(buf, si.BaseIndex)
+		buf = binary.AppendUvarint(buf, si.MinIndex)
+		buf = binary.AppendUvarint(buf, si.MaxIndex)
+		buf = binary.AppendUvarint(buf, si.IndexStart)
+		buf = binary.AppendUvarint(buf, si.SizeLimit)
+		buf = binary.AppendUvarint(buf, si.Size)
+		buf = binary.AppendVarint(buf, encodeTime(si.CreateTime))
+		buf = binary.AppendVarint(buf, encodeTime(si.SealTime))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(state.Cursors)))
+	for name, idx := range state.Cursors {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, idx)
+	}
+
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoliTable))
+}
+
+func decodeStateBinary(raw []byte) (types.PersistentState, error) {
+	var state types.PersistentState
+
+	if len(raw) < stateHeaderLen+stateCRCLen {
+		return state, errStateTruncated
+	}
+	if binary.LittleEndian.Uint32(raw[0:4]) != stateMagic {
+		return state, errors.New("invalid magic")
+	}
+	if raw[4] != stateVersion {
+		return state, fmt.Errorf("unsupported state version %d", raw[4])
+	}
+	body, crcBytes := raw[:len(raw)-stateCRCLen], raw[len(raw)-stateCRCLen:]
+	if crc32.Checksum(body, castagnoliTable) != binary.LittleEndian.Uint32(crcBytes) {
+		return state, errors.New("checksum mismatch")
+	}
+
+	d := stateDecoder{buf: body[stateHeaderLen:]}
+	state.NextSegmentID = d.uvarint()
+	nSegs := d.count()
+	if nSegs > 0 {
+		state.Segments = make([]types.SegmentInfo, 0, nSegs)
+	}
+	for i := 0; i < nSegs && d.err == nil; i++ {
+		var si types.SegmentInfo
+		si.ID = d.uvarint()
+		si.BaseIndex = d.uvarint()
+		si.MinIndex = d.uvarint()
+		si.MaxIndex = d.uvarint()
+		si.IndexStart = d.uvarint()
+		si.SizeLimit = d.uvarint()
+		si.Size = d.uvarint()
+		si.CreateTime = decodeTime(d.varint())
+		si.SealTime = decodeTime(d.varint())
+		state.Segments = append(state.Segments, si)
+	}
+	nCursors := d.count()
+	if nCursors > 0 {
+		state.Cursors = make(map[string]uint64, nCursors)
+	}
+	for i := 0; i < nCursors && d.err == nil; i++ {
+		name := d.bytes(d.count())
+		state.Cursors[string(name)] = d.uvarint()
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail(fmt.Errorf("%d unexpected trailing bytes", len(d.buf)))
+	}
+	return state, d.err
+}
+
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func decodeTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+// stateDecoder reads varints from buf, remembering the first error so that
+// callers can check once at the end.
+type stateDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *stateDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.buf = nil
+}
+
+func (d *stateDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(errStateTruncated)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *stateDecoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(errStateTruncated)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// count reads a length and checks it can't possibly exceed the remaining
+// input so corrupt lengths don't cause huge allocations.
+func (d *stateDecoder) count() int {
+	v := d.uvarint()
+	if v > uint64(len(d.buf)) {
+		d.fail(errStateTruncated)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *stateDecoder) bytes(n int) []byte {
+	if n > len(d.buf) {
+		d.fail(errStateTruncated)
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
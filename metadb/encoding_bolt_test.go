@@ -0,0 +1,82 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !wasm
+
+package metadb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/polarsignals/wal/conformance"
+	"github.com/polarsignals/wal/types"
+)
+
+func TestBoltMetaDBEncodingMigration(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	rawMeta := func() []byte {
+		t.Helper()
+		bb, err := bbolt.Open(tmpDir+"/"+FileName, 0644, nil)
+		require.NoError(t, err)
+		defer bb.Close()
+		var raw []byte
+		require.NoError(t, bb.View(func(tx *bbolt.Tx) error {
+			raw = append(raw, tx.Bucket([]byte(MetaBucket)).Get([]byte(MetaKey))...)
+			return nil
+		}))
+		return raw
+	}
+
+	// An existing store written with JSON.
+	first := makeState(3)
+	{
+		var db BoltMetaDB
+		_, err := db.Load(tmpDir)
+		require.NoError(t, err)
+		require.NoError(t, db.CommitState(*first))
+		require.Equal(t, len(jsonState(t, first)), db.EncodedStateSize())
+		require.NoError(t, db.Close())
+	}
+	require.True(t, json.Valid(rawMeta()))
+
+	// Opening with binary encoding still reads the JSON state and rewrites it on
+	// the next commit.
+	second := makeState(4)
+	{
+		db := BoltMetaDB{Encoding: EncodingBinary}
+		got, err := db.Load(tmpDir)
+		require.NoError(t, err)
+		require.Equal(t, *first, got)
+		require.NoError(t, db.CommitState(*second))
+		require.NoError(t, db.Close())
+	}
+	raw := rawMeta()
+	require.Equal(t, uint32(stateMagic), binary.LittleEndian.Uint32(raw))
+
+	// And a store that's back on the default reads it too.
+	var db BoltMetaDB
+	got, err := db.Load(tmpDir)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, *second, got)
+	require.Equal(t, len(raw), db.EncodedStateSize())
+}
+
+func jsonState(t *testing.T, state *types.PersistentState) []byte {
+	t.Helper()
+	raw, err := json.Marshal(state)
+	require.NoError(t, err)
+	return raw
+}
+
+func TestBoltBinaryEncodingConformance(t *testing.T) {
+	conformance.TestMetaStore(t, func(t *testing.T) (string, func() types.MetaStore) {
+		return t.TempDir(), func() types.MetaStore { return &BoltMetaDB{Encoding: EncodingBinary} }
+	})
+}
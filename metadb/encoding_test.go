@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/conformance"
+	"github.com/polarsignals/wal/types"
+)
+
+func TestStateEncoding(t *testing.T) {
+	withCursors := makeState(4)
+	withCursors.Cursors = map[string]uint64{"uploader": 1050, "indexer": 1200, "": 1}
+
+	cases := []struct {
+		name  string
+		state *types.PersistentState
+	}{
+		{name: "empty", state: &types.PersistentState{}},
+		{name: "one segment", state: makeState(1)},
+		{name: "many segments", state: makeState(1000)},
+		{name: "with cursors", state: withCursors},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			for _, enc := range []Encoding{EncodingJSON, EncodingBinary} {
+				raw, err := encodeState(*tc.state, enc)
+				require.NoError(t, err)
+
+				got, err := decodeState(raw)
+				require.NoError(t, err)
+				require.Equal(t, *tc.state, got)
+			}
+		})
+	}
+
+	// Binary should be much smaller than JSON for large states.
+	state := makeState(1000)
+	js, err := encodeState(*state, EncodingJSON)
+	require.NoError(t, err)
+	bin, err := encodeState(*state, EncodingBinary)
+	require.NoError(t, err)
+	require.Less(t, len(bin)*3, len(js))
+	t.Logf("1000 segments: json=%d binary=%d", len(js), len(bin))
+}
+
+func TestStateEncodingCorruption(t *testing.T) {
+	raw := encodeStateBinary(*makeState(3))
+
+	// Every single byte flip must be detected.
+	for i := range raw {
+		bad := append([]byte(nil), raw...)
+		bad[i] ^= 0x01
+		_, err := decodeState(bad)
+		require.ErrorIs(t, err, types.ErrCorrupt, "flip at byte %d not detected", i)
+	}
+
+	// As must every truncation.
+	for i := 0; i < len(raw); i++ {
+		_, err := decodeState(raw[:i])
+		require.ErrorIs(t, err, types.ErrCorrupt, "truncation to %d bytes not detected", i)
+	}
+
+	// Unknown future versions are rejected rather than misread, even with a
+	// valid checksum.
+	future := append([]byte(nil), raw[:len(raw)-stateCRCLen]...)
+	future[4] = stateVersion + 1
+	future = binary.LittleEndian.AppendUint32(future, crc32.Checksum(future, castagnoliTable))
+	_, err := decodeState(future)
+	require.ErrorContains(t, err, "unsupported state version")
+}
+
+func TestBinaryEncodingConformance(t *testing.T) {
+	conformance.TestMetaStore(t, func(t *testing.T) (string, func() types.MetaStore) {
+		return t.TempDir(), func() types.MetaStore { return &FileMetaDB{Encoding: EncodingBinary} }
+	}, conformance.WithCrash(tornLatestSlot))
+}
@@ -0,0 +1,390 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/polarsignals/wal/types"
+)
+
+const (
+	// FileMetaDBName is the prefix of the two slot files used by FileMetaDB. The
+	// files are named FileMetaDBName + ".0" and FileMetaDBName + ".1".
+	FileMetaDBName = "wal-meta.dat"
+
+	fileRecordMagic   = 0x4d4c4157 // "WALM" little endian
+	fileRecordVersion = 1
+
+	// fileRecordHeaderLen is the length of the fixed header that precedes the
+	// encoded state in each slot.
+	//
+	//   0      4      5           8            16       20       24
+	//   +------+------+-----------+------------+--------+--------+
+	//   | magic| vers | reserved  | seq        | len    | crc    |
+	//   +------+------+-----------+------------+--------+--------+
+	//
+	// crc is CRC32 Castagnoli over seq, len and the len byte payload. The
+	// payload is the uvarint length of the encoded state, the encoded state,
+	// the uvarint number of stable keys and then each stable key and value as
+	// a uvarint length followed by the bytes.
+	fileRecordHeaderLen = 24
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileMetaDB implements types.MetaStore using two plain files and no external
+// dependencies so it works on every build target including wasm.
+//
+// The store is double-buffered: each commit writes a complete, checksummed
+// record with an increasing sequence number into whichever slot file doesn't
+// hold the latest state and fsyncs it. Load picks the valid record with the
+// highest sequence number, so a commit torn by a crash leaves the previous
+// state intact in the other slot. The slot files are only created once, in a
+// crash-safe way via a rename, so commits never need to fsync the directory.
+//
+// Stable values are kept in the same record so every SetStable rewrites the
+// whole record too. That's fine for the handful of small values raft stores.
+type FileMetaDB struct {
+	// Encoding is used to encode state on commit. See Encoding for how to
+	// migrate an existing store.
+	Encoding Encoding
+
+	dir   string
+	slots [2]*os.File
+
+	// mu serializes commits and protects the fields below since SetStable may
+	// be called concurrently with CommitState.
+	mu     sync.Mutex
+	seq    uint64
+	state  []byte
+	stable map[string][]byte
+}
+
+func slotFileName(slot int) string {
+	return fmt.Sprintf("%s.%d", FileMetaDBName, slot)
+}
+
+func (db *FileMetaDB) ensureOpen(dir string) error {
+	if db.dir != "" && db.dir != dir {
+		return fmt.Errorf("can't load dir %s, already open in dir %s", dir, db.dir)
+	}
+	if db.slots[0] != nil {
+		return nil
+	}
+
+	for slot := range db.slots {
+		fileName := filepath.Join(dir, slotFileName(slot))
+		_, err := os.Stat(fileName)
+		if errors.Is(err, os.ErrNotExist) {
+			err = safeInitSlot(dir, slotFileName(slot))
+		}
+		if err != nil {
+			db.closeSlots()
+			return fmt.Errorf("failed initializing meta file %s: %w", slotFileName(slot), err)
+		}
+		f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+		if err != nil {
+			db.closeSlots()
+			return fmt.Errorf("failed to open %s: %w", slotFileName(slot), err)
+		}
+		db.slots[slot] = f
+	}
+	db.dir = dir
+	return nil
+}
+
+// safeInitSlot creates an empty slot file under a temporary name and renames
+// it into place so that a crash can never leave a partially created slot that
+// we'd mistake for corruption.
+func safeInitSlot(dir, name string) error {
+	tmpFileName := filepath.Join(dir, name+".tmp")
+
+	// Delete any old attempts to init that were unsuccessful
+	if err := os.RemoveAll(tmpFileName); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if err := os.Rename(tmpFileName, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func (db *FileMetaDB) closeSlots() error {
+	var err error
+	for i, f := range db.slots {
+		if f == nil {
+			continue
+		}
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		db.slots[i] = nil
+	}
+	return err
+}
+
+// Load loads the existing persisted state. If there is no existing state
+// implementations are expected to create initialize new storage and return an
+// empty state.
+func (db *FileMetaDB) Load(dir string) (types.PersistentState, error) {
+	var state types.PersistentState
+
+	if err := db.ensureOpen(dir); err != nil {
+		return state, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var (
+		best    []byte
+		bestSeq uint64
+		written bool
+	)
+	for slot, f := range db.slots {
+		fi, err := f.Stat()
+		if err != nil {
+			return state, err
+		}
+		if fi.Size() == 0 {
+			continue
+		}
+		written = true
+		raw := make([]byte, fi.Size())
+		if _, err := f.ReadAt(raw, 0); err != nil {
+			return state, fmt.Errorf("failed to read %s: %w", slotFileName(slot), err)
+		}
+		seq, payload, ok := decodeFileRecord(raw)
+		if !ok {
+			// Most likely a commit torn by a crash, the other slot has the state
+			// from before it.
+			continue
+		}
+		if best == nil || seq > bestSeq {
+			best, bestSeq = payload, seq
+		}
+	}
+
+	if best == nil {
+		if written {
+			return state, fmt.Errorf("%w: no valid meta record in %s", types.ErrCorrupt, dir)
+		}
+		// This is valid it's an "empty" log that will be initialized by the WAL.
+		db.seq = 0
+		db.state = nil
+		db.stable = make(map[string][]byte)
+		return state, nil
+	}
+
+	encState, stable, err := decodeFilePayload(best)
+	if err != nil {
+		return state, fmt.Errorf("%w: failed to parse meta record: %s", types.ErrCorrupt, err)
+	}
+	db.seq = bestSeq
+	db.state = encState
+	db.stable = stable
+	if len(encState) == 0 {
+		// Only stable values have been stored so far.
+		return state, nil
+	}
+	return decodeState(encState)
+}
+
+// CommitState must atomically replace all persisted metadata in the current
+// store with the set provided. It must not return until the data is persisted
+// durably and in a crash-safe way otherwise the guarantees of the WAL will be
+// compromised. The WAL will only ever call this in a single thread at one
+// time and it will never be called concurrently with Load however it may be
+// called concurrently with Get/SetStable operations.
+func (db *FileMetaDB) CommitState(state types.PersistentState) error {
+	encoded, err := encodeState(state, db.Encoding)
+	if err != nil {
+		return fmt.Errorf("failed to encode persisted state: %w", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.slots[0] == nil {
+		return ErrUnintialized
+	}
+	if err := db.writeLocked(encoded, db.stable); err != nil {
+		return err
+	}
+	db.state = encoded
+	return nil
+}
+
+// GetStable returns the value stored for key or nil if there is none. It may
+// be called concurrently with any other method except Load.
+func (db *FileMetaDB) GetStable(key []byte) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.slots[0] == nil {
+		return nil, ErrUnintialized
+	}
+	val, ok := db.stable[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, val...), nil
+}
+
+// SetStable durably stores value for key, replacing any existing value. A nil
+// value removes the key. It doesn't return until the new record has been
+// fsynced.
+func (db *FileMetaDB) SetStable(key []byte, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.slots[0] == nil {
+		return ErrUnintialized
+	}
+
+	stable := make(map[string][]byte, len(db.stable)+1)
+	for k, v := range db.stable {
+		stable[k] = v
+	}
+	if value == nil {
+		delete(stable, string(key))
+	} else {
+		stable[string(key)] = append([]byte{}, value...)
+	}
+	if err := db.writeLocked(db.state, stable); err != nil {
+		return err
+	}
+	db.stable = stable
+	return nil
+}
+
+// writeLocked durably writes a new record with the given encoded state and
+// stable values to the slot that doesn't hold the latest record.
+func (db *FileMetaDB) writeLocked(encState []byte, stable map[string][]byte) error {
+	seq := db.seq + 1
+	f := db.slots[seq%2]
+	rec := encodeFileRecord(seq, encodeFilePayload(encState, stable))
+
+	if _, err := f.WriteAt(rec, 0); err != nil {
+		return fmt.Errorf("failed to write persisted state: %w", err)
+	}
+	// Drop any tail left by a longer previous record. It's ignored by Load
+	// anyway since the header records the length, this just reclaims space.
+	if err := f.Truncate(int64(len(rec))); err != nil {
+		return fmt.Errorf("failed to truncate %s: %w", slotFileName(int(seq%2)), err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", slotFileName(int(seq%2)), err)
+	}
+	db.seq = seq
+	return nil
+}
+
+// EncodedStateSize implements types.StateSizeReporter.
+func (db *FileMetaDB) EncodedStateSize() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.state)
+}
+
+// Close implements io.Closer
+func (db *FileMetaDB) Close() error {
+	return db.closeSlots()
+}
+
+func encodeFileRecord(seq uint64, payload []byte) []byte {
+	rec := make([]byte, fileRecordHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(rec[0:4], fileRecordMagic)
+	rec[4] = fileRecordVersion
+	binary.LittleEndian.PutUint64(rec[8:16], seq)
+	binary.LittleEndian.PutUint32(rec[16:20], uint32(len(payload)))
+	copy(rec[fileRecordHeaderLen:], payload)
+
+	crc := crc32.Update(0, castagnoliTable, rec[8:20])
+	crc = crc32.Update(crc, castagnoliTable, payload)
+	binary.LittleEndian.PutUint32(rec[20:24], crc)
+	return rec
+}
+
+func decodeFileRecord(rec []byte) (uint64, []byte, bool) {
+	if len(rec) < fileRecordHeaderLen {
+		return 0, nil, false
+	}
+	if binary.LittleEndian.Uint32(rec[0:4]) != fileRecordMagic || rec[4] != fileRecordVersion {
+		return 0, nil, false
+	}
+	seq := binary.LittleEndian.Uint64(rec[8:16])
+	n := binary.LittleEndian.Uint32(rec[16:20])
+	if uint64(len(rec)-fileRecordHeaderLen) < uint64(n) {
+		return 0, nil, false
+	}
+	payload := rec[fileRecordHeaderLen : fileRecordHeaderLen+int(n)]
+
+	crc := crc32.Update(0, castagnoliTable, rec[8:20])
+	crc = crc32.Update(crc, castagnoliTable, payload)
+	if crc != binary.LittleEndian.Uint32(rec[20:24]) {
+		return 0, nil, false
+	}
+	return seq, payload, true
+}
+
+func encodeFilePayload(encState []byte, stable map[string][]byte) []byte {
+	keys := make([]string, 0, len(stable))
+	size := binary.MaxVarintLen64 * 2
+	for k, v := range stable {
+		keys = append(keys, k)
+		size += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 0, size+len(encState))
+	buf = binary.AppendUvarint(buf, uint64(len(encState)))
+	buf = append(buf, encState...)
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(stable[k])))
+		buf = append(buf, stable[k]...)
+	}
+	return buf
+}
+
+func decodeFilePayload(payload []byte) ([]byte, map[string][]byte, error) {
+	d := stateDecoder{buf: payload}
+	encState := d.bytes(d.count())
+	n := d.count()
+	stable := make(map[string][]byte, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.bytes(d.count())
+		v := d.bytes(d.count())
+		if d.err == nil {
+			stable[string(k)] = append([]byte{}, v...)
+		}
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail(fmt.Errorf("%d unexpected trailing bytes", len(d.buf)))
+	}
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	return append([]byte{}, encState...), stable, nil
+}
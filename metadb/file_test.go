@@ -0,0 +1,186 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package metadb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/conformance"
+	"github.com/polarsignals/wal/types"
+)
+
+func TestFileMetaDB(t *testing.T) {
+	cases := []struct {
+		name string
+		// failSim is called with the dir after two states have been committed
+		// and may damage files to simulate a crash.
+		failSim   func(t *testing.T, dir string)
+		expect    func(first, second *types.PersistentState) *types.PersistentState
+		expectErr error
+	}{
+		{
+			name:   "basic storage",
+			expect: func(_, second *types.PersistentState) *types.PersistentState { return second },
+		},
+		{
+			name: "torn latest commit",
+			failSim: func(t *testing.T, dir string) {
+				// The second commit went to slot 0. Chop it in half as if we crashed
+				// part way through writing it.
+				truncateSlot(t, dir, 0, 0.5)
+			},
+			expect: func(first, _ *types.PersistentState) *types.PersistentState { return first },
+		},
+		{
+			name: "corrupt latest commit",
+			failSim: func(t *testing.T, dir string) {
+				flipSlotByte(t, dir, 0, fileRecordHeaderLen+10)
+			},
+			expect: func(first, _ *types.PersistentState) *types.PersistentState { return first },
+		},
+		{
+			name: "corrupt latest header",
+			failSim: func(t *testing.T, dir string) {
+				flipSlotByte(t, dir, 0, 9)
+			},
+			expect: func(first, _ *types.PersistentState) *types.PersistentState { return first },
+		},
+		{
+			name: "both slots corrupt",
+			failSim: func(t *testing.T, dir string) {
+				truncateSlot(t, dir, 0, 0.5)
+				flipSlotByte(t, dir, 1, fileRecordHeaderLen+10)
+			},
+			expectErr: types.ErrCorrupt,
+		},
+		{
+			name: "crash during slot init",
+			failSim: func(t *testing.T, dir string) {
+				// A leftover tmp file from a previous init attempt is ignored.
+				require.NoError(t, os.WriteFile(filepath.Join(dir, slotFileName(0)+".tmp"), []byte("junk"), 0644))
+			},
+			expect: func(_, second *types.PersistentState) *types.PersistentState { return second },
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+
+			first := makeState(3)
+			second := makeState(4)
+			second.Cursors = map[string]uint64{"uploader": 1050}
+			{
+				var db FileMetaDB
+				gotState, err := db.Load(tmpDir)
+				require.NoError(t, err)
+
+				require.Equal(t, 0, int(gotState.NextSegmentID))
+				require.Empty(t, gotState.Segments)
+
+				require.NoError(t, db.CommitState(*first))
+				require.NoError(t, db.CommitState(*second))
+				require.NoError(t, db.Close())
+			}
+
+			if tc.failSim != nil {
+				tc.failSim(t, tmpDir)
+			}
+
+			var db FileMetaDB
+			gotState, err := db.Load(tmpDir)
+			if tc.expectErr != nil {
+				require.ErrorIs(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			defer db.Close()
+			require.Equal(t, *tc.expect(first, second), gotState)
+
+			// The next commit must not overwrite the only valid state until it's
+			// durable, and must be what we load afterwards.
+			third := makeState(5)
+			require.NoError(t, db.CommitState(*third))
+			require.NoError(t, db.Close())
+
+			gotState, err = db.Load(tmpDir)
+			require.NoError(t, err)
+			require.Equal(t, *third, gotState)
+		})
+	}
+}
+
+func TestFileMetaDBErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	var db FileMetaDB
+
+	// Calling anything before load is an error
+	require.ErrorIs(t, db.CommitState(types.PersistentState{NextSegmentID: 1234}), ErrUnintialized)
+
+	// Loading twice is OK from same dir
+	_, err := db.Load(tmpDir)
+	require.NoError(t, err)
+	_, err = db.Load(tmpDir)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// But not from a different (valid) one
+	_, err = db.Load(t.TempDir())
+	require.ErrorContains(t, err, "already open in dir")
+
+	// Loading from a non-existent dir is an error
+	var db2 FileMetaDB
+	_, err = db2.Load("fake-dir-that-does-not-exist")
+	require.True(t, strings.Contains(strings.ToLower(err.Error()), "no such file or directory"))
+}
+
+func TestFileMetaDBConformance(t *testing.T) {
+	conformance.TestMetaStore(t, func(t *testing.T) (string, func() types.MetaStore) {
+		return t.TempDir(), func() types.MetaStore { return &FileMetaDB{} }
+	}, conformance.WithCrash(tornLatestSlot))
+}
+
+// tornLatestSlot truncates whichever slot holds the latest commit as if we
+// crashed part way through writing it.
+func tornLatestSlot(t *testing.T, dir string) {
+	t.Helper()
+	var seqs [2]uint64
+	for slot := range seqs {
+		raw, err := os.ReadFile(filepath.Join(dir, slotFileName(slot)))
+		require.NoError(t, err)
+		if len(raw) >= fileRecordHeaderLen {
+			seqs[slot] = binary.LittleEndian.Uint64(raw[8:16])
+		}
+	}
+	latest := 0
+	if seqs[1] > seqs[0] {
+		latest = 1
+	}
+	truncateSlot(t, dir, latest, 0.5)
+}
+
+func truncateSlot(t *testing.T, dir string, slot int, frac float64) {
+	t.Helper()
+	fn := filepath.Join(dir, slotFileName(slot))
+	fi, err := os.Stat(fn)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(fn, int64(float64(fi.Size())*frac)))
+}
+
+func flipSlotByte(t *testing.T, dir string, slot int, off int) {
+	t.Helper()
+	fn := filepath.Join(dir, slotFileName(slot))
+	raw, err := os.ReadFile(fn)
+	require.NoError(t, err)
+	raw[off] ^= 0xff
+	require.NoError(t, os.WriteFile(fn, raw, 0644))
+}
@@ -6,7 +6,6 @@
 package metadb
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -39,8 +38,13 @@ var (
 // store. See repo README for reasons for this design choice and performance
 // implications.
 type BoltMetaDB struct {
-	dir string
-	db  *bbolt.DB
+	// Encoding is used to encode state on commit. See Encoding for how to
+	// migrate an existing store.
+	Encoding Encoding
+
+	dir       string
+	db        *bbolt.DB
+	stateSize int
 }
 
 func (db *BoltMetaDB) ensureOpen(dir string) error {
@@ -173,10 +177,8 @@ func (db *BoltMetaDB) Load(dir string) (types.PersistentState, error) {
 		return state, nil
 	}
 
-	if err := json.Unmarshal(raw, &state); err != nil {
-		return state, fmt.Errorf("%w: failed to parse persisted state: %s", types.ErrCorrupt, err)
-	}
-	return state, nil
+	db.stateSize = len(raw)
+	return decodeState(raw)
 }
 
 // CommitState must atomically replace all persisted metadata in the current
@@ -190,7 +192,7 @@ func (db *BoltMetaDB) CommitState(state types.PersistentState) error {
 		return ErrUnintialized
 	}
 
-	encoded, err := json.Marshal(state)
+	encoded, err := encodeState(state, db.Encoding)
 	if err != nil {
 		return fmt.Errorf("failed to encode persisted state: %w", err)
 	}
@@ -206,9 +208,68 @@ func (db *BoltMetaDB) CommitState(state types.PersistentState) error {
 		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.stateSize = len(encoded)
+	return nil
+}
+
+// GetStable returns the value stored for key or nil if there is none. It may
+// be called concurrently with any other method except Load.
+func (db *BoltMetaDB) GetStable(key []byte) ([]byte, error) {
+	if db.db == nil {
+		return nil, ErrUnintialized
+	}
+
+	tx, err := db.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	stable := tx.Bucket([]byte(StableBucket))
+
+	val := stable.Get(key)
+	if val == nil {
+		return nil, nil
+	}
+	// Bolt only guarantees the slice is valid until the end of the transaction.
+	ret := make([]byte, len(val))
+	copy(ret, val)
+	return ret, nil
+}
+
+// SetStable durably stores value for key, replacing any existing value. A nil
+// value removes the key. Bolt fsyncs on commit so it doesn't return until the
+// value is persisted.
+func (db *BoltMetaDB) SetStable(key []byte, value []byte) error {
+	if db.db == nil {
+		return ErrUnintialized
+	}
+
+	tx, err := db.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stable := tx.Bucket([]byte(StableBucket))
+
+	if value == nil {
+		err = stable.Delete(key)
+	} else {
+		err = stable.Put(key, value)
+	}
+	if err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
+// EncodedStateSize implements types.StateSizeReporter.
+func (db *BoltMetaDB) EncodedStateSize() int {
+	return db.stateSize
+}
+
 // Close implements io.Closer
 func (db *BoltMetaDB) Close() error {
 	if db.db == nil {
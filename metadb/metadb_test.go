@@ -12,6 +12,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/polarsignals/wal/conformance"
 	"github.com/polarsignals/wal/types"
 )
 
@@ -25,6 +26,14 @@ func TestMetaDB(t *testing.T) {
 			name:       "basic storage",
 			writeState: makeState(4),
 		},
+		{
+			name: "with cursors",
+			writeState: func() *types.PersistentState {
+				s := makeState(4)
+				s.Cursors = map[string]uint64{"uploader": 1050, "indexer": 1200}
+				return s
+			}(),
+		},
 	}
 
 	for _, tc := range cases {
@@ -113,6 +122,7 @@ func makeState(nSegs int) *types.PersistentState {
 			CreateTime: startTime.Add(time.Duration(i) * time.Minute),
 			SealTime:   startTime.Add(time.Duration(i+1) * time.Minute),
 			SizeLimit:  64 * 1024 * 1024,
+			Size:       123456 + 800,
 		}
 		state.Segments = append(state.Segments, si)
 	}
@@ -130,3 +140,9 @@ func makeState(nSegs int) *types.PersistentState {
 	}
 	return state
 }
+
+func TestBoltMetaDBConformance(t *testing.T) {
+	conformance.TestMetaStore(t, func(t *testing.T) (string, func() types.MetaStore) {
+		return t.TempDir(), func() types.MetaStore { return &BoltMetaDB{} }
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build wasm
+
+package metadb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/types"
+)
+
+func TestBoltMetaDBImportsLegacyState(t *testing.T) {
+	tmpDir := t.TempDir()
+	legacy := makeState(3)
+	raw, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, FileName), raw, 0644))
+
+	var db BoltMetaDB
+	got, err := db.Load(tmpDir)
+	require.NoError(t, err)
+	require.Equal(t, *legacy, got)
+	require.NoError(t, db.Close())
+
+	_, err = os.Stat(filepath.Join(tmpDir, FileName))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// The imported state survives a reopen without the old file.
+	var db2 BoltMetaDB
+	got, err = db2.Load(tmpDir)
+	require.NoError(t, err)
+	defer db2.Close()
+	require.Equal(t, *legacy, got)
+
+	// And the old file is never read again once state has been committed.
+	require.NoError(t, db2.CommitState(*makeState(4)))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, FileName), raw, 0644))
+	var db3 BoltMetaDB
+	got, err = db3.Load(tmpDir)
+	require.NoError(t, err)
+	defer db3.Close()
+	require.Equal(t, *makeState(4), got)
+}
+
+func TestBoltMetaDBEmptyLegacyState(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, FileName), nil, 0644))
+
+	var db BoltMetaDB
+	got, err := db.Load(tmpDir)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, types.PersistentState{}, got)
+}
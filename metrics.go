@@ -18,6 +18,22 @@ type Metrics struct {
 	EntriesTruncated      *prometheus.CounterVec
 	Truncations           *prometheus.CounterVec
 	LastSegmentAgeSeconds prometheus.Gauge
+	MetaStateBytes        prometheus.Gauge
+	StableGets            prometheus.Counter
+	StableSets            prometheus.Counter
+
+	SegmentCompactions       prometheus.Counter
+	CompactionBytesReclaimed prometheus.Counter
+	SegmentMerges            prometheus.Counter
+	SegmentPreallocations    prometheus.Counter
+
+	EntryCacheHits   prometheus.Counter
+	EntryCacheMisses prometheus.Counter
+
+	RecoveryDiscards           *prometheus.CounterVec
+	RecoveryBytesDiscarded     prometheus.Counter
+	RecoveryOrphansDeleted     prometheus.Counter
+	RecoveryOrphansQuarantined prometheus.Counter
 }
 
 func newWALMetrics(reg prometheus.Registerer) *Metrics {
@@ -56,7 +72,7 @@ func newWALMetrics(reg prometheus.Registerer) *Metrics {
 			prometheus.CounterOpts{
 				Name: "entries_truncated_total",
 				Help: "entries_truncated counts how many log entries have been truncated" +
-					" from the front or back.",
+					" from the front or back, either explicitly or by the retention policy.",
 			},
 			[]string{"type"},
 		),
@@ -75,5 +91,71 @@ func newWALMetrics(reg prometheus.Registerer) *Metrics {
 				" that segment file was first created and when it was sealed. this" +
 				" gives a rough estimate how quickly writes are filling the disk.",
 		}),
+		MetaStateBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "meta_state_bytes",
+			Help: "meta_state_bytes is the size of the encoded WAL metadata most" +
+				" recently loaded or committed to the meta store. It's only set if the" +
+				" meta store reports it.",
+		}),
+		StableGets: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "stable_gets",
+			Help: "stable_gets counts how many calls are made to GetStable or GetUint64.",
+		}),
+		StableSets: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "stable_sets",
+			Help: "stable_sets counts how many calls are made to SetStable or SetUint64.",
+		}),
+		SegmentCompactions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "segment_compactions",
+			Help: "segment_compactions counts how many times a front-truncated segment" +
+				" has been rewritten to reclaim the space used by truncated entries.",
+		}),
+		CompactionBytesReclaimed: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "compaction_bytes_reclaimed",
+			Help: "compaction_bytes_reclaimed estimates the bytes of segment files freed" +
+				" by compaction.",
+		}),
+		SegmentMerges: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "segment_merges",
+			Help: "segment_merges counts how many times adjacent small sealed segments" +
+				" have been merged into a single segment.",
+		}),
+		SegmentPreallocations: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "segment_preallocations",
+			Help: "segment_preallocations counts how many times the file for the next" +
+				" segment has been preallocated in the background before rotation.",
+		}),
+		EntryCacheHits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "entry_cache_hits",
+			Help: "entry_cache_hits counts reads served from the entry cache.",
+		}),
+		EntryCacheMisses: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "entry_cache_misses",
+			Help: "entry_cache_misses counts reads that had to go to the segment" +
+				" files because the entry cache didn't hold the entry.",
+		}),
+		RecoveryDiscards: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "recovery_discards_total",
+				Help: "recovery_discards counts how many times opening the WAL discarded" +
+					" data from the end of the tail segment, categorized by the reason.",
+			},
+			[]string{"reason"},
+		),
+		RecoveryBytesDiscarded: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "recovery_bytes_discarded",
+			Help: "recovery_bytes_discarded counts the bytes of uncommitted or corrupt" +
+				" data discarded from the tail segment when opening the WAL.",
+		}),
+		RecoveryOrphansDeleted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "recovery_orphans_deleted",
+			Help: "recovery_orphans_deleted counts segment files deleted when opening" +
+				" the WAL because they weren't part of the recovered log.",
+		}),
+		RecoveryOrphansQuarantined: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "recovery_orphans_quarantined",
+			Help: "recovery_orphans_quarantined counts orphaned segment files moved to" +
+				" quarantine when opening the WAL instead of being deleted.",
+		}),
 	}
 }
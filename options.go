@@ -4,6 +4,9 @@
 package wal
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -37,13 +40,26 @@ func WithLogger(logger log.Logger) walOpt {
 	}
 }
 
-// WithSegmentSize is an option that allows a custom segmentSize to be set.
+// WithSegmentSize is an option that allows a custom segmentSize to be set. It
+// must be between MinSegmentSize and MaxSegmentSize otherwise Open fails.
 func WithSegmentSize(size int) walOpt {
 	return func(w *WAL) {
 		w.segmentSize = size
 	}
 }
 
+// WithMaxEntrySize is an option that sets the largest entry StoreLogs accepts.
+// Entries larger than segment.MaxFrameSize are split across several frames in
+// the segment file. Raising it above segment.MaxFrameSize makes new segments
+// unreadable by older versions of this package. The default is
+// segment.DefaultMaxEntrySize. If a custom SegmentFiler is used it must be
+// configured to accept entries this big too.
+func WithMaxEntrySize(size int) walOpt {
+	return func(w *WAL) {
+		w.maxEntrySize = size
+	}
+}
+
 // WithMetrics is an option that allows specifying a custom metrics object.
 func WithMetrics(m *Metrics) walOpt {
 	return func(w *WAL) {
@@ -51,16 +67,182 @@ func WithMetrics(m *Metrics) walOpt {
 	}
 }
 
+// WithHooks is an option that registers callbacks for WAL lifecycle events.
+// See Hooks for details on when and how they are invoked.
+func WithHooks(h Hooks) walOpt {
+	return func(w *WAL) {
+		w.hooks = h
+	}
+}
+
+// WithRetention is an option that enables a background goroutine that
+// truncates the front of the log automatically. Whole sealed segments are
+// removed, oldest first, while the sealed segments total more than maxBytes or
+// while the oldest was sealed more than maxAge ago. At least minEntries entries
+// are always kept and entries after the index reported by
+// WithAcknowledgedIndex, if set, or not yet committed by every registered
+// Cursor are never removed. A zero maxBytes or maxAge disables that limit.
+func WithRetention(maxBytes uint64, maxAge time.Duration, minEntries uint64) walOpt {
+	return func(w *WAL) {
+		w.retention.maxBytes = maxBytes
+		w.retention.maxAge = maxAge
+		w.retention.minEntries = minEntries
+	}
+}
+
+// WithAcknowledgedIndex is an option that stops retention removing entries
+// that consumers of the log haven't processed yet. fn must return the highest
+// index that every consumer has acknowledged, or zero if some consumer hasn't
+// acknowledged anything. It's called from the retention goroutine.
+func WithAcknowledgedIndex(fn func() uint64) walOpt {
+	return func(w *WAL) {
+		w.retention.acknowledged = fn
+	}
+}
+
+// WithCompaction is an option that enables a background goroutine that
+// reclaims the space taken up by entries truncated from the front of a sealed
+// segment. Front truncations normally only free space once every entry in a
+// segment has been removed. With compaction, once the truncated entries of the
+// first segment are estimated to take up at least minReclaim bytes, the
+// remaining entries are copied to a new segment file which replaces the old
+// one. The SegmentFiler must support rewriting segments which the default one
+// does.
+func WithCompaction(minReclaim uint64) walOpt {
+	return func(w *WAL) {
+		w.compaction.head = true
+		w.compaction.minReclaim = minReclaim
+	}
+}
+
+// WithSegmentMerging is an option that enables a background goroutine that
+// merges runs of adjacent sealed segments that are each smaller than
+// smallSize bytes into a single segment, as long as the merged segment is no
+// larger than the segment size. Lots of small segments can build up after many
+// TruncateBack calls and each costs an open file and an entry in the meta data.
+// The SegmentFiler must support rewriting segments which the default one does.
+func WithSegmentMerging(smallSize uint64) walOpt {
+	return func(w *WAL) {
+		w.compaction.mergeBelow = smallSize
+	}
+}
+
+// WithCursorTruncationGuard is an option that makes TruncateFront return
+// ErrCursorBehind rather than remove entries that a registered Cursor hasn't
+// committed yet.
+func WithCursorTruncationGuard() walOpt {
+	return func(w *WAL) {
+		w.cursorGuard = true
+	}
+}
+
+// WithDiskReserve is an option that makes StoreLogs fail with ErrDiskFull once
+// the free space on the WAL's file system drops below reserve bytes. This
+// leaves room for the meta updates and new segment files that truncations need
+// so that operators can always recover by truncating. The SegmentFiler must be
+// able to report free space which the default one can on Linux and macOS. Free
+// space is checked at most once a second and whenever a segment file is
+// created, with appends in between counted against the last value.
+func WithDiskReserve(reserve uint64) walOpt {
+	return func(w *WAL) {
+		w.diskReserve = reserve
+	}
+}
+
+// WithMmap is an option that memory maps sealed segments read-only so reading
+// an entry copies it straight from the mapping rather than making several
+// system calls. Segments are only unmapped once no reader is using them. Where
+// mapping isn't supported, such as on wasm, segments are read normally. If a
+// custom SegmentFiler is used it must be configured to map segments itself,
+// see segment.WithMmap.
+func WithMmap() walOpt {
+	return func(w *WAL) {
+		w.mmap = true
+	}
+}
+
+// WithFSOptions is an option that configures how segment files are synced and
+// written, for example with fdatasync or O_DIRECT, see fs.Options. Open fails
+// if the options aren't supported on this platform. If a custom SegmentFiler
+// is used it must be given a VFS from fs.NewWithOptions itself.
+func WithFSOptions(opts fs.Options) walOpt {
+	return func(w *WAL) {
+		w.fsOpts = opts
+	}
+}
+
+// WithIndexCache is an option that keeps the index blocks of sealed segments in
+// memory, up to budget bytes in total, so reading from a sealed segment only
+// needs to read the entry itself. Index blocks are loaded the first time a
+// segment is read and the least recently used are dropped to stay within
+// budget. If a custom SegmentFiler is used it must be configured with a cache
+// itself, see segment.WithIndexCache.
+func WithIndexCache(budget uint64) walOpt {
+	return func(w *WAL) {
+		w.indexCacheBytes = budget
+	}
+}
+
+// WithEntryCache is an option that keeps recently appended or read entries in
+// memory so reading them again doesn't touch the segment files. The least
+// recently used entries are dropped once the cached entries' data adds up to
+// more than maxBytes. This is useful when followers or replicators re-read the
+// most recent entries.
+func WithEntryCache(maxBytes uint64) walOpt {
+	return func(w *WAL) {
+		w.entryCache = newEntryCache(maxBytes)
+	}
+}
+
+// WithOrphanQuarantine is an option that makes Open move orphaned segment
+// files, ones that exist on disk but aren't in the WAL's metadata, into a
+// quarantine subdirectory instead of deleting them. This protects the data if
+// the metadata is stale, for example because it was restored from an old
+// backup. Quarantined files older than retention are deleted each time the
+// WAL is opened, zero keeps them forever. Use waldump to list or restore them.
+// The SegmentFiler must be able to move files which the default one can.
+func WithOrphanQuarantine(retention time.Duration) walOpt {
+	return func(w *WAL) {
+		w.quarantine = true
+		w.quarantineRetention = retention
+	}
+}
+
+// WithSegmentPreallocation is an option that creates and preallocates the file
+// for the next segment in the background once threshold, a fraction between 0
+// and 1, of the tail segment's size limit has been written. Rotation then
+// only needs to rename the file into place, commit the metadata and swap the
+// writer rather than allocating a whole segment while appends wait. The
+// SegmentFiler must be able to preallocate segments which the default one can.
+func WithSegmentPreallocation(threshold float64) walOpt {
+	return func(w *WAL) {
+		w.prealloc.threshold = threshold
+	}
+}
+
 func (w *WAL) applyDefaultsAndValidate() error {
 	// Defaults
 	if w.logger == nil {
 		w.logger = log.NewNopLogger()
 	}
+	if w.maxEntrySize == 0 {
+		w.maxEntrySize = segment.DefaultMaxEntrySize
+	}
 	if w.sf == nil {
 		// These are not actually swappable via options right now but we override
 		// them in tests. Only load the default implementations if they are not set.
-		vfs := fs.New()
-		w.sf = segment.NewFiler(w.dir, vfs)
+		vfs, err := fs.NewWithOptions(w.fsOpts)
+		if err != nil {
+			return err
+		}
+		f := segment.NewFiler(w.dir, vfs, segment.WithMaxEntrySize(w.maxEntrySize))
+		if w.mmap {
+			segment.WithMmap()(f)
+		}
+		if w.indexCacheBytes > 0 {
+			segment.WithIndexCache(w.indexCacheBytes)(f)
+		}
+		w.sf = f
 	}
 	if w.metrics == nil {
 		w.metrics = newWALMetrics(prometheus.NewRegistry())
@@ -71,5 +253,41 @@ func (w *WAL) applyDefaultsAndValidate() error {
 	if w.segmentSize == 0 {
 		w.segmentSize = DefaultSegmentSize
 	}
+	if w.retention.interval == 0 {
+		w.retention.interval = DefaultRetentionInterval
+	}
+
+	// Validation
+	if w.segmentSize < MinSegmentSize || uint64(w.segmentSize) > MaxSegmentSize {
+		return fmt.Errorf("segment size %d is out of range, it must be between %d and %d bytes",
+			w.segmentSize, MinSegmentSize, uint64(MaxSegmentSize))
+	}
+	if w.compaction.enabled() {
+		if _, ok := w.sf.(segmentMerger); !ok {
+			return fmt.Errorf("compaction and merging require a SegmentFiler that can rewrite segments")
+		}
+	}
+	if w.prealloc.threshold < 0 || w.prealloc.threshold > 1 {
+		return fmt.Errorf("segment preallocation threshold %g is out of range, it must be between 0 and 1", w.prealloc.threshold)
+	}
+	if w.prealloc.enabled() {
+		if _, ok := w.sf.(segmentPreallocator); !ok {
+			return fmt.Errorf("segment preallocation requires a SegmentFiler that can preallocate segments")
+		}
+	}
+	if w.quarantine {
+		if _, ok := w.sf.(orphanQuarantiner); !ok {
+			return fmt.Errorf("orphan quarantine requires a SegmentFiler that can quarantine segments")
+		}
+	}
+	if w.diskReserve > 0 {
+		sr, ok := w.sf.(spaceReporter)
+		if !ok {
+			return fmt.Errorf("disk reserve requires a SegmentFiler that can report free space")
+		}
+		if _, err := sr.FreeSpace(); err != nil {
+			return fmt.Errorf("disk reserve is not supported: %w", err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"github.com/go-kit/log/level"
+)
+
+// segmentPreallocator is implemented by SegmentFilers that can prepare the
+// file for the next segment ahead of time, such as segment.Filer.
+type segmentPreallocator interface {
+	Preallocate(size uint64) error
+}
+
+// preallocPolicy configures preparing the next segment file in the background
+// before the tail fills up.
+type preallocPolicy struct {
+	// threshold is the fraction of the tail's SizeLimit that must be written
+	// before the next segment is preallocated. Zero disables preallocation.
+	threshold float64
+
+	// ch triggers the background goroutine and done is closed when it exits.
+	ch   chan struct{}
+	done chan struct{}
+
+	// requested is set once preallocation has been triggered for the current
+	// tail. It's only accessed with writeMu held.
+	requested bool
+}
+
+func (p preallocPolicy) enabled() bool {
+	return p.threshold > 0
+}
+
+// maybePreallocLocked triggers preallocation of the next segment if the tail
+// has passed the fill threshold. It must be called with writeMu held and
+// never blocks.
+func (w *WAL) maybePreallocLocked(s *state) {
+	if !w.prealloc.enabled() || w.prealloc.requested {
+		return
+	}
+	sz, ok := s.tail.(segmentSizer)
+	if !ok {
+		return
+	}
+	if float64(sz.Size()) < w.prealloc.threshold*float64(w.segmentSize) {
+		return
+	}
+	w.prealloc.requested = true
+	select {
+	case w.prealloc.ch <- struct{}{}:
+	default:
+		// Already pending
+	}
+}
+
+// runPrealloc preallocates the next segment each time it's triggered until
+// the WAL is closed.
+func (w *WAL) runPrealloc() {
+	defer close(w.prealloc.done)
+	for {
+		select {
+		case <-w.shutdownCh:
+			return
+		case <-w.prealloc.ch:
+			if err := w.sf.(segmentPreallocator).Preallocate(uint64(w.segmentSize)); err != nil {
+				level.Error(w.logger).Log("msg", "segment preallocation failed", "err", err)
+				continue
+			}
+			w.metrics.SegmentPreallocations.Inc()
+		}
+	}
+}
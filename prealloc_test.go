@@ -0,0 +1,42 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/types"
+)
+
+func TestSegmentPreallocation(t *testing.T) {
+	w, err := Open(t.TempDir(), WithSegmentSize(MinSegmentSize), WithSegmentPreallocation(0.5))
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Write enough to fill several segments, giving preallocation a chance to
+	// finish before each rotation.
+	for i := uint64(1); i <= 2000; i += 10 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(i, 10)))
+		time.Sleep(time.Millisecond)
+	}
+	require.Greater(t, testutil.ToFloat64(w.metrics.SegmentRotations), 2.0)
+	require.Greater(t, testutil.ToFloat64(w.metrics.SegmentPreallocations), 1.0)
+
+	var le types.LogEntry
+	for i := uint64(1); i < 2000; i++ {
+		require.NoError(t, w.GetLog(i, &le))
+		validateLogEntry(t, le)
+	}
+}
+
+func TestSegmentPreallocationOptions(t *testing.T) {
+	_, err := Open(t.TempDir(), WithSegmentPreallocation(1.5))
+	require.ErrorContains(t, err, "out of range")
+	_, err = Open(t.TempDir(), WithSegmentPreallocation(0.5), WithSegmentFiler(struct{ types.SegmentFiler }{}))
+	require.ErrorContains(t, err, "can preallocate segments")
+}
@@ -0,0 +1,88 @@
+//go:build !wasm
+
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package raftadapter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// logCodecVersion is the first byte of every encoded log so the format can
+// evolve without breaking existing WALs.
+const logCodecVersion = 1
+
+var errLogTruncated = errors.New("encoded raft log is truncated")
+
+// EncodeLog encodes every field of l except Index, which the WAL already
+// stores, in a compact binary format:
+//
+//	version (1 byte) | Type (1 byte) | Term (uvarint) |
+//	AppendedAt (varint unix nanoseconds, zero for the zero time) |
+//	len(Extensions) (uvarint) | Extensions | Data
+//
+// Data goes last so it doesn't need a length prefix.
+func EncodeLog(l *raft.Log) []byte {
+	buf := make([]byte, 0, 2+3*binary.MaxVarintLen64+len(l.Extensions)+len(l.Data))
+	buf = append(buf, logCodecVersion, byte(l.Type))
+	buf = binary.AppendUvarint(buf, l.Term)
+	var appendedAt int64
+	if !l.AppendedAt.IsZero() {
+		appendedAt = l.AppendedAt.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, appendedAt)
+	buf = binary.AppendUvarint(buf, uint64(len(l.Extensions)))
+	buf = append(buf, l.Extensions...)
+	return append(buf, l.Data...)
+}
+
+// DecodeLog decodes data produced by EncodeLog into l. It doesn't touch
+// l.Index. Data and Extensions alias data.
+func DecodeLog(data []byte, l *raft.Log) error {
+	if len(data) < 2 {
+		return errLogTruncated
+	}
+	if data[0] != logCodecVersion {
+		return fmt.Errorf("unsupported raft log codec version %d", data[0])
+	}
+	l.Type = raft.LogType(data[1])
+	data = data[2:]
+
+	term, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errLogTruncated
+	}
+	l.Term = term
+	data = data[n:]
+
+	appendedAt, n := binary.Varint(data)
+	if n <= 0 {
+		return errLogTruncated
+	}
+	l.AppendedAt = time.Time{}
+	if appendedAt != 0 {
+		l.AppendedAt = time.Unix(0, appendedAt)
+	}
+	data = data[n:]
+
+	extLen, n := binary.Uvarint(data)
+	if n <= 0 || extLen > uint64(len(data)-n) {
+		return errLogTruncated
+	}
+	data = data[n:]
+	l.Extensions = nil
+	if extLen > 0 {
+		l.Extensions = data[:extLen]
+	}
+	l.Data = data[extLen:]
+	if len(l.Data) == 0 {
+		l.Data = nil
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+//go:build !wasm
+
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+// Package raftadapter wraps a *wal.WAL so it can be used as the LogStore and
+// StableStore of a github.com/hashicorp/raft node. It isn't built on wasm since
+// raft's dependencies don't support it.
+package raftadapter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/polarsignals/wal"
+	"github.com/polarsignals/wal/types"
+)
+
+// ErrKeyNotFound is returned by Get for keys that have never been set. Raft
+// checks for missing keys by comparing the error message with "not found"
+// which this matches.
+var ErrKeyNotFound = errors.New("not found")
+
+// Store implements raft.LogStore, raft.StableStore and raft.MonotonicLogStore
+// on top of a WAL. Log fields other than Index are encoded with EncodeLog.
+type Store struct {
+	w *wal.WAL
+}
+
+var (
+	_ raft.LogStore          = (*Store)(nil)
+	_ raft.StableStore       = (*Store)(nil)
+	_ raft.MonotonicLogStore = (*Store)(nil)
+)
+
+// New returns a Store backed by w. The caller remains responsible for closing
+// w.
+func New(w *wal.WAL) *Store {
+	return &Store{w: w}
+}
+
+// IsMonotonic implements raft.MonotonicLogStore. The WAL can't store logs with
+// gaps between indexes.
+func (s *Store) IsMonotonic() bool {
+	return true
+}
+
+// FirstIndex returns the first index written. 0 for no entries.
+func (s *Store) FirstIndex() (uint64, error) {
+	return s.w.FirstIndex()
+}
+
+// LastIndex returns the last index written. 0 for no entries.
+func (s *Store) LastIndex() (uint64, error) {
+	return s.w.LastIndex()
+}
+
+// GetLog gets a log entry at a given index. It returns raft.ErrLogNotFound if
+// the index isn't in the log.
+func (s *Store) GetLog(index uint64, log *raft.Log) error {
+	var le types.LogEntry
+	if err := s.w.GetLog(index, &le); err != nil {
+		if errors.Is(err, wal.ErrNotFound) {
+			return raft.ErrLogNotFound
+		}
+		return err
+	}
+	if err := DecodeLog(le.Data, log); err != nil {
+		return fmt.Errorf("%w: failed to decode raft log %d: %s", wal.ErrCorrupt, index, err)
+	}
+	log.Index = index
+	return nil
+}
+
+// StoreLog stores a log entry.
+func (s *Store) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs stores multiple log entries. Indexes must follow on from the last
+// index in the log without gaps unless the log is empty.
+func (s *Store) StoreLogs(logs []*raft.Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	entries := make([]types.LogEntry, len(logs))
+	for i, l := range logs {
+		entries[i] = types.LogEntry{Index: l.Index, Data: EncodeLog(l)}
+	}
+	return s.w.StoreLogs(entries)
+}
+
+// DeleteRange deletes the inclusive range of log entries from min to max. The
+// range must be a prefix or suffix of the log, or cover it entirely, since
+// those are the only deletions the WAL supports and all that raft needs.
+func (s *Store) DeleteRange(min, max uint64) error {
+	if min > max {
+		return nil
+	}
+	first, err := s.w.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := s.w.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case last == 0 || max < first || min > last:
+		// Nothing to delete.
+		return nil
+	case min <= first:
+		// A prefix or the whole log. Truncating the front past the last index
+		// resets the WAL to empty.
+		return s.w.TruncateFront(max + 1)
+	case max >= last:
+		return s.w.TruncateBack(min - 1)
+	default:
+		return fmt.Errorf("only suffix or prefix ranges may be deleted from log: "+
+			"first=%d last=%d min=%d max=%d", first, last, min, max)
+	}
+}
+
+// Set durably stores val under key.
+func (s *Store) Set(key []byte, val []byte) error {
+	return s.w.SetStable(key, val)
+}
+
+// Get returns the value for key or ErrKeyNotFound if it isn't set.
+func (s *Store) Get(key []byte) ([]byte, error) {
+	val, err := s.w.GetStable(key)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+// SetUint64 durably stores val under key.
+func (s *Store) SetUint64(key []byte, val uint64) error {
+	return s.w.SetUint64(key, val)
+}
+
+// GetUint64 returns the value for key or zero if it isn't set.
+func (s *Store) GetUint64(key []byte) (uint64, error) {
+	return s.w.GetUint64(key)
+}
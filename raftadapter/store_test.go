@@ -0,0 +1,264 @@
+//go:build !wasm
+
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package raftadapter
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal"
+)
+
+func TestLogCodec(t *testing.T) {
+	cases := []raft.Log{
+		{},
+		{Term: 1, Type: raft.LogCommand, Data: []byte("hello")},
+		{
+			Term:       1 << 40,
+			Type:       raft.LogConfiguration,
+			Data:       []byte("config"),
+			Extensions: []byte("ext"),
+			AppendedAt: time.Unix(1700000000, 123456789),
+		},
+		{Term: 7, Type: raft.LogNoop, Extensions: []byte{0}},
+	}
+	for i, want := range cases {
+		var got raft.Log
+		require.NoError(t, DecodeLog(EncodeLog(&want), &got), "case %d", i)
+		require.Equal(t, want.Term, got.Term)
+		require.Equal(t, want.Type, got.Type)
+		require.Equal(t, want.Data, got.Data)
+		require.Equal(t, want.Extensions, got.Extensions)
+		require.True(t, want.AppendedAt.Equal(got.AppendedAt))
+	}
+
+	raw := EncodeLog(&cases[2])
+	for i := 0; i < 8; i++ {
+		var got raft.Log
+		require.Error(t, DecodeLog(raw[:i], &got), "truncation to %d bytes", i)
+	}
+	raw[0] = logCodecVersion + 1
+	var got raft.Log
+	require.ErrorContains(t, DecodeLog(raw, &got), "unsupported raft log codec version")
+}
+
+func openStore(t *testing.T, dir string) (*wal.WAL, *Store) {
+	t.Helper()
+	w, err := wal.Open(dir, wal.WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	return w, New(w)
+}
+
+func makeLogs(first, last uint64) []*raft.Log {
+	var logs []*raft.Log
+	for idx := first; idx <= last; idx++ {
+		logs = append(logs, &raft.Log{
+			Index:      idx,
+			Term:       idx / 10,
+			Type:       raft.LogCommand,
+			Data:       []byte(fmt.Sprintf("log %d", idx)),
+			AppendedAt: time.Unix(0, int64(idx)*1000),
+		})
+	}
+	return logs
+}
+
+// TestConformance runs the same sequence of operations against the adapter and
+// raft's InmemStore and checks they behave identically.
+func TestConformance(t *testing.T) {
+	dir := t.TempDir()
+	w, store := openStore(t, dir)
+	defer func() { w.Close() }()
+	mem := raft.NewInmemStore()
+
+	type stores interface {
+		raft.LogStore
+		raft.StableStore
+	}
+	both := func(fn func(s stores) error) {
+		t.Helper()
+		errMem := fn(mem)
+		errWAL := fn(store)
+		if errMem == nil {
+			require.NoError(t, errWAL)
+		} else {
+			require.EqualError(t, errWAL, errMem.Error())
+		}
+	}
+	check := func() {
+		t.Helper()
+		memFirst, _ := mem.FirstIndex()
+		memLast, _ := mem.LastIndex()
+		first, err := store.FirstIndex()
+		require.NoError(t, err)
+		last, err := store.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, memFirst, first, "FirstIndex")
+		require.Equal(t, memLast, last, "LastIndex")
+
+		// Check one either side of the range too.
+		for idx := memFirst; idx <= memLast+1; idx++ {
+			var want, got raft.Log
+			errMem := mem.GetLog(idx, &want)
+			errWAL := store.GetLog(idx, &got)
+			require.Equal(t, errMem, errWAL, "GetLog(%d)", idx)
+			if errMem != nil {
+				continue
+			}
+			require.Equal(t, want.Index, got.Index)
+			require.Equal(t, want.Term, got.Term)
+			require.Equal(t, want.Type, got.Type)
+			require.Equal(t, want.Data, got.Data)
+			require.True(t, want.AppendedAt.Equal(got.AppendedAt))
+		}
+		var got raft.Log
+		require.Equal(t, raft.ErrLogNotFound, store.GetLog(memFirst-1, &got))
+	}
+
+	check()
+
+	both(func(s stores) error { return s.StoreLog(makeLogs(1, 1)[0]) })
+	both(func(s stores) error { return s.StoreLogs(makeLogs(2, 500)) })
+	check()
+
+	// Head truncation like raft does after a snapshot.
+	both(func(s stores) error { return s.DeleteRange(1, 200) })
+	check()
+
+	// Tail truncation like raft does when a follower's log conflicts.
+	both(func(s stores) error { return s.DeleteRange(450, 500) })
+	check()
+	both(func(s stores) error { return s.StoreLogs(makeLogs(450, 600)) })
+	check()
+
+	// Ranges outside the log are no-ops. InmemStore moves its first or last
+	// index when deleting outside the log so only check these against the WAL.
+	require.NoError(t, store.DeleteRange(1, 100))
+	require.NoError(t, store.DeleteRange(1000, 2000))
+	check()
+
+	// Persisted across restarts.
+	require.NoError(t, w.Close())
+	w, store = openStore(t, dir)
+	check()
+
+	// Deleting everything, like raft does on restoring a snapshot to a
+	// MonotonicLogStore, resets the log so it can start from any index.
+	both(func(s stores) error { return s.DeleteRange(201, 600) })
+	check()
+	both(func(s stores) error { return s.StoreLogs(makeLogs(1000, 1010)) })
+	check()
+
+	// Stable store.
+	both(func(s stores) error { _, err := s.Get([]byte("missing")); return err })
+	both(func(s stores) error {
+		v, err := s.GetUint64([]byte("missing"))
+		require.Equal(t, uint64(0), v)
+		return err
+	})
+	both(func(s stores) error { return s.Set([]byte("LastVoteCand"), []byte("node-a")) })
+	both(func(s stores) error { return s.SetUint64([]byte("CurrentTerm"), 5) })
+	require.NoError(t, w.Close())
+	w, store = openStore(t, dir)
+
+	both(func(s stores) error {
+		v, err := s.Get([]byte("LastVoteCand"))
+		require.Equal(t, []byte("node-a"), v)
+		return err
+	})
+	both(func(s stores) error {
+		v, err := s.GetUint64([]byte("CurrentTerm"))
+		require.Equal(t, uint64(5), v)
+		return err
+	})
+}
+
+func TestDeleteRangeMiddle(t *testing.T) {
+	w, store := openStore(t, t.TempDir())
+	defer w.Close()
+
+	require.NoError(t, store.StoreLogs(makeLogs(1, 10)))
+	require.ErrorContains(t, store.DeleteRange(3, 5), "only suffix or prefix ranges")
+}
+
+// TestRaft runs a single node raft cluster on the adapter to check it works end
+// to end.
+func TestRaft(t *testing.T) {
+	dir := t.TempDir()
+	w, store := openStore(t, dir)
+	defer w.Close()
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = "node-a"
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.LogOutput = io.Discard
+
+	addr, trans := raft.NewInmemTransport("")
+	fsm := &countingFSM{}
+	r, err := raft.NewRaft(conf, fsm, store, store, raft.NewInmemSnapshotStore(), trans)
+	require.NoError(t, err)
+	defer r.Shutdown()
+
+	require.NoError(t, r.BootstrapCluster(raft.Configuration{
+		Servers: []raft.Server{{ID: conf.LocalID, Address: addr}},
+	}).Error())
+
+	select {
+	case <-r.LeaderCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for leadership")
+	}
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, r.Apply([]byte(fmt.Sprintf("cmd %d", i)), time.Second).Error())
+	}
+	require.Equal(t, 100, fsm.count())
+
+	term, err := store.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Greater(t, term, uint64(0))
+
+	last, err := store.LastIndex()
+	require.NoError(t, err)
+	var l raft.Log
+	require.NoError(t, store.GetLog(last, &l))
+	require.Equal(t, raft.LogCommand, l.Type)
+	require.Equal(t, []byte("cmd 99"), l.Data)
+}
+
+type countingFSM struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (f *countingFSM) Apply(*raft.Log) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n++
+	return nil
+}
+
+func (f *countingFSM) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+func (f *countingFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return nil, fmt.Errorf("snapshots not supported")
+}
+
+func (f *countingFSM) Restore(io.ReadCloser) error {
+	return fmt.Errorf("snapshots not supported")
+}
@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/polarsignals/wal/segment"
+	"github.com/polarsignals/wal/types"
+)
+
+// RecoveryReport describes what Open had to do to recover the log after it
+// was last closed. After a clean shutdown nothing is discarded or deleted.
+type RecoveryReport struct {
+	// Tail is the tail segment that was recovered. It's nil if there was no
+	// tail segment to recover and a new one was created.
+	Tail *types.SegmentInfo
+
+	// LastIndex is the last valid index in the log after recovery.
+	LastIndex uint64
+
+	// Discarded describes the data discarded from the end of the tail segment,
+	// if any.
+	Discarded types.TailRecovery
+
+	// DeletedOrphans are the segment files that were deleted because they
+	// weren't part of the recovered log, for example a segment created by a
+	// rotation or compaction that crashed before it committed. Only the ID and
+	// BaseIndex are known.
+	DeletedOrphans []types.SegmentInfo
+
+	// QuarantinedOrphans are the orphaned segment files that were moved to the
+	// quarantine directory instead of being deleted because
+	// WithOrphanQuarantine is set.
+	QuarantinedOrphans []types.SegmentInfo
+}
+
+// orphanQuarantiner is implemented by SegmentFilers that can move orphaned
+// segments aside instead of deleting them, such as segment.Filer.
+type orphanQuarantiner interface {
+	Quarantine(baseIndex, ID uint64) error
+	PruneQuarantined(before time.Time) ([]segment.QuarantinedFile, error)
+}
+
+// RecoveryReport returns the report of what was recovered when the WAL was
+// opened.
+func (w *WAL) RecoveryReport() RecoveryReport {
+	r := w.recovery
+	if r.Tail != nil {
+		tail := *r.Tail
+		r.Tail = &tail
+	}
+	r.DeletedOrphans = append([]types.SegmentInfo(nil), r.DeletedOrphans...)
+	r.QuarantinedOrphans = append([]types.SegmentInfo(nil), r.QuarantinedOrphans...)
+	return r
+}
+
+// reportRecovery logs the recovery report and updates the recovery metrics.
+func (w *WAL) reportRecovery() {
+	r := w.recovery
+	for _, info := range r.DeletedOrphans {
+		level.Warn(w.logger).Log("msg", "deleted orphaned segment", "baseIndex", info.BaseIndex, "id", info.ID)
+	}
+	w.metrics.RecoveryOrphansDeleted.Add(float64(len(r.DeletedOrphans)))
+	for _, info := range r.QuarantinedOrphans {
+		level.Warn(w.logger).Log("msg", "quarantined orphaned segment", "baseIndex", info.BaseIndex, "id", info.ID)
+	}
+	w.metrics.RecoveryOrphansQuarantined.Add(float64(len(r.QuarantinedOrphans)))
+
+	if r.Tail == nil {
+		return
+	}
+	if r.Discarded.Reason != "" {
+		level.Warn(w.logger).Log("msg", "discarded uncommitted data from tail segment",
+			"id", r.Tail.ID, "reason", r.Discarded.Reason,
+			"start", r.Discarded.DiscardStart, "end", r.Discarded.DiscardEnd,
+			"lastIndex", r.LastIndex)
+		w.metrics.RecoveryDiscards.WithLabelValues(string(r.Discarded.Reason)).Inc()
+		w.metrics.RecoveryBytesDiscarded.Add(float64(r.Discarded.DiscardEnd - r.Discarded.DiscardStart))
+		return
+	}
+	level.Info(w.logger).Log("msg", "recovered tail segment", "id", r.Tail.ID, "lastIndex", r.LastIndex)
+}
+
+// quarantineSegments moves orphaned segment files to quarantine and returns
+// the ones that were moved. Files that can't be moved are left where they are
+// rather than deleted so they'll be retried next time.
+func (w *WAL) quarantineSegments(orphans map[uint64]types.SegmentInfo) []types.SegmentInfo {
+	q := w.sf.(orphanQuarantiner)
+	var moved []types.SegmentInfo
+	for ID, info := range orphans {
+		if err := q.Quarantine(info.BaseIndex, ID); err != nil {
+			level.Error(w.logger).Log("msg", "failed to quarantine orphaned segment", "baseIndex", info.BaseIndex, "id", ID, "err", err)
+			continue
+		}
+		moved = append(moved, info)
+	}
+	return moved
+}
+
+// pruneQuarantine deletes quarantined files older than the retention period.
+func (w *WAL) pruneQuarantine(now time.Time) {
+	if w.quarantineRetention == 0 {
+		return
+	}
+	pruned, err := w.sf.(orphanQuarantiner).PruneQuarantined(now.Add(-w.quarantineRetention))
+	for _, qf := range pruned {
+		level.Info(w.logger).Log("msg", "deleted expired quarantined segment", "file", qf.Name)
+	}
+	if err != nil {
+		level.Error(w.logger).Log("msg", "failed to prune quarantined segments", "err", err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/fs"
+	"github.com/polarsignals/wal/segment"
+	"github.com/polarsignals/wal/types"
+)
+
+func TestRecoveryReport(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir)
+	require.NoError(t, err)
+	// A brand new WAL has no tail to recover.
+	require.Nil(t, w.RecoveryReport().Tail)
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 10)))
+	require.NoError(t, w.StoreLogs([]types.LogEntry{{Index: 11, Data: []byte("corrupt me")}}))
+	tail := w.loadState().getTailInfo().SegmentInfo
+	require.NoError(t, w.Close())
+
+	// A clean shutdown has nothing to report.
+	w, err = Open(dir)
+	require.NoError(t, err)
+	r := w.RecoveryReport()
+	require.Equal(t, tail.ID, r.Tail.ID)
+	require.Equal(t, uint64(11), r.LastIndex)
+	require.Empty(t, r.Discarded.Reason)
+	require.Empty(t, r.DeletedOrphans)
+	require.NoError(t, w.Close())
+
+	// Corrupt the last commit and leave an orphaned segment behind.
+	fname := filepath.Join(dir, segment.FileName(tail))
+	buf, err := os.ReadFile(fname)
+	require.NoError(t, err)
+	off := bytes.Index(buf, []byte("corrupt me"))
+	require.Greater(t, off, 0)
+	f, err := os.OpenFile(fname, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("C"), int64(off))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	orphan := types.SegmentInfo{ID: tail.ID + 10, BaseIndex: 100}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segment.FileName(orphan)), nil, 0644))
+
+	w, err = Open(dir)
+	require.NoError(t, err)
+	defer w.Close()
+	r = w.RecoveryReport()
+	require.Equal(t, tail.ID, r.Tail.ID)
+	require.Equal(t, uint64(10), r.LastIndex)
+	require.Equal(t, types.DiscardCRCMismatch, r.Discarded.Reason)
+	require.Less(t, r.Discarded.DiscardStart, uint64(off))
+	require.Greater(t, r.Discarded.DiscardEnd, uint64(off))
+	require.Equal(t, []types.SegmentInfo{orphan}, r.DeletedOrphans)
+	_, err = os.Stat(filepath.Join(dir, segment.FileName(orphan)))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	lastIndex, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), lastIndex)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(w.metrics.RecoveryDiscards.WithLabelValues("crc_mismatch")))
+	require.Equal(t, float64(r.Discarded.DiscardEnd-r.Discarded.DiscardStart),
+		testutil.ToFloat64(w.metrics.RecoveryBytesDiscarded))
+	require.Equal(t, 1.0, testutil.ToFloat64(w.metrics.RecoveryOrphansDeleted))
+}
+
+func TestOrphanQuarantine(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 10)))
+	require.NoError(t, w.Close())
+
+	orphan := types.SegmentInfo{ID: 1234, BaseIndex: 100}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, segment.FileName(orphan)), []byte("data"), 0644))
+
+	w, err = Open(dir, WithOrphanQuarantine(time.Hour))
+	require.NoError(t, err)
+	r := w.RecoveryReport()
+	require.Empty(t, r.DeletedOrphans)
+	require.Equal(t, []types.SegmentInfo{orphan}, r.QuarantinedOrphans)
+	require.Equal(t, 1.0, testutil.ToFloat64(w.metrics.RecoveryOrphansQuarantined))
+	require.NoError(t, w.Close())
+
+	// The orphan was moved aside, not deleted.
+	_, err = os.Stat(filepath.Join(dir, segment.FileName(orphan)))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	f := segment.NewFiler(dir, fs.New())
+	qfs, err := f.ListQuarantined()
+	require.NoError(t, err)
+	require.Len(t, qfs, 1)
+	require.Equal(t, orphan.ID, qfs[0].Segment.ID)
+	data, err := os.ReadFile(filepath.Join(dir, segment.QuarantineDir, qfs[0].Name))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+
+	// The quarantine dir doesn't confuse a WAL without the option and files
+	// younger than the retention are kept.
+	w, err = Open(dir, WithOrphanQuarantine(time.Hour))
+	require.NoError(t, err)
+	lastIndex, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), lastIndex)
+	require.NoError(t, w.Close())
+	w, err = Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	qfs, err = f.ListQuarantined()
+	require.NoError(t, err)
+	require.Len(t, qfs, 1)
+
+	// Expired files are deleted.
+	w, err = Open(dir, WithOrphanQuarantine(time.Nanosecond))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	qfs, err = f.ListQuarantined()
+	require.NoError(t, err)
+	require.Empty(t, qfs)
+}
+
+func TestOrphanQuarantineRequiresQuarantiner(t *testing.T) {
+	_, err := Open(t.TempDir(), WithOrphanQuarantine(0), WithSegmentFiler(struct{ types.SegmentFiler }{}))
+	require.ErrorContains(t, err, "can quarantine segments")
+}
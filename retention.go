@@ -0,0 +1,151 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// DefaultRetentionInterval is how often the retention policy is evaluated when
+// enabled with WithRetention.
+var DefaultRetentionInterval = time.Minute
+
+// retentionPolicy configures automatic truncation of the front of the log.
+// Zero values disable the respective limit.
+type retentionPolicy struct {
+	maxBytes   uint64
+	maxAge     time.Duration
+	minEntries uint64
+	interval   time.Duration
+
+	// acknowledged reports the highest index all consumers have acknowledged.
+	// It's nil if there are no consumers to wait for.
+	acknowledged func() uint64
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.maxBytes > 0 || p.maxAge > 0
+}
+
+// runRetention periodically enforces the retention policy until the WAL is
+// closed.
+func (w *WAL) runRetention() {
+	ticker := time.NewTicker(w.retention.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.shutdownCh:
+			return
+		case now := <-ticker.C:
+			if err := w.enforceRetention(now); err != nil && err != ErrClosed {
+				level.Error(w.logger).Log("msg", "retention truncation failed", "err", err)
+			}
+		}
+	}
+}
+
+// enforceRetention truncates whole sealed segments from the front of the log
+// while they violate the retention policy as of now.
+func (w *WAL) enforceRetention(now time.Time) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	s, release := w.acquireState()
+	defer release()
+
+	newMin := w.retentionPoint(s, now)
+	if newMin == 0 || newMin <= s.firstIndex() {
+		return nil
+	}
+	return w.truncateHeadLocked(newMin, "retention")
+}
+
+// retentionPoint returns the index that should become the new first index of
+// the log according to the retention policy, or zero if nothing should be
+// truncated. Only whole sealed segments are considered so that truncation
+// always frees disk space. The last entry is never removed by retention, nor
+// is any entry after the acknowledged index or that a registered cursor hasn't
+// committed yet.
+func (w *WAL) retentionPoint(s *state, now time.Time) uint64 {
+	p := w.retention
+	last := s.lastIndex()
+	if last == 0 {
+		return 0
+	}
+
+	// Never move past the slowest consumer.
+	limit := last
+	if p.acknowledged != nil {
+		if acked := p.acknowledged(); acked+1 < limit {
+			limit = acked + 1
+		}
+	}
+	if min, ok := s.minCursorIndex(); ok && min+1 < limit {
+		limit = min + 1
+	}
+
+	var sealed []segmentState
+	var totalBytes uint64
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if seg.SealTime.IsZero() {
+			break
+		}
+		sealed = append(sealed, seg)
+		totalBytes += sealedSegmentSize(seg)
+	}
+
+	newMin := uint64(0)
+	for _, seg := range sealed {
+		tooBig := p.maxBytes > 0 && totalBytes > p.maxBytes
+		tooOld := p.maxAge > 0 && now.Sub(seg.SealTime) > p.maxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		next := seg.MaxIndex + 1
+		if next > limit {
+			break
+		}
+		if p.minEntries > 0 && last-next+1 < p.minEntries {
+			break
+		}
+		newMin = next
+		totalBytes -= sealedSegmentSize(seg)
+	}
+	return newMin
+}
+
+// segmentSizer is implemented by SegmentWriters that can report how many bytes
+// have been written to the segment, such as segment.Writer. It's only called
+// on the write path, including when the segment is sealed.
+type segmentSizer interface {
+	Size() uint64
+}
+
+// sealedSegmentSize returns the bytes a sealed segment occupies on disk as
+// recorded when it was sealed. Segments sealed without recording their size,
+// by an older version or a SegmentWriter that can't report it, are assumed to
+// have filled their size limit.
+func sealedSegmentSize(seg segmentState) uint64 {
+	if seg.Size > 0 {
+		return seg.Size
+	}
+	return seg.SizeLimit
+}
+
+// recordSealedSize sets the size of the sealed tail in info if the tail's
+// SegmentWriter can report it.
+func recordSealedSize(info *types.SegmentInfo, tail types.SegmentWriter) {
+	if sz, ok := tail.(segmentSizer); ok {
+		info.Size = sz.Size()
+	}
+}
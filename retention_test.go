@@ -0,0 +1,228 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/segment"
+)
+
+func TestRetention(t *testing.T) {
+	// Each full test segment has 100 entries of 4 bytes so is 400 bytes.
+	cases := []struct {
+		name        string
+		tsOpts      []testStorageOpt
+		walOpts     []walOpt
+		advance     time.Duration
+		expectFirst uint64
+		expectLast  uint64
+	}{
+		{
+			name:        "no limits exceeded",
+			tsOpts:      []testStorageOpt{segFull(), segFull(), segTail(10)},
+			walOpts:     []walOpt{WithRetention(1000, time.Hour, 0)},
+			expectFirst: 1,
+			expectLast:  210,
+		},
+		{
+			name:        "size limit",
+			tsOpts:      []testStorageOpt{segFull(), segFull(), segFull(), segTail(10)},
+			walOpts:     []walOpt{WithRetention(500, 0, 0)},
+			expectFirst: 201,
+			expectLast:  310,
+		},
+		{
+			name:        "age limit",
+			tsOpts:      []testStorageOpt{segFull(), segFull(), segTail(10)},
+			walOpts:     []walOpt{WithRetention(0, time.Hour, 0)},
+			advance:     2 * time.Hour,
+			expectFirst: 201,
+			expectLast:  210,
+		},
+		{
+			name:        "min entries",
+			tsOpts:      []testStorageOpt{segFull(), segFull(), segTail(10)},
+			walOpts:     []walOpt{WithRetention(0, time.Hour, 110)},
+			advance:     2 * time.Hour,
+			expectFirst: 101,
+			expectLast:  210,
+		},
+		{
+			name:        "never removes last entry",
+			tsOpts:      []testStorageOpt{segFull(), segFull(), segTail(0)},
+			walOpts:     []walOpt{WithRetention(0, time.Hour, 0)},
+			advance:     2 * time.Hour,
+			expectFirst: 101,
+			expectLast:  200,
+		},
+		{
+			name:   "acknowledged index holds back truncation",
+			tsOpts: []testStorageOpt{segFull(), segFull(), segTail(10)},
+			walOpts: []walOpt{
+				WithRetention(0, time.Hour, 0),
+				WithAcknowledgedIndex(func() uint64 { return 150 }),
+			},
+			advance:     2 * time.Hour,
+			expectFirst: 101,
+			expectLast:  210,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			m := newWALMetrics(reg)
+			opts := append(tc.walOpts, WithMetrics(m))
+			_, w, err := testOpenWAL(t, tc.tsOpts, opts, false)
+			require.NoError(t, err)
+			defer w.Close()
+
+			firstBefore, err := w.FirstIndex()
+			require.NoError(t, err)
+
+			require.NoError(t, w.enforceRetention(time.Now().Add(tc.advance)))
+
+			first, err := w.FirstIndex()
+			require.NoError(t, err)
+			require.Equal(t, int(tc.expectFirst), int(first))
+			last, err := w.LastIndex()
+			require.NoError(t, err)
+			require.Equal(t, int(tc.expectLast), int(last))
+
+			truncated := testutil.ToFloat64(m.EntriesTruncated.WithLabelValues("retention"))
+			require.Equal(t, float64(first-firstBefore), truncated)
+		})
+	}
+}
+
+func TestRetentionAcknowledgedIndex(t *testing.T) {
+	var acked uint64
+	_, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segFull(), segTail(10)},
+		[]walOpt{
+			WithRetention(0, time.Hour, 0),
+			WithAcknowledgedIndex(func() uint64 { return atomic.LoadUint64(&acked) }),
+		}, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Nothing acknowledged blocks all truncation.
+	require.NoError(t, w.enforceRetention(time.Now().Add(2*time.Hour)))
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1, int(first))
+
+	// Only whole segments that have been acknowledged are removed.
+	atomic.StoreUint64(&acked, 120)
+	require.NoError(t, w.enforceRetention(time.Now().Add(2*time.Hour)))
+	first, err = w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 101, int(first))
+
+	atomic.StoreUint64(&acked, 210)
+	require.NoError(t, w.enforceRetention(time.Now().Add(2*time.Hour)))
+	first, err = w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 201, int(first))
+}
+
+func TestRetentionUnregisteredCursorBlocks(t *testing.T) {
+	_, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segFull(), segTail(10)},
+		[]walOpt{WithRetention(0, time.Hour, 0)}, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// A cursor that hasn't committed anything blocks all truncation.
+	c, err := w.Cursor("slow")
+	require.NoError(t, err)
+	require.NoError(t, w.enforceRetention(time.Now().Add(2*time.Hour)))
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1, int(first))
+
+	// Cursors can't move backwards.
+	require.NoError(t, c.Commit(120))
+	require.Error(t, c.Commit(110))
+
+	require.NoError(t, w.enforceRetention(time.Now().Add(2*time.Hour)))
+	first, err = w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 101, int(first))
+
+	// Removing the cursor lets retention catch up.
+	require.NoError(t, w.RemoveCursor("slow"))
+	require.NoError(t, w.enforceRetention(time.Now().Add(2*time.Hour)))
+	first, err = w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 201, int(first))
+}
+
+func TestRetentionBackground(t *testing.T) {
+	_, w, err := testOpenWAL(t, []testStorageOpt{segFull(), segFull(), segTail(10)},
+		[]walOpt{
+			WithRetention(500, 0, 0),
+			func(w *WAL) { w.retention.interval = time.Millisecond },
+		}, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.Eventually(t, func() bool {
+		first, err := w.FirstIndex()
+		return err == nil && first == 101
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestSealedSegmentSize(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Segments sealed by rotation and by TruncateBack, which doesn't write an
+	// index block, all record their real size.
+	for i := uint64(1); i <= 1000; i += 10 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(i, 10)))
+	}
+	require.NoError(t, w.TruncateBack(995))
+	require.NoError(t, w.StoreLogs(makeLogEntries(996, 1)))
+
+	s := w.loadState()
+	it := s.segments.Iterator()
+	n, truncated := 0, false
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if seg.SealTime.IsZero() {
+			continue
+		}
+		// Files are preallocated so may be bigger than what was written.
+		fi, err := os.Stat(filepath.Join(dir, segment.FileName(seg.SegmentInfo)))
+		require.NoError(t, err)
+		require.LessOrEqual(t, seg.Size, uint64(fi.Size()), "segment %d", seg.ID)
+		require.Equal(t, seg.Size, sealedSegmentSize(seg))
+		if seg.IndexStart == 0 {
+			// Sealed by TruncateBack with entries up to 1000 written. Each frame
+			// takes at least 16 bytes.
+			require.Equal(t, uint64(995), seg.MaxIndex)
+			require.GreaterOrEqual(t, seg.Size, 16*(1000-seg.BaseIndex+1))
+			truncated = true
+		} else {
+			require.Greater(t, seg.Size, seg.IndexStart)
+		}
+		n++
+	}
+	require.Greater(t, n, 2)
+	require.True(t, truncated)
+	last, ok := s.segments.Get(s.getTailInfo().BaseIndex)
+	require.True(t, ok)
+	require.Zero(t, last.Size)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"io"
+	"unsafe"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// alignedWriter builds the writes for a file that wants them aligned, see
+// types.AlignedFile. Every write is widened to whole blocks: it starts with the
+// already written part of the block containing the write offset and is padded
+// with zeros at the end. Frames after the last commit are never read so the
+// padding is harmless and the next write overwrites it.
+type alignedWriter struct {
+	align int
+
+	// buf is reused between writes. Its address is a multiple of align.
+	buf []byte
+
+	// tail holds the block at tailOff as of the last write so the next write
+	// doesn't have to read it back. It's only valid if tailOK is set.
+	tail    []byte
+	tailOff uint64
+	tailOK  bool
+}
+
+func newAlignedWriter(align int) *alignedWriter {
+	return &alignedWriter{
+		align: align,
+		tail:  make([]byte, align),
+	}
+}
+
+// writeAt writes data at off in wf using only aligned writes.
+func (a *alignedWriter) writeAt(wf types.WritableFile, data []byte, off uint64) error {
+	align := uint64(a.align)
+	start := off - off%align
+	head := int(off - start)
+	size := int((uint64(head+len(data)) + align - 1) / align * align)
+
+	if cap(a.buf) < size {
+		n := minBufSize
+		for n < size {
+			n *= 2
+		}
+		a.buf = alignedBuffer(n, a.align)
+	}
+	buf := a.buf[:size]
+
+	if head > 0 {
+		// The cached block may be stale if this isn't the block the last write
+		// ended in, for example because we just recovered the file or a failed
+		// append rolled back the write offset.
+		if !a.tailOK || a.tailOff != start {
+			if _, err := wf.ReadAt(a.tail[:head], int64(start)); err != nil {
+				return err
+			}
+		}
+		copy(buf, a.tail[:head])
+	}
+	copy(buf[head:], data)
+	for i := head + len(data); i < size; i++ {
+		buf[i] = 0
+	}
+
+	n, err := wf.WriteAt(buf, int64(start))
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Remember the block the next write will start in.
+	end := off + uint64(len(data))
+	a.tailOff = end - end%align
+	a.tailOK = end%align != 0
+	if a.tailOK {
+		copy(a.tail, buf[a.tailOff-start:])
+	}
+	return nil
+}
+
+// alignedBuffer returns a buffer of n bytes whose address is a multiple of
+// align.
+func alignedBuffer(n, align int) []byte {
+	buf := make([]byte, n+align)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align)); rem != 0 {
+		off = align - rem
+	}
+	return buf[off : off+n : off+n]
+}
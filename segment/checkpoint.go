@@ -0,0 +1,243 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/polarsignals/wal/types"
+)
+
+const (
+	// DefaultCheckpointInterval is the default number of entries appended to
+	// the tail segment between index checkpoints.
+	DefaultCheckpointInterval = 4096
+
+	checkpointFileSuffix = ".idx"
+
+	// checkpointMagic is the first 4 bytes of every checkpoint file.
+	checkpointMagic   uint32 = 0xc4ec6b1d
+	checkpointVersion uint8  = 1
+
+	// checkpointHeaderLen is the length of the checkpoint file header: magic,
+	// version, 3 bytes of padding, BaseIndex and ID.
+	checkpointHeaderLen = 24
+
+	// checkpointRecordHeaderLen is the length of the header before each
+	// record's offsets: number of offsets, CRC and commit end offset.
+	checkpointRecordHeaderLen = 16
+)
+
+// The index of the tail segment is only held in memory until the segment is
+// sealed, so recovering the tail after a restart means scanning every frame in
+// it. To speed that up the Writer periodically appends the offsets of the
+// entries committed since the last checkpoint to a side file. Recovery loads
+// the offsets from there and only scans the frames after the last checkpoint.
+//
+// The side file is never fsynced. Each record is only written after the
+// commit it describes has been synced, and offsets of committed entries in a
+// tail segment never change, so any record that passes its CRC check is
+// correct. Recovery uses records up to the first one that doesn't and new
+// records are written from there. The format is:
+//
+//	File header (24 bytes):
+//	  magic (4) | version (1) | padding (3) | BaseIndex (8) | ID (8)
+//	Record, repeated:
+//	  n (4) | crc (4) | commitEnd (8) | n * offset (8)
+//
+// commitEnd is the file offset just after the commit frame that committed the
+// record's entries. The CRC is the Castagnoli CRC of the record without the
+// crc field.
+
+// CheckpointFileName returns the name of the index checkpoint side file for
+// the segment.
+func CheckpointFileName(info types.SegmentInfo) string {
+	return strings.TrimSuffix(FileName(info), segmentFileSuffix) + checkpointFileSuffix
+}
+
+// checkpoint is the index state loaded from a checkpoint file.
+type checkpoint struct {
+	offsets   []uint64
+	commitEnd uint64
+	// end is the file offset after the last valid record.
+	end int64
+}
+
+// readCheckpoint loads the valid records from the checkpoint file in rf. It
+// returns an error if the file header is missing or doesn't match info.
+func readCheckpoint(rf io.ReaderAt, info types.SegmentInfo) (*checkpoint, error) {
+	var hdr [checkpointHeaderLen]byte
+	if _, err := rf.ReadAt(hdr[:], 0); err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(hdr[0:4]) != checkpointMagic || hdr[4] != checkpointVersion ||
+		binary.LittleEndian.Uint64(hdr[8:16]) != info.BaseIndex || binary.LittleEndian.Uint64(hdr[16:24]) != info.ID {
+		return nil, fmt.Errorf("%w: checkpoint header doesn't match segment %d", types.ErrCorrupt, info.ID)
+	}
+
+	ck := &checkpoint{end: checkpointHeaderLen}
+	var rh [checkpointRecordHeaderLen]byte
+	var buf []byte
+	for {
+		if _, err := rf.ReadAt(rh[:], ck.end); err != nil {
+			// Torn or no more records.
+			return ck, nil
+		}
+		n := binary.LittleEndian.Uint32(rh[0:4])
+		if n == 0 || uint64(n) > maxIndexLen/8 {
+			return ck, nil
+		}
+		if cap(buf) < int(n)*8 {
+			buf = make([]byte, int(n)*8)
+		}
+		buf = buf[:int(n)*8]
+		if _, err := rf.ReadAt(buf, ck.end+checkpointRecordHeaderLen); err != nil {
+			return ck, nil
+		}
+		crc := crc32.Checksum(rh[0:4], castagnoliTable)
+		crc = crc32.Update(crc, castagnoliTable, rh[8:])
+		crc = crc32.Update(crc, castagnoliTable, buf)
+		if crc != binary.LittleEndian.Uint32(rh[4:8]) {
+			return ck, nil
+		}
+		for i := 0; i < len(buf); i += 8 {
+			ck.offsets = append(ck.offsets, binary.LittleEndian.Uint64(buf[i:]))
+		}
+		ck.commitEnd = binary.LittleEndian.Uint64(rh[8:16])
+		ck.end += checkpointRecordHeaderLen + int64(len(buf))
+	}
+}
+
+// checkpointer appends index checkpoints for a tail segment to its side file.
+// Checkpoints only speed up recovery so failing to write one doesn't fail the
+// append, it just disables checkpointing for the rest of the segment.
+type checkpointer struct {
+	vfs      types.VFS
+	dir      string
+	info     types.SegmentInfo
+	interval int
+
+	// f is nil until the first record is written.
+	f types.WritableFile
+	// end is the offset the next record is written at and count the number of
+	// offsets in the file before it.
+	end    int64
+	count  int
+	failed bool
+}
+
+// openCheckpointer loads the checkpoint for a tail segment being recovered and
+// returns a checkpointer ready to append more records to it. The checkpoint is
+// nil if there isn't a valid one.
+func openCheckpointer(vfs types.VFS, dir string, info types.SegmentInfo, interval int) (*checkpointer, *checkpoint) {
+	c := &checkpointer{vfs: vfs, dir: dir, info: info, interval: interval}
+	f, err := vfs.OpenWriter(dir, CheckpointFileName(info))
+	if err != nil {
+		return c, nil
+	}
+	ck, err := readCheckpoint(f, info)
+	if err != nil {
+		// Start again with a new file.
+		f.Close()
+		c.remove()
+		return c, nil
+	}
+	c.f = f
+	c.end = ck.end
+	c.count = len(ck.offsets)
+	return c, ck
+}
+
+// maybeWrite appends a record with the offsets committed since the last one if
+// there are at least interval of them. commitEnd is the offset just after the
+// commit frame that committed them.
+func (c *checkpointer) maybeWrite(offsets []uint64, commitEnd uint64) {
+	if c.failed || len(offsets)-c.count < c.interval {
+		return
+	}
+	if err := c.write(offsets[c.count:], commitEnd); err != nil {
+		c.failed = true
+		return
+	}
+	c.count = len(offsets)
+}
+
+func (c *checkpointer) write(offsets []uint64, commitEnd uint64) error {
+	if c.f == nil {
+		f, err := c.vfs.Create(c.dir, CheckpointFileName(c.info), 0)
+		if err != nil {
+			return err
+		}
+		var hdr [checkpointHeaderLen]byte
+		binary.LittleEndian.PutUint32(hdr[0:4], checkpointMagic)
+		hdr[4] = checkpointVersion
+		binary.LittleEndian.PutUint64(hdr[8:16], c.info.BaseIndex)
+		binary.LittleEndian.PutUint64(hdr[16:24], c.info.ID)
+		if _, err := f.WriteAt(hdr[:], 0); err != nil {
+			f.Close()
+			return err
+		}
+		c.f = f
+		c.end = checkpointHeaderLen
+	}
+
+	buf := make([]byte, checkpointRecordHeaderLen+len(offsets)*8)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(offsets)))
+	binary.LittleEndian.PutUint64(buf[8:16], commitEnd)
+	for i, o := range offsets {
+		binary.LittleEndian.PutUint64(buf[checkpointRecordHeaderLen+i*8:], o)
+	}
+	crc := crc32.Checksum(buf[0:4], castagnoliTable)
+	crc = crc32.Update(crc, castagnoliTable, buf[8:])
+	binary.LittleEndian.PutUint32(buf[4:8], crc)
+
+	if _, err := c.f.WriteAt(buf, c.end); err != nil {
+		return err
+	}
+	c.end += int64(len(buf))
+	return nil
+}
+
+// close closes the side file, leaving it in place for recovery.
+func (c *checkpointer) close() error {
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// remove closes and deletes the side file once the segment is sealed and has
+// an index block, or if it's unusable.
+func (c *checkpointer) remove() {
+	c.close()
+	deleteCheckpoint(c.vfs, c.dir, c.info)
+}
+
+func deleteCheckpoint(vfs types.VFS, dir string, info types.SegmentInfo) error {
+	err := vfs.Delete(dir, CheckpointFileName(info))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func hasPrefix(offsets, prefix []uint64) bool {
+	if len(offsets) < len(prefix) {
+		return false
+	}
+	for i, o := range prefix {
+		if offsets[i] != o {
+			return false
+		}
+	}
+	return true
+}
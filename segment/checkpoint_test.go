@@ -0,0 +1,167 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/types"
+)
+
+func checkpointTestSegment(t *testing.T, f *Filer, n int) (types.SegmentInfo, types.SegmentWriter) {
+	t.Helper()
+	info := testSegment(1)
+	info.SizeLimit = 1024 * 1024
+	w, err := f.Create(info)
+	require.NoError(t, err)
+	for i := uint64(1); i <= uint64(n); i++ {
+		val := fmt.Sprintf("%05d. Some Value.", i)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: i, Data: []byte(val)}}))
+	}
+	return info, w
+}
+
+func TestCheckpointRecovery(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithCheckpointInterval(10))
+
+	info, w := checkpointTestSegment(t, f, 95)
+	require.NoError(t, w.Close())
+	ckFile := vfs.files[CheckpointFileName(info)]
+	require.NotNil(t, ckFile)
+	require.Equal(t, checkpointHeaderLen+9*(checkpointRecordHeaderLen+10*8), ckFile.maxWritten)
+
+	// Clobber the first entry's frame header. A full scan would stop there but
+	// recovery starts after the last checkpoint so never reads it.
+	segFile := vfs.files[FileName(info)]
+	_, err := segFile.WriteAt(make([]byte, frameHeaderLen), fileHeaderLen)
+	require.NoError(t, err)
+
+	rw, err := f.RecoverTail(info)
+	require.NoError(t, err)
+	require.Equal(t, uint64(95), rw.LastIndex())
+	var le types.LogEntry
+	for i := uint64(2); i <= 95; i++ {
+		require.NoError(t, rw.GetLog(i, &le))
+		require.Equal(t, fmt.Sprintf("%05d. Some Value.", i), string(le.Data))
+	}
+
+	// Appends carry on checkpointing after the recovered records.
+	for i := uint64(96); i <= 120; i++ {
+		val := fmt.Sprintf("%05d. Some Value.", i)
+		require.NoError(t, rw.Append([]types.LogEntry{{Index: i, Data: []byte(val)}}))
+	}
+	require.NoError(t, rw.Close())
+
+	ck, err := readCheckpoint(ckFile, info)
+	require.NoError(t, err)
+	require.Len(t, ck.offsets, 120)
+	require.Equal(t, rw.(*Writer).getOffsets()[:120], ck.offsets)
+}
+
+func TestCheckpointTornRecord(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithCheckpointInterval(10))
+
+	info, w := checkpointTestSegment(t, f, 35)
+	require.NoError(t, w.Close())
+
+	// Corrupt the last record so only the first two are used.
+	ckFile := vfs.files[CheckpointFileName(info)]
+	_, err := ckFile.WriteAt([]byte{0xff}, int64(ckFile.maxWritten-1))
+	require.NoError(t, err)
+	ck, err := readCheckpoint(ckFile, info)
+	require.NoError(t, err)
+	require.Len(t, ck.offsets, 20)
+
+	// Recovery writes a record for the rescanned entries over the corrupt one.
+	rw, err := f.RecoverTail(info)
+	require.NoError(t, err)
+	require.Equal(t, uint64(35), rw.LastIndex())
+	ck, err = readCheckpoint(ckFile, info)
+	require.NoError(t, err)
+	require.Equal(t, rw.(*Writer).getOffsets()[:35], ck.offsets)
+	require.NoError(t, rw.Close())
+
+	// A checkpoint with a header for another segment is ignored and rebuilt.
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], info.ID+1)
+	_, err = ckFile.WriteAt(id[:], 16)
+	require.NoError(t, err)
+	rw, err = f.RecoverTail(info)
+	require.NoError(t, err)
+	require.Equal(t, uint64(35), rw.LastIndex())
+	ck, err = readCheckpoint(vfs.files[CheckpointFileName(info)], info)
+	require.NoError(t, err)
+	require.Equal(t, rw.(*Writer).getOffsets()[:35], ck.offsets)
+	require.NoError(t, rw.Close())
+}
+
+func TestCheckpointRemoved(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithCheckpointInterval(10))
+
+	info, w := checkpointTestSegment(t, f, 20)
+	_, ok := vfs.files[CheckpointFileName(info)]
+	require.True(t, ok)
+
+	// Deleting the segment deletes its checkpoint.
+	require.NoError(t, w.Close())
+	require.NoError(t, f.Delete(info.BaseIndex, info.ID))
+	require.Empty(t, vfs.files)
+
+	// Sealing removes the checkpoint since the index block replaces it.
+	info = testSegment(1)
+	w, err := f.Create(info)
+	require.NoError(t, err)
+	for i := uint64(1); ; i++ {
+		require.NoError(t, w.Append([]types.LogEntry{{Index: i, Data: []byte("a value")}}))
+		sealed, _, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			break
+		}
+		if i == 20 {
+			_, ok := vfs.files[CheckpointFileName(info)]
+			require.True(t, ok)
+		}
+	}
+	_, ok = vfs.files[CheckpointFileName(info)]
+	require.False(t, ok)
+}
+
+func TestRecoveryAcrossScanBuffers(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithCheckpointInterval(0))
+
+	info := testSegment(1)
+	info.SizeLimit = 8 * scanBufSize
+	w, err := f.Create(info)
+	require.NoError(t, err)
+
+	// Entries of varying sizes so frame headers land all over the scan buffers,
+	// including straddling their ends.
+	var want []string
+	for i := uint64(1); i <= 200; i++ {
+		val := strings.Repeat(fmt.Sprintf("%d", i%10), int(i*i*3%40000)+1)
+		want = append(want, val)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: i, Data: []byte(val)}}))
+	}
+	require.Greater(t, vfs.files[FileName(info)].maxWritten, 2*scanBufSize)
+	require.NoError(t, w.Close())
+
+	rw, err := f.RecoverTail(info)
+	require.NoError(t, err)
+	require.Equal(t, uint64(200), rw.LastIndex())
+	var le types.LogEntry
+	for i, val := range want {
+		require.NoError(t, rw.GetLog(uint64(i+1), &le))
+		require.Equal(t, val, string(le.Data))
+	}
+}
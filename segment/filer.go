@@ -23,14 +23,89 @@ const (
 type Filer struct {
 	dir string
 	vfs types.VFS
+
+	maxEntrySize int
+	// maxFrameSize is always MaxFrameSize except in tests that need to exercise
+	// continuation frames without writing huge entries.
+	maxFrameSize int
+
+	// mmap opens sealed segments memory mapped if the VFS supports it.
+	mmap bool
+
+	// indexCache holds index blocks of sealed segments in memory if it's
+	// enabled.
+	indexCache *indexCache
+
+	// checkpointInterval is the number of entries appended to the tail
+	// between index checkpoints. Zero disables them.
+	checkpointInterval int
+
+	// spare is the file made ready for the next segment by Preallocate.
+	spare spareFile
+}
+
+type filerOpt func(*Filer)
+
+// WithMaxEntrySize is an option that sets the largest entry segments created
+// or recovered by the Filer will accept. Entries larger than MaxFrameSize are
+// split across continuation frames. If size is larger than MaxFrameSize new
+// segments are written with a format version that older versions of this
+// package can't read. The default is DefaultMaxEntrySize.
+func WithMaxEntrySize(size int) filerOpt {
+	return func(f *Filer) {
+		f.maxEntrySize = size
+	}
+}
+
+// WithMmap is an option that makes the Filer open sealed segments memory
+// mapped read-only when the VFS implements types.FileMapper. Reads are then
+// copied straight from the mapping instead of needing several system calls per
+// entry. If the VFS can't map files, for example on wasm, segments are read
+// normally.
+func WithMmap() filerOpt {
+	return func(f *Filer) {
+		f.mmap = true
+	}
+}
+
+// WithIndexCache is an option that keeps the index blocks of sealed segments in
+// memory once they're first read, so reading an entry from a sealed segment
+// only needs a single read for the entry itself. The least recently used index
+// blocks are dropped once they take up more than budget bytes in total. Each
+// entry takes 4 bytes of index, or 8 in segments larger than 2GiB. Segments
+// whose index block is bigger than budget read their index an entry at a time
+// as if the cache was disabled.
+func WithIndexCache(budget uint64) filerOpt {
+	return func(f *Filer) {
+		f.indexCache = newIndexCache(budget)
+	}
+}
+
+// WithCheckpointInterval is an option that sets how many entries are appended
+// to the tail segment between index checkpoints, which let recovery skip
+// scanning most of the tail. Checkpoints are written to a side file next to
+// the segment which is removed once it's sealed. Zero disables them. The
+// default is DefaultCheckpointInterval.
+func WithCheckpointInterval(entries int) filerOpt {
+	return func(f *Filer) {
+		f.checkpointInterval = entries
+	}
 }
 
 // NewFiler creates a Filer ready for use.
-func NewFiler(dir string, vfs types.VFS) *Filer {
-	return &Filer{
-		dir: dir,
-		vfs: vfs,
+func NewFiler(dir string, vfs types.VFS, opts ...filerOpt) *Filer {
+	f := &Filer{
+		dir:          dir,
+		vfs:          vfs,
+		maxEntrySize: DefaultMaxEntrySize,
+		maxFrameSize: MaxFrameSize,
+
+		checkpointInterval: DefaultCheckpointInterval,
 	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
 }
 
 // FileName returns the formatted file name expected for this segment.
@@ -47,12 +122,25 @@ func (f *Filer) Create(info types.SegmentInfo) (types.SegmentWriter, error) {
 	}
 	fname := FileName(info)
 
-	wf, err := f.vfs.Create(f.dir, fname, uint64(info.SizeLimit))
+	var wf types.WritableFile
+	var err error
+	if f.takeSpare(fname, info.SizeLimit) {
+		wf, err = f.vfs.OpenWriter(f.dir, fname)
+	} else {
+		wf, err = f.vfs.Create(f.dir, fname, uint64(info.SizeLimit))
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return createFile(info, wf)
+	w, err := createFile(info, wf, f.maxEntrySize, f.maxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	if f.checkpointInterval > 0 {
+		w.ckpt = &checkpointer{vfs: f.vfs, dir: f.dir, info: info, interval: f.checkpointInterval}
+	}
+	return w, nil
 }
 
 // RecoverTail is called on an unsealed segment when re-opening the WAL it will
@@ -68,19 +156,61 @@ func (f *Filer) RecoverTail(info types.SegmentInfo) (types.SegmentWriter, error)
 		return nil, err
 	}
 
-	return recoverFile(info, wf)
+	if f.checkpointInterval == 0 {
+		// Don't leave an old checkpoint behind to be picked up later.
+		deleteCheckpoint(f.vfs, f.dir, info)
+		return recoverFile(info, wf, f.maxEntrySize, f.maxFrameSize, nil)
+	}
+
+	ckpt, ck := openCheckpointer(f.vfs, f.dir, info, f.checkpointInterval)
+	w, err := recoverFile(info, wf, f.maxEntrySize, f.maxFrameSize, ck)
+	if err != nil {
+		ckpt.close()
+		return nil, err
+	}
+	w.ckpt = ckpt
+	if ck != nil && !hasPrefix(w.getOffsets(), ck.offsets) {
+		// Recovery didn't trust the checkpoint so start a new one.
+		ckpt.remove()
+		ckpt.count = 0
+	}
+	// Removes the checkpoint if the tail turned out to be sealed.
+	w.checkpoint()
+	return w, nil
 }
 
 // Open an already sealed segment for reading. Open may validate the file's
 // header and return an error if it doesn't match the expected info.
 func (f *Filer) Open(info types.SegmentInfo) (types.SegmentReader, error) {
-	fname := FileName(info)
-
-	rf, err := f.vfs.OpenReader(f.dir, fname)
+	rf, err := f.openReadable(FileName(info))
+	if err != nil {
+		return nil, err
+	}
+	r, err := openSealed(info, rf)
 	if err != nil {
+		rf.Close()
 		return nil, err
 	}
+	// Index blocks too big for the cache are read an entry at a time instead,
+	// rather than the whole block on every lookup.
+	if f.indexCache != nil && info.IndexStart != 0 && f.indexCache.fits(r.indexBlockSize()) {
+		r.cache = f.indexCache
+	}
+	return r, nil
+}
+
+// openReadable opens the named segment file for reading, memory mapped if
+// that's enabled and supported by the VFS.
+func (f *Filer) openReadable(fname string) (types.ReadableFile, error) {
+	if f.mmap {
+		if fm, ok := f.vfs.(types.FileMapper); ok {
+			return fm.OpenMapped(f.dir, fname)
+		}
+	}
+	return f.vfs.OpenReader(f.dir, fname)
+}
 
+func openSealed(info types.SegmentInfo, rf types.ReadableFile) (*Reader, error) {
 	// Validate header here since openReader is re-used by writer where it's valid
 	// for the file header not to be committed yet after a crash so we can't check
 	// it there.
@@ -97,7 +227,7 @@ func (f *Filer) Open(info types.SegmentInfo) (types.SegmentReader, error) {
 		return nil, err
 	}
 
-	gotInfo, err := readFileHeader(hdr[:])
+	gotInfo, vsn, err := readFileHeader(hdr[:])
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +236,17 @@ func (f *Filer) Open(info types.SegmentInfo) (types.SegmentReader, error) {
 		return nil, err
 	}
 
-	return openReader(info, rf)
+	r, err := openReader(info, rf, vsn)
+	if err != nil {
+		return nil, err
+	}
+	if info.IndexStart == 0 {
+		// TruncateBack seals segments without writing an index block.
+		if err := r.loadIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
 }
 
 // List returns the set of segment IDs currently stored. It's used by the WAL
@@ -154,8 +294,122 @@ func (f *Filer) listInternal() (map[uint64]uint64, []uint64, error) {
 // This interface allows a  simpler implementation where we can just delete
 // the file if it exists without having to scan the underlying storage for a.
 func (f *Filer) Delete(baseIndex uint64, ID uint64) error {
-	fname := fmt.Sprintf(segmentFileNamePattern, baseIndex, ID)
-	return f.vfs.Delete(f.dir, fname)
+	info := types.SegmentInfo{BaseIndex: baseIndex, ID: ID}
+	// Delete the tail's checkpoint first so it can't be left behind without
+	// its segment.
+	if err := deleteCheckpoint(f.vfs, f.dir, info); err != nil {
+		return err
+	}
+	if f.indexCache != nil {
+		f.indexCache.remove(ID)
+	}
+	return f.vfs.Delete(f.dir, FileName(info))
+}
+
+// FreeSpace returns the number of bytes available for new segment data in the
+// Filer's directory. It returns an error if the VFS doesn't implement
+// types.FreeSpaceReporter.
+func (f *Filer) FreeSpace() (uint64, error) {
+	fsr, ok := f.vfs.(types.FreeSpaceReporter)
+	if !ok {
+		return 0, fmt.Errorf("VFS %T can't report free space", f.vfs)
+	}
+	return fsr.FreeSpace(f.dir)
+}
+
+// Rewrite copies the entries from MinIndex to MaxIndex of the sealed segment
+// described by from into a new sealed segment file described by to, which must
+// have from.MinIndex as its BaseIndex. It's used to reclaim the space taken up
+// by entries truncated from the front of a segment. It returns to with the
+// IndexStart and Size of the new segment set. See Merge for details.
+func (f *Filer) Rewrite(from, to types.SegmentInfo) (types.SegmentInfo, error) {
+	return f.Merge([]types.SegmentInfo{from}, to)
+}
+
+// Merge copies the entries from MinIndex to MaxIndex of each of the adjacent
+// sealed segments described by from, in order, including segments sealed by
+// TruncateBack without an index block, into a single new sealed
+// segment file described by to, which must have from[0].MinIndex as its
+// BaseIndex. It returns to with the IndexStart and Size of the new segment
+// set. The new file is fully synced before Merge returns but it's up to the
+// caller to commit it to the meta data and delete the old segments. If an
+// error is returned the new file has been deleted again.
+func (f *Filer) Merge(from []types.SegmentInfo, to types.SegmentInfo) (types.SegmentInfo, error) {
+	if len(from) == 0 {
+		return to, fmt.Errorf("no segments to merge")
+	}
+	for i, info := range from {
+		if info.IndexStart == 0 && info.SealTime.IsZero() {
+			return to, fmt.Errorf("can't rewrite unsealed segment %d", info.ID)
+		}
+		if info.MaxIndex < info.MinIndex {
+			return to, fmt.Errorf("can't rewrite segment %d with no entries", info.ID)
+		}
+		if i > 0 && info.MinIndex != from[i-1].MaxIndex+1 {
+			return to, fmt.Errorf("segment %d doesn't follow on from segment %d", info.ID, from[i-1].ID)
+		}
+	}
+	if to.BaseIndex != from[0].MinIndex {
+		return to, fmt.Errorf("rewritten segment must start at %d, got BaseIndex=%d", from[0].MinIndex, to.BaseIndex)
+	}
+
+	readers := make([]*Reader, 0, len(from))
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+	for _, info := range from {
+		sr, err := f.Open(info)
+		if err != nil {
+			return to, err
+		}
+		readers = append(readers, sr.(*Reader))
+	}
+
+	wf, err := f.vfs.Create(f.dir, FileName(to), 0)
+	if err != nil {
+		return to, err
+	}
+	merged, err := f.merge(readers, to, wf)
+	if closeErr := wf.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't leave a partial copy behind. It would be deleted as an orphan on
+		// the next Open anyway.
+		f.vfs.Delete(f.dir, FileName(to))
+		return to, err
+	}
+	return merged, nil
+}
+
+func (f *Filer) merge(readers []*Reader, to types.SegmentInfo, wf types.WritableFile) (types.SegmentInfo, error) {
+	w, err := newWriter(to, wf, f.maxEntrySize, f.maxFrameSize)
+	if err != nil {
+		return to, err
+	}
+	// Keep any format features the old segments used, their entries might need
+	// continuation frames even if the Filer's max entry size was lowered since.
+	for _, r := range readers {
+		if r.vsn > w.vsn {
+			w.vsn = r.vsn
+		}
+	}
+	if err := w.initEmpty(); err != nil {
+		return to, err
+	}
+	for _, r := range readers {
+		if err := w.copyFrom(r, r.info.MinIndex, r.info.MaxIndex); err != nil {
+			return to, err
+		}
+	}
+	to.IndexStart, err = w.seal()
+	if err != nil {
+		return to, err
+	}
+	to.Size = w.Size()
+	return to, nil
 }
 
 // DumpSegment attempts to read the segment file specified by the baseIndex and
@@ -178,40 +432,33 @@ func (f *Filer) DumpSegment(baseIndex uint64, ID uint64, after, before uint64, f
 		return err
 	}
 
-	buf := make([]byte, 64*1024)
+	// Reuse the Reader's frame decoding so entries split across continuation
+	// frames are reassembled. It never reads the index so the version doesn't
+	// matter.
+	r, err := openReader(types.SegmentInfo{BaseIndex: baseIndex, ID: ID}, rf, version)
+	if err != nil {
+		return err
+	}
+	le := types.LogEntry{Data: make([]byte, 0, minBufSize)}
 	idx := baseIndex
 
 	type frameInfo struct {
 		Index  uint64
 		Offset int64
-		Len    uint32
 	}
 	var batch []frameInfo
 
-	_, err = readThroughSegment(rf, func(info types.SegmentInfo, fh frameHeader, offset int64) (bool, error) {
+	_, _, err = readThroughSegment(rf, func(info types.SegmentInfo, fh frameHeader, offset int64) (bool, error) {
 		if fh.typ == FrameCommit {
 			// All the previous entries have been committed. Read them and send up to
 			// caller.
 			for _, frame := range batch {
-				// Check the header is reasonable
-				if frame.Len > MaxEntrySize {
-					return false, fmt.Errorf("failed to read entry idx=%d, frame header length (%d) is too big: %w",
-						frame.Index, frame.Len, err)
-				}
-
-				if frame.Len > uint32(len(buf)) {
-					buf = make([]byte, frame.Len)
-				}
-
-				n, err := rf.ReadAt(buf[:frame.Len], frame.Offset+frameHeaderLen)
-				if err != nil {
-					return false, err
-				}
-				if uint32(n) < frame.Len {
-					return false, io.ErrUnexpectedEOF
+				if _, err := r.readFrame(uint64(frame.Offset), &le); err != nil {
+					return false, fmt.Errorf("failed to read entry idx=%d: %w", frame.Index, err)
 				}
+				le.Index = frame.Index
 
-				ok, err := fn(info, types.LogEntry{Index: frame.Index, Data: buf[:n]})
+				ok, err := fn(info, le)
 				if !ok || err != nil {
 					return ok, err
 				}
@@ -235,7 +482,7 @@ func (f *Filer) DumpSegment(baseIndex uint64, ID uint64, after, before uint64, f
 			return false, nil
 		}
 
-		batch = append(batch, frameInfo{idx, offset, fh.len})
+		batch = append(batch, frameInfo{idx, offset})
 		idx++
 		return true, nil
 	})
@@ -9,7 +9,10 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/polarsignals/wal/conformance"
+	"github.com/polarsignals/wal/fs"
 	"github.com/polarsignals/wal/types"
 	"github.com/stretchr/testify/require"
 )
@@ -104,6 +107,7 @@ func TestRecovery(t *testing.T) {
 		wantErr            string
 		wantLastIndex      uint64
 		wantSealed         bool
+		wantDiscard        types.DiscardReason
 	}{
 		{
 			name:               "recover empty",
@@ -144,6 +148,7 @@ func TestRecovery(t *testing.T) {
 			},
 			// should recover back to before the append
 			wantLastIndex: 10,
+			wantDiscard:   types.DiscardTornCommit,
 		},
 		{
 			name:               "partial initial commit",
@@ -156,6 +161,7 @@ func TestRecovery(t *testing.T) {
 			},
 			// should recover back to before the append
 			wantLastIndex: 0,
+			wantDiscard:   types.DiscardCRCMismatch,
 		},
 		{
 			name:               "torn write with some data in middle of commit missing",
@@ -169,6 +175,7 @@ func TestRecovery(t *testing.T) {
 			},
 			// should recover back to before the append
 			wantLastIndex: 10,
+			wantDiscard:   types.DiscardCRCMismatch,
 		},
 		{
 			name:               "torn write with header in commit corrupt",
@@ -183,6 +190,7 @@ func TestRecovery(t *testing.T) {
 			},
 			// should recover back to before the append
 			wantLastIndex: 10,
+			wantDiscard:   types.DiscardTornCommit,
 		},
 		{
 			name: "bad segment header, valid commit",
@@ -223,6 +231,7 @@ func TestRecovery(t *testing.T) {
 				return err
 			},
 			wantLastIndex: 0, // Should recover as an empty segment
+			wantDiscard:   types.DiscardCRCMismatch,
 		},
 		{
 			name: "bad segment header BaseIndex, valid commit",
@@ -237,6 +246,7 @@ func TestRecovery(t *testing.T) {
 				return err
 			},
 			wantLastIndex: 0, // Should recover as an empty segment
+			wantDiscard:   types.DiscardCRCMismatch,
 		},
 		{
 			name:               "sealed tail",
@@ -275,6 +285,23 @@ func TestRecovery(t *testing.T) {
 			// Recovery should succeed without error just with an empty WAL
 			wantLastIndex: 0,
 		},
+		{
+			name:               "header for another segment, nothing committed",
+			numPreviousEntries: 0,
+			appendEntrySizes:   []int{},
+			corrupt: func(twf *testWritableFile) error {
+				// Simulate a header that was written without its commit frame
+				// for a different segment.
+				hdr := make([]byte, fileHeaderLen)
+				if err := writeFileHeader(hdr, testSegment(123), version); err != nil {
+					return err
+				}
+				_, err := twf.WriteAt(hdr, 0)
+				return err
+			},
+			wantLastIndex: 0,
+			wantDiscard:   types.DiscardHeaderMismatch,
+		},
 	}
 
 	for _, tc := range cases {
@@ -335,6 +362,12 @@ func TestRecovery(t *testing.T) {
 
 			require.Equal(t, int(tc.wantLastIndex), int(w.LastIndex()))
 
+			rec := w.(types.TailRecoveryReporter).Recovery()
+			require.Equal(t, tc.wantDiscard, rec.Reason)
+			if tc.wantDiscard != "" {
+				require.Greater(t, rec.DiscardEnd, rec.DiscardStart)
+			}
+
 			sealed, indexStart, err := w.Sealed()
 			require.NoError(t, err)
 
@@ -522,6 +555,59 @@ func testSegment(baseIndex uint64) types.SegmentInfo {
 	}
 }
 
+func TestRewrite(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	from := testSegment(1)
+	w, err := f.Create(from)
+	require.NoError(t, err)
+
+	idx := uint64(1)
+	for {
+		val := fmt.Sprintf("%05d. Some Value.", idx)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Data: []byte(val)}}))
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			from.IndexStart = indexStart
+			from.MaxIndex = idx
+			break
+		}
+		idx++
+	}
+	require.NoError(t, w.Close())
+
+	// Truncate the front then copy what's left.
+	from.MinIndex = 50
+	to := testSegment(50)
+	_, err = f.Rewrite(from, testSegment(40))
+	require.ErrorContains(t, err, "must start at 50")
+
+	to, err = f.Rewrite(from, to)
+	require.NoError(t, err)
+	require.NotZero(t, to.IndexStart)
+	require.Greater(t, to.Size, to.IndexStart)
+	to.MaxIndex = from.MaxIndex
+
+	r, err := f.Open(to)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var le types.LogEntry
+	require.ErrorIs(t, r.GetLog(49, &le), types.ErrNotFound)
+	for i := uint64(50); i <= from.MaxIndex; i++ {
+		require.NoError(t, r.GetLog(i, &le))
+		require.Equal(t, fmt.Sprintf("%05d. Some Value.", i), string(le.Data))
+	}
+
+	// The copy only holds the remaining entries.
+	oldFile := vfs.files[FileName(from)]
+	newFile := vfs.files[FileName(to)]
+	require.Less(t, newFile.maxWritten, int(from.IndexStart))
+	require.Greater(t, oldFile.maxWritten, newFile.maxWritten)
+}
+
 func TestDumpSegment(t *testing.T) {
 	vfs := newTestVFS()
 
@@ -699,3 +785,119 @@ func TestDumpLogs(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int(250-150-1), totalDumped)
 }
+
+func TestFilerConformance(t *testing.T) {
+	conformance.TestSegmentFiler(t, func(t *testing.T) types.SegmentFiler {
+		vfs := fs.NewMemFS()
+		vfs.Mkdir("/wal")
+		return NewFiler("/wal", vfs)
+	})
+}
+
+func TestOpenSealedWithoutIndex(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+
+	// TruncateBack seals the tail where it is without writing an index block.
+	info := testSegment(1)
+	w, err := f.Create(info)
+	require.NoError(t, err)
+	for i := uint64(1); i <= 20; i++ {
+		val := fmt.Sprintf("%05d. Some Value.", i)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: i, Data: []byte(val)}}))
+	}
+	require.NoError(t, w.Close())
+	info.MaxIndex = 15
+	info.SealTime = time.Now()
+
+	r, err := f.Open(info)
+	require.NoError(t, err)
+	defer r.Close()
+
+	var le types.LogEntry
+	for i := uint64(1); i <= 15; i++ {
+		require.NoError(t, r.GetLog(i, &le))
+		require.Equal(t, fmt.Sprintf("%05d. Some Value.", i), string(le.Data))
+	}
+	require.ErrorIs(t, r.GetLog(16, &le), types.ErrNotFound)
+
+	// It can be merged into a properly sealed segment.
+	to := testSegment(1)
+	to.ID = 2
+	to, err = f.Merge([]types.SegmentInfo{info}, to)
+	require.NoError(t, err)
+	require.NotZero(t, to.IndexStart)
+	require.Greater(t, to.Size, to.IndexStart)
+}
+
+func TestIndexCacheReads(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithIndexCache(1024))
+
+	info := testSegment(1)
+	w, err := f.Create(info)
+	require.NoError(t, err)
+	for idx := uint64(1); ; idx++ {
+		val := fmt.Sprintf("%05d. Some Value.", idx)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: idx, Data: []byte(val)}}))
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			info.IndexStart = indexStart
+			info.MaxIndex = idx
+			break
+		}
+	}
+	require.NoError(t, w.Close())
+
+	r, err := f.Open(info)
+	require.NoError(t, err)
+
+	var le types.LogEntry
+	require.NoError(t, r.GetLog(1, &le))
+	_, ok := f.indexCache.get(info.ID)
+	require.True(t, ok)
+
+	// Clobber the index on disk, reads must come from the cached copy.
+	file := vfs.files[FileName(info)]
+	zeros := make([]byte, (info.MaxIndex-info.BaseIndex+1)*4)
+	_, err = file.WriteAt(zeros, int64(info.IndexStart))
+	require.NoError(t, err)
+
+	for i := info.BaseIndex; i <= info.MaxIndex; i++ {
+		require.NoError(t, r.GetLog(i, &le))
+		require.Equal(t, fmt.Sprintf("%05d. Some Value.", i), string(le.Data))
+	}
+	require.ErrorIs(t, r.GetLog(info.MaxIndex+1, &le), types.ErrNotFound)
+
+	// Closing a reader keeps the index for other readers of the segment,
+	// deleting the segment drops it.
+	require.NoError(t, r.Close())
+	_, ok = f.indexCache.get(info.ID)
+	require.True(t, ok)
+	require.NoError(t, f.Delete(info.BaseIndex, info.ID))
+	_, ok = f.indexCache.get(info.ID)
+	require.False(t, ok)
+
+	// A segment whose index block is bigger than the whole budget doesn't use
+	// the cache at all, lookups read just the entry they need.
+	small := NewFiler("test", vfs, WithIndexCache(8))
+	info = testSegment(1)
+	w, err = small.Create(info)
+	require.NoError(t, err)
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Data: []byte("one")}, {Index: 2, Data: []byte("two")}, {Index: 3, Data: []byte("three")}}))
+	require.NoError(t, w.Close())
+	sr, err := small.RecoverTail(info)
+	require.NoError(t, err)
+	info.IndexStart, err = sr.(*Writer).seal()
+	require.NoError(t, err)
+	info.MaxIndex = 3
+	require.NoError(t, sr.Close())
+
+	r, err = small.Open(info)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Nil(t, r.(*Reader).cache)
+	require.NoError(t, r.GetLog(3, &le))
+	require.Equal(t, "three", string(le.Data))
+}
@@ -6,20 +6,31 @@ package segment
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
+	"math"
 
 	"github.com/polarsignals/wal/types"
 )
 
 const (
-	// MaxEntrySize is the largest we allow any single raft log entry to be. This
-	// is larger than our raft implementation ever allows so seems safe to encode
-	// statically for now. We could make this configurable. It's main purpose it
-	// to limit allocation when reading entries back if their lengths are
+	// MaxFrameSize is the largest payload a single frame may have. Entries
+	// larger than this are split across continuation frames, which is only
+	// possible in segments created with a max entry size larger than this. It
+	// also limits allocation when reading frames back if their lengths are
 	// corrupted.
-	MaxEntrySize = 64 * 1024 * 1024 // 64 MiB
+	MaxFrameSize = 64 * 1024 * 1024 // 64 MiB
+
+	// DefaultMaxEntrySize is the largest entry allowed unless configured
+	// otherwise with WithMaxEntrySize. It's the same as MaxFrameSize so that by
+	// default segments never contain continuation frames and remain readable by
+	// older versions.
+	DefaultMaxEntrySize = MaxFrameSize
+
+	// MaxEntrySize is the default max entry size.
+	//
+	// Deprecated: use DefaultMaxEntrySize or WithMaxEntrySize.
+	MaxEntrySize = DefaultMaxEntrySize
 
 	// minBufSize is the size we allocate read and write buffers. Setting it
 	// larger wastes more memory but increases the chances that we'll read the
@@ -27,13 +38,39 @@ const (
 	// the disk.
 	minBufSize = 64 * 1024
 
+	// scanBufSize is the size of the reads used when scanning through the
+	// frames of a segment, for example while recovering the tail.
+	scanBufSize = 1024 * 1024
+
 	fileHeaderLen = 32
-	version       = 0
 	magic         = 0x58eb6b0d
 
+	// version is the format version of segments that never contain
+	// continuation frames. versionContinuations marks segments that may, so
+	// that versions that don't understand them refuse to read the file rather
+	// than misinterpret it. versionWideOffsets segments may also contain
+	// continuation frames and their index stores 64-bit offsets. Each segment
+	// uses the lowest version that supports what it needs.
+	version              = 0
+	versionContinuations = 1
+	versionWideOffsets   = 2
+
+	// maxNarrowSegmentSize is the largest SizeLimit for which segments are
+	// written with 32-bit offsets. It's well under 4GiB so that the final batch
+	// which takes a segment past its limit can't overflow them.
+	maxNarrowSegmentSize = 1 << 31
+
+	// maxIndexLen is the largest index array we write. Segments are sealed
+	// early rather than let the index frame's length overflow.
+	maxIndexLen = math.MaxUint32 / 2
+
 	// Note that this must remain a power of 2 to ensure aligning to this also
 	// aligns to sector boundaries.
 	frameHeaderLen = 8
+
+	// frameFlagMore is set on entry and continuation frames that are followed
+	// by another continuation frame of the same entry.
+	frameFlagMore = 1 << 0
 )
 
 const ( // Start iota from 0
@@ -41,12 +78,13 @@ const ( // Start iota from 0
 	FrameEntry
 	FrameIndex
 	FrameCommit
+	FrameContinuation
 )
 
 var (
 	// ErrTooBig indicates that the caller tried to write a logEntry with a
-	// payload that's larger than we are prepared to support.
-	ErrTooBig = errors.New("entries larger than 64MiB are not supported")
+	// payload that's larger than the max entry size.
+	ErrTooBig = types.ErrTooBig
 )
 
 /*
@@ -66,8 +104,9 @@ var (
 
 */
 
-// writeFileHeader writes a file header into buf for the given file metadata.
-func writeFileHeader(buf []byte, info types.SegmentInfo) error {
+// writeFileHeader writes a file header into buf for the given file metadata
+// and format version.
+func writeFileHeader(buf []byte, info types.SegmentInfo, vsn uint8) error {
 	if len(buf) < fileHeaderLen {
 		return io.ErrShortBuffer
 	}
@@ -77,7 +116,7 @@ func writeFileHeader(buf []byte, info types.SegmentInfo) error {
 	buf[4] = 0
 	buf[5] = 0
 	buf[6] = 0
-	buf[7] = version
+	buf[7] = vsn
 	binary.LittleEndian.PutUint64(buf[8:16], info.BaseIndex)
 	binary.LittleEndian.PutUint64(buf[16:24], info.ID)
 	// I removed the codec option from this library since we let the caller
@@ -87,23 +126,28 @@ func writeFileHeader(buf []byte, info types.SegmentInfo) error {
 	return nil
 }
 
-// readFileHeader reads a file header from buf.
-func readFileHeader(buf []byte) (*types.SegmentInfo, error) {
+// readFileHeader reads a file header from buf returning the segment info and
+// format version.
+func readFileHeader(buf []byte) (*types.SegmentInfo, uint8, error) {
 	if len(buf) < fileHeaderLen {
-		return nil, io.ErrShortBuffer
+		return nil, 0, io.ErrShortBuffer
 	}
 
 	var i types.SegmentInfo
-	m := binary.LittleEndian.Uint64(buf[0:8])
+	m := binary.LittleEndian.Uint32(buf[0:4])
 	if m != magic {
-		return nil, types.ErrCorrupt
+		return nil, 0, types.ErrCorrupt
 	}
-	if buf[7] != version {
-		return nil, types.ErrCorrupt
+	if buf[4] != 0 || buf[5] != 0 || buf[6] != 0 {
+		return nil, 0, types.ErrCorrupt
+	}
+	vsn := buf[7]
+	if vsn > versionWideOffsets {
+		return nil, 0, types.ErrCorrupt
 	}
 	i.BaseIndex = binary.LittleEndian.Uint64(buf[8:16])
 	i.ID = binary.LittleEndian.Uint64(buf[16:24])
-	return &i, nil
+	return &i, vsn, nil
 }
 
 func validateFileHeader(got, expect types.SegmentInfo) error {
@@ -124,14 +168,24 @@ func validateFileHeader(got, expect types.SegmentInfo) error {
 
 	0      1      2      3      4      5      6      7      8
 	+------+------+------+------+------+------+------+------+
-	| Type | Reserved           | Length/CRC                |
+	| Type | Flags| Reserved    | Length/CRC                |
 	+------+------+------+------+------+------+------+------+
+
+	Flags is only used by entry and continuation frames. An entry larger than
+	MaxFrameSize is written as an entry frame with frameFlagMore set followed
+	by continuation frames, all but the last of which also have it set. The
+	entry's data is the concatenation of all their payloads.
 */
 
 type frameHeader struct {
-	typ uint8
-	len uint32
-	crc uint32
+	typ   uint8
+	flags uint8
+	len   uint32
+	crc   uint32
+}
+
+func (h frameHeader) more() bool {
+	return h.flags&frameFlagMore != 0
 }
 
 func writeFrame(buf []byte, h frameHeader, payload []byte) error {
@@ -155,7 +209,7 @@ func writeFrameHeader(buf []byte, h frameHeader) error {
 		return io.ErrShortBuffer
 	}
 	buf[0] = h.typ
-	buf[1] = 0
+	buf[1] = h.flags
 	buf[2] = 0
 	buf[3] = 0
 	lOrCRC := h.len
@@ -187,7 +241,15 @@ func readFrameHeader(buf []byte) (frameHeader, error) {
 		}
 		return h, fmt.Errorf("%w: corrupt frame header with type 0 but non-zero other fields", types.ErrCorrupt)
 
-	case FrameEntry, FrameIndex:
+	case FrameEntry, FrameContinuation:
+		h.typ = buf[0]
+		h.flags = buf[1]
+		if h.flags&^frameFlagMore != 0 {
+			return h, fmt.Errorf("%w: corrupt frame header with unknown flags %x", types.ErrCorrupt, h.flags)
+		}
+		h.len = binary.LittleEndian.Uint32(buf[4:8])
+
+	case FrameIndex:
 		h.typ = buf[0]
 		h.len = binary.LittleEndian.Uint32(buf[4:8])
 
@@ -217,32 +279,46 @@ func encodedFrameSize(payloadLen int) int {
 	return frameHeaderLen + payloadLen + padLen(payloadLen)
 }
 
-func indexFrameSize(numEntries int) int {
+// indexEntrySize returns the size of each offset in the index array of a
+// segment with format version vsn.
+func indexEntrySize(vsn uint8) int {
+	if vsn >= versionWideOffsets {
+		return 8
+	}
+	return 4
+}
+
+func indexFrameSize(numEntries int, vsn uint8) int {
 	// Index frames are completely unnecessary if the whole block is a
 	// continuation with no new entries.
 	if numEntries == 0 {
 		return 0
 	}
-	return encodedFrameSize(numEntries * 4)
+	return encodedFrameSize(numEntries * indexEntrySize(vsn))
 }
 
-func writeIndexFrame(buf []byte, offsets []uint32) error {
-	if len(buf) < indexFrameSize(len(offsets)) {
+func writeIndexFrame(buf []byte, offsets []uint64, vsn uint8) error {
+	if len(buf) < indexFrameSize(len(offsets), vsn) {
 		return io.ErrShortBuffer
 	}
+	entrySize := indexEntrySize(vsn)
 	fh := frameHeader{
 		typ: FrameIndex,
-		len: uint32(len(offsets) * 4),
+		len: uint32(len(offsets) * entrySize),
 	}
 	if err := writeFrameHeader(buf, fh); err != nil {
 		return err
 	}
 	cursor := frameHeaderLen
 	for _, o := range offsets {
-		binary.LittleEndian.PutUint32(buf[cursor:], o)
-		cursor += 4
+		if entrySize == 8 {
+			binary.LittleEndian.PutUint64(buf[cursor:], o)
+		} else {
+			binary.LittleEndian.PutUint32(buf[cursor:], uint32(o))
+		}
+		cursor += entrySize
 	}
-	if (len(offsets) % 2) == 1 {
+	if entrySize == 4 && (len(offsets)%2) == 1 {
 		// Odd number of entries, zero pad to keep it 8-byte aligned
 		binary.LittleEndian.PutUint32(buf[cursor:], 0)
 	}
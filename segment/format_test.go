@@ -18,6 +18,7 @@ func TestFileHeaderCodec(t *testing.T) {
 	cases := []struct {
 		name            string
 		info            types.SegmentInfo
+		vsn             uint8
 		bufSize         int
 		corrupt         func([]byte) []byte
 		wantWriteErr    string
@@ -31,6 +32,34 @@ func TestFileHeaderCodec(t *testing.T) {
 				ID:        4321,
 			},
 		},
+		{
+			name: "continuations version",
+			info: types.SegmentInfo{
+				BaseIndex: 1234,
+				ID:        4321,
+			},
+			vsn: versionContinuations,
+		},
+		{
+			name: "wide offsets version",
+			info: types.SegmentInfo{
+				BaseIndex: 1234,
+				ID:        4321,
+			},
+			vsn: versionWideOffsets,
+		},
+		{
+			name: "unknown version reading",
+			info: types.SegmentInfo{
+				BaseIndex: 1234,
+				ID:        4321,
+			},
+			corrupt: func(buf []byte) []byte {
+				buf[7] = versionWideOffsets + 1
+				return buf
+			},
+			wantReadErr: "corrupt",
+		},
 		{
 			name: "short buf writing",
 			info: types.SegmentInfo{
@@ -98,7 +127,7 @@ func TestFileHeaderCodec(t *testing.T) {
 			}
 			buf := make([]byte, length)
 
-			err := writeFileHeader(buf, tc.info)
+			err := writeFileHeader(buf, tc.info, tc.vsn)
 
 			if tc.wantWriteErr != "" {
 				require.ErrorContains(t, err, tc.wantWriteErr)
@@ -110,13 +139,14 @@ func TestFileHeaderCodec(t *testing.T) {
 				buf = tc.corrupt(buf)
 			}
 
-			got, err := readFileHeader(buf)
+			got, vsn, err := readFileHeader(buf)
 			if tc.wantReadErr != "" {
 				require.ErrorContains(t, err, tc.wantReadErr)
 				return
 			}
 			require.NoError(t, err)
 			require.NotNil(t, got)
+			require.Equal(t, tc.vsn, vsn)
 
 			err = validateFileHeader(*got, tc.info)
 			if tc.wantValidateErr != "" {
@@ -135,12 +165,12 @@ func TestFileHeaderCodecFuzz(t *testing.T) {
 	var buf [fileHeaderLen]byte
 	for i := 0; i < 1000; i++ {
 		fzz.Fuzz(&info)
-		err := writeFileHeader(buf[:], info)
+		err := writeFileHeader(buf[:], info, version)
 		require.NoError(t, err)
 
 		t.Logf("% x", buf[:])
 
-		got, err := readFileHeader(buf[:])
+		got, _, err := readFileHeader(buf[:])
 		require.NoError(t, err)
 		require.NotNil(t, got)
 
@@ -162,6 +192,13 @@ func TestFrameCodecFuzz(t *testing.T) {
 		fzz.Fuzz(&length)
 
 		fh.typ = FrameEntry
+		fh.flags = 0
+		if length%3 == 0 {
+			fh.typ = FrameContinuation
+		}
+		if length%2 == 0 {
+			fh.flags = frameFlagMore
+		}
 		fh.len = uint32(length)
 
 		expectLen := encodedFrameSize(int(length))
@@ -191,6 +228,14 @@ func TestFrameCodecFuzz(t *testing.T) {
 	}
 }
 
+func TestFrameHeaderUnknownFlags(t *testing.T) {
+	var buf [frameHeaderLen]byte
+	require.NoError(t, writeFrameHeader(buf[:], frameHeader{typ: FrameEntry, len: 10}))
+	buf[1] = 0x2
+	_, err := readFrameHeader(buf[:])
+	require.ErrorIs(t, err, types.ErrCorrupt)
+}
+
 func TestPadLen(t *testing.T) {
 	fzz := fuzz.New()
 	var length uint32
@@ -212,16 +257,16 @@ func TestPadLen(t *testing.T) {
 func TestWriteIndexFrame(t *testing.T) {
 	// TestFrameCodecFuzz covers most of the bases for the actual header encoding
 	// etc. This just needs to test the index encoding.
-	var index [1024]uint32
+	var index [1024]uint64
 
 	for i := range index {
 		// Write offsets as if each record is exactly 64 bytes
-		index[i] = uint32(i * 64)
+		index[i] = uint64(i * 64)
 	}
 
-	buf := make([]byte, indexFrameSize(len(index)))
+	buf := make([]byte, indexFrameSize(len(index), version))
 
-	err := writeIndexFrame(buf, index[:])
+	err := writeIndexFrame(buf, index[:], version)
 	require.NoError(t, err)
 
 	//t.Log(index, buf)
@@ -234,3 +279,24 @@ func TestWriteIndexFrame(t *testing.T) {
 		offset += 4
 	}
 }
+
+func TestWriteWideIndexFrame(t *testing.T) {
+	// Odd length to check there's no padding needed.
+	index := []uint64{0, 1 << 32, 1<<40 + 8}
+
+	buf := make([]byte, indexFrameSize(len(index), versionWideOffsets))
+	require.Len(t, buf, frameHeaderLen+len(index)*8)
+	require.NoError(t, writeIndexFrame(buf, index, versionWideOffsets))
+
+	fh, err := readFrameHeader(buf)
+	require.NoError(t, err)
+	require.Equal(t, FrameIndex, fh.typ)
+	require.Equal(t, uint32(len(index)*8), fh.len)
+
+	offset := frameHeaderLen
+	for i, want := range index {
+		got := binary.LittleEndian.Uint64(buf[offset:])
+		require.Equal(t, want, got, "unexpected index value at offset %d", i)
+		offset += 8
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"container/list"
+	"sync"
+)
+
+// indexCache holds the index blocks of sealed segments in memory so that
+// looking up an entry's offset doesn't need a read. It's shared by all the
+// readers opened by a Filer and evicts the least recently used index blocks
+// once they take up more than budget bytes.
+type indexCache struct {
+	mu     sync.Mutex
+	budget uint64
+	size   uint64
+	// lru holds *indexCacheEntry with the most recently used at the front.
+	lru   *list.List
+	items map[uint64]*list.Element
+}
+
+type indexCacheEntry struct {
+	id    uint64
+	index []byte
+}
+
+func newIndexCache(budget uint64) *indexCache {
+	return &indexCache{
+		budget: budget,
+		lru:    list.New(),
+		items:  make(map[uint64]*list.Element),
+	}
+}
+
+// get returns the cached index block of the segment with the given ID.
+func (c *indexCache) get(id uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*indexCacheEntry).index, true
+}
+
+// fits returns whether an index block of size bytes can be cached at all.
+func (c *indexCache) fits(size uint64) bool {
+	return size <= c.budget
+}
+
+// add caches the index block of the segment with the given ID, evicting others
+// until it fits in the budget. Index blocks larger than the whole budget are
+// not cached, readers check fits first.
+func (c *indexCache) add(id uint64, index []byte) {
+	size := uint64(len(index))
+	if !c.fits(size) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[id]; ok {
+		// Loaded concurrently by another reader.
+		return
+	}
+	for c.size+size > c.budget {
+		c.removeElementLocked(c.lru.Back())
+	}
+	c.items[id] = c.lru.PushFront(&indexCacheEntry{id: id, index: index})
+	c.size += size
+}
+
+// remove drops the index block of the segment with the given ID if it's
+// cached.
+func (c *indexCache) remove(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[id]; ok {
+		c.removeElementLocked(e)
+	}
+}
+
+func (c *indexCache) removeElementLocked(e *list.Element) {
+	entry := c.lru.Remove(e).(*indexCacheEntry)
+	delete(c.items, entry.id)
+	c.size -= uint64(len(entry.index))
+}
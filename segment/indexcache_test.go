@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexCache(t *testing.T) {
+	c := newIndexCache(10)
+
+	c.add(1, make([]byte, 4))
+	c.add(2, make([]byte, 4))
+	_, ok := c.get(1)
+	require.True(t, ok)
+
+	// 2 is now the least recently used so it's evicted to make room.
+	c.add(3, make([]byte, 4))
+	_, ok = c.get(2)
+	require.False(t, ok)
+	_, ok = c.get(1)
+	require.True(t, ok)
+	_, ok = c.get(3)
+	require.True(t, ok)
+	require.Equal(t, uint64(8), c.size)
+
+	// Too big to ever fit.
+	c.add(4, make([]byte, 11))
+	_, ok = c.get(4)
+	require.False(t, ok)
+
+	// Exactly the budget evicts everything else.
+	c.add(5, make([]byte, 10))
+	require.Equal(t, 1, c.lru.Len())
+	require.Equal(t, uint64(10), c.size)
+
+	c.remove(5)
+	c.remove(6)
+	require.Equal(t, 0, c.lru.Len())
+	require.Equal(t, uint64(0), c.size)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/polarsignals/wal/types"
+)
+
+// spareFileName is the name of the preallocated file Create renames into place
+// for the next segment. It doesn't have the segment suffix so List ignores it.
+const spareFileName = "next-segment.prealloc"
+
+// spareFile tracks the preallocated spare segment file. Preallocate creates it
+// in the background while Create may be consuming it on the write path.
+type spareFile struct {
+	mu sync.Mutex
+	// size is the preallocated size of the spare file, or zero if there isn't
+	// one ready. A spare left behind by a previous process is never used since
+	// we can't tell if it was completely allocated, it's replaced instead.
+	size uint64
+	// busy is set while Preallocate is creating the file or Create is moving
+	// it into place.
+	busy bool
+}
+
+// Preallocate creates and preallocates a spare file of size bytes so the next
+// Create of a segment with that SizeLimit can rename it into place rather than
+// allocating a new file on the write path. It's meant to be called in the
+// background. It's a no-op if a spare of that size is already ready or one is
+// being created. It returns an error if the VFS doesn't implement
+// types.FileMover.
+func (f *Filer) Preallocate(size uint64) error {
+	if _, ok := f.vfs.(types.FileMover); !ok {
+		return fmt.Errorf("VFS %T can't move files", f.vfs)
+	}
+	f.spare.mu.Lock()
+	if f.spare.busy || f.spare.size == size {
+		f.spare.mu.Unlock()
+		return nil
+	}
+	f.spare.busy = true
+	f.spare.size = 0
+	f.spare.mu.Unlock()
+
+	err := f.createSpare(size)
+
+	f.spare.mu.Lock()
+	f.spare.busy = false
+	if err == nil {
+		f.spare.size = size
+	}
+	f.spare.mu.Unlock()
+	return err
+}
+
+func (f *Filer) createSpare(size uint64) error {
+	// Replace any old or too small spare.
+	if err := f.vfs.Delete(f.dir, spareFileName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	wf, err := f.vfs.Create(f.dir, spareFileName, size)
+	if err != nil {
+		return err
+	}
+	return wf.Close()
+}
+
+// takeSpare renames the spare file to fname if there's one ready that's
+// exactly size bytes. It returns false if there wasn't, in which case the
+// caller should create the file itself.
+func (f *Filer) takeSpare(fname string, size uint64) bool {
+	f.spare.mu.Lock()
+	if f.spare.busy || f.spare.size == 0 || f.spare.size != size {
+		f.spare.mu.Unlock()
+		return false
+	}
+	f.spare.size = 0
+	// Stop Preallocate replacing the file while we move it.
+	f.spare.busy = true
+	f.spare.mu.Unlock()
+	defer func() {
+		f.spare.mu.Lock()
+		f.spare.busy = false
+		f.spare.mu.Unlock()
+	}()
+
+	// Preallocate already checked the VFS can move files. The move fsyncs the
+	// directory so the new name is durable before anything is committed to it.
+	if err := f.vfs.(types.FileMover).Move(f.dir, spareFileName, f.dir, fname); err != nil {
+		// Try to leave things tidy for the next Preallocate. It replaces the spare
+		// anyway if this fails.
+		f.vfs.Delete(f.dir, spareFileName)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/fs"
+	"github.com/polarsignals/wal/types"
+)
+
+func TestPreallocate(t *testing.T) {
+	vfs := fs.NewMemFS()
+	vfs.Mkdir("/wal")
+	f := NewFiler("/wal", vfs)
+
+	seg1 := testSegment(1)
+	require.NoError(t, f.Preallocate(seg1.SizeLimit))
+	files, err := vfs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{spareFileName}, files)
+
+	// The spare isn't a segment.
+	segs, err := f.List()
+	require.NoError(t, err)
+	require.Empty(t, segs)
+
+	// A segment of a different size doesn't use it.
+	seg0 := testSegment(1)
+	seg0.SizeLimit *= 2
+	w, err := f.Create(seg0)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, f.Delete(seg0.BaseIndex, seg0.ID))
+	files, err = vfs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{spareFileName}, files)
+
+	// A matching one is renamed into place.
+	w, err = f.Create(seg1)
+	require.NoError(t, err)
+	files, err = vfs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{FileName(seg1)}, files)
+
+	for i := uint64(1); i <= 10; i++ {
+		require.NoError(t, w.Append([]types.LogEntry{{Index: i, Data: []byte("preallocated")}}))
+	}
+	require.NoError(t, w.Close())
+	w, err = f.RecoverTail(seg1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), w.LastIndex())
+	require.NoError(t, w.Close())
+
+	// The spare is only used once, the next segment is created as usual.
+	seg2 := testSegment(11)
+	w, err = f.Create(seg2)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	files, err = vfs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Equal(t, []string{FileName(seg1), FileName(seg2)}, files)
+
+	// A spare left by another process is replaced rather than trusted.
+	wf, err := vfs.Create("/wal", spareFileName, 1)
+	require.NoError(t, err)
+	require.NoError(t, wf.Close())
+	f = NewFiler("/wal", vfs)
+	require.NoError(t, f.Preallocate(seg1.SizeLimit))
+	rf, err := vfs.OpenReader("/wal", spareFileName)
+	require.NoError(t, err)
+	buf := make([]byte, seg1.SizeLimit)
+	_, err = rf.ReadAt(buf, 0)
+	require.NoError(t, err)
+	require.NoError(t, rf.Close())
+
+	// The VFS has to be able to rename files.
+	require.ErrorContains(t, NewFiler("test", newTestVFS()).Preallocate(1024), "can't move files")
+}
@@ -0,0 +1,148 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/polarsignals/wal/types"
+)
+
+const (
+	// QuarantineDir is the subdirectory of the segment directory that
+	// Quarantine moves segment files into.
+	QuarantineDir = "quarantine"
+
+	// quarantineTimeFormat is the format of the timestamp prefixed to the names
+	// of quarantined files. It sorts in time order.
+	quarantineTimeFormat = "20060102T150405Z"
+)
+
+// QuarantinedFile describes a segment file in the quarantine directory.
+type QuarantinedFile struct {
+	// Name is the file's name in the quarantine directory. It's the time it
+	// was quarantined followed by the segment's original file name.
+	Name string
+
+	// Time is when the file was quarantined, to the second.
+	Time time.Time
+
+	// Segment has the ID and BaseIndex of the segment from its original file
+	// name. Nothing else is known without reading the file.
+	Segment types.SegmentInfo
+}
+
+// Quarantine moves the segment with the given baseIndex and id into the
+// quarantine directory instead of deleting it. Its index checkpoint, if any,
+// is deleted since it can be rebuilt from the segment. It returns an error if
+// the VFS doesn't implement types.FileMover.
+func (f *Filer) Quarantine(baseIndex, ID uint64) error {
+	mv, ok := f.vfs.(types.FileMover)
+	if !ok {
+		return fmt.Errorf("VFS %T can't move files", f.vfs)
+	}
+	info := types.SegmentInfo{BaseIndex: baseIndex, ID: ID}
+	if err := deleteCheckpoint(f.vfs, f.dir, info); err != nil {
+		return err
+	}
+	fname := FileName(info)
+	qname := time.Now().UTC().Format(quarantineTimeFormat) + "-" + fname
+	return mv.Move(f.dir, fname, f.quarantineDir(), qname)
+}
+
+// ListQuarantined returns the quarantined segment files, oldest first. Files
+// in the quarantine directory that weren't put there by Quarantine are
+// ignored.
+func (f *Filer) ListQuarantined() ([]QuarantinedFile, error) {
+	files, err := f.vfs.ListDir(f.quarantineDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var qfs []QuarantinedFile
+	for _, name := range files {
+		qf, ok := parseQuarantineName(name)
+		if !ok {
+			continue
+		}
+		qfs = append(qfs, qf)
+	}
+	sort.SliceStable(qfs, func(i, j int) bool {
+		return qfs[i].Time.Before(qfs[j].Time)
+	})
+	return qfs, nil
+}
+
+// RestoreQuarantined moves the named quarantined file back into the segment
+// directory under its original name. It fails if a file with that name
+// already exists. Restoring a segment doesn't add it to the WAL's metadata so
+// a WAL opened on the directory will treat it as an orphan again. It's meant
+// for inspecting or recovering its entries with tools like waldump.
+func (f *Filer) RestoreQuarantined(name string) (types.SegmentInfo, error) {
+	qf, ok := parseQuarantineName(name)
+	if !ok {
+		return types.SegmentInfo{}, fmt.Errorf("%q is not a quarantined segment file name", name)
+	}
+	mv, ok := f.vfs.(types.FileMover)
+	if !ok {
+		return types.SegmentInfo{}, fmt.Errorf("VFS %T can't move files", f.vfs)
+	}
+	if err := mv.Move(f.quarantineDir(), name, f.dir, FileName(qf.Segment)); err != nil {
+		return types.SegmentInfo{}, err
+	}
+	return qf.Segment, nil
+}
+
+// PruneQuarantined deletes quarantined files that were quarantined before the
+// given time and returns them.
+func (f *Filer) PruneQuarantined(before time.Time) ([]QuarantinedFile, error) {
+	qfs, err := f.ListQuarantined()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []QuarantinedFile
+	for _, qf := range qfs {
+		if !qf.Time.Before(before) {
+			break
+		}
+		if err := f.vfs.Delete(f.quarantineDir(), qf.Name); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, qf)
+	}
+	return pruned, nil
+}
+
+func (f *Filer) quarantineDir() string {
+	return filepath.Join(f.dir, QuarantineDir)
+}
+
+func parseQuarantineName(name string) (QuarantinedFile, bool) {
+	ts, fname, ok := strings.Cut(name, "-")
+	if !ok {
+		return QuarantinedFile{}, false
+	}
+	t, err := time.Parse(quarantineTimeFormat, ts)
+	if err != nil {
+		return QuarantinedFile{}, false
+	}
+	var bIdx, id uint64
+	if n, err := fmt.Sscanf(fname, segmentFileNamePattern, &bIdx, &id); err != nil || n != 2 {
+		return QuarantinedFile{}, false
+	}
+	info := types.SegmentInfo{BaseIndex: bIdx, ID: id}
+	if FileName(info) != fname {
+		// Don't accept anything that wouldn't round trip, such as paths.
+		return QuarantinedFile{}, false
+	}
+	return QuarantinedFile{Name: name, Time: t, Segment: info}, true
+}
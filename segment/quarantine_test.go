@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package segment
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/fs"
+	"github.com/polarsignals/wal/types"
+)
+
+func TestQuarantine(t *testing.T) {
+	vfs := fs.NewMemFS()
+	vfs.Mkdir("/wal")
+	f := NewFiler("/wal", vfs, WithCheckpointInterval(1))
+
+	// Nothing quarantined yet, and no quarantine dir.
+	qfs, err := f.ListQuarantined()
+	require.NoError(t, err)
+	require.Empty(t, qfs)
+
+	seg1 := testSegment(1)
+	seg2 := testSegment(11)
+	for _, info := range []types.SegmentInfo{seg1, seg2} {
+		w, err := f.Create(info)
+		require.NoError(t, err)
+		require.NoError(t, w.Append([]types.LogEntry{{Index: info.BaseIndex, Data: []byte("orphan")}}))
+		require.NoError(t, w.Close())
+	}
+
+	start := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, f.Quarantine(seg1.BaseIndex, seg1.ID))
+	require.NoError(t, f.Quarantine(seg2.BaseIndex, seg2.ID))
+
+	// The segments and their checkpoints are gone from the segment dir.
+	files, err := vfs.ListDir("/wal")
+	require.NoError(t, err)
+	require.Empty(t, files)
+	segs, err := f.List()
+	require.NoError(t, err)
+	require.Empty(t, segs)
+
+	// Files that weren't quarantined are ignored.
+	junk, err := vfs.Create(filepath.Join("/wal", QuarantineDir), "notes.txt", 0)
+	require.NoError(t, err)
+	require.NoError(t, junk.Close())
+
+	qfs, err = f.ListQuarantined()
+	require.NoError(t, err)
+	require.Len(t, qfs, 2)
+	got := map[uint64]QuarantinedFile{}
+	for _, qf := range qfs {
+		require.False(t, qf.Time.Before(start))
+		got[qf.Segment.ID] = qf
+	}
+	require.Equal(t, seg1.BaseIndex, got[seg1.ID].Segment.BaseIndex)
+	require.Equal(t, seg2.BaseIndex, got[seg2.ID].Segment.BaseIndex)
+
+	// Restoring puts the file back where it can be read.
+	_, err = f.RestoreQuarantined("../" + got[seg1.ID].Name)
+	require.Error(t, err)
+	info, err := f.RestoreQuarantined(got[seg1.ID].Name)
+	require.NoError(t, err)
+	require.Equal(t, seg1.ID, info.ID)
+	_, err = f.RestoreQuarantined(got[seg1.ID].Name)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	segs, err = f.List()
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]uint64{seg1.ID: seg1.BaseIndex}, segs)
+	w, err := f.RecoverTail(seg1)
+	require.NoError(t, err)
+	var le types.LogEntry
+	require.NoError(t, w.GetLog(seg1.BaseIndex, &le))
+	require.Equal(t, "orphan", string(le.Data))
+	require.NoError(t, w.Close())
+
+	// Pruning only removes files quarantined before the cutoff.
+	pruned, err := f.PruneQuarantined(start)
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+	pruned, err = f.PruneQuarantined(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	require.Equal(t, seg2.ID, pruned[0].Segment.ID)
+	qfs, err = f.ListQuarantined()
+	require.NoError(t, err)
+	require.Empty(t, qfs)
+}
@@ -17,27 +17,42 @@ type Reader struct {
 	info types.SegmentInfo
 	rf   types.ReadableFile
 
+	// vsn is the format version from the file header which determines the width
+	// of offsets in the index array.
+	vsn uint8
+
 	scratchFrameHeader []byte
 
+	// offsets holds the frame offset of each entry for sealed segments that
+	// have no index frame, which is the case when TruncateBack sealed them. It's
+	// built by reading through the file when the segment is opened.
+	offsets []uint64
+
+	// cache optionally holds the index block of this sealed segment in memory.
+	cache *indexCache
+
 	// tail optionally providers an interface to the writer state when this is an
 	// unsealed segment so we can fetch from it's in-memory index.
 	tail tailWriter
 }
 
 type tailWriter interface {
-	OffsetForFrame(idx uint64) (uint32, error)
+	OffsetForFrame(idx uint64) (uint64, error)
 }
 
-func openReader(info types.SegmentInfo, rf types.ReadableFile) (*Reader, error) {
+func openReader(info types.SegmentInfo, rf types.ReadableFile, vsn uint8) (*Reader, error) {
 	r := &Reader{
 		info: info,
 		rf:   rf,
+		vsn:  vsn,
 	}
 
 	return r, nil
 }
 
-// Close implements io.Closer
+// Close implements io.Closer. The segment's index block stays cached since
+// other readers of the segment may still be open, it's only dropped when the
+// segment is deleted.
 func (r *Reader) Close() error {
 	return r.rf.Close()
 }
@@ -56,78 +71,172 @@ func (r *Reader) GetLog(idx uint64, le *types.LogEntry) error {
 	return nil
 }
 
-func (r *Reader) readFrame(offset uint32, le *types.LogEntry) (frameHeader, error) {
+// readFrame reads the entry whose first frame is at offset into le.Data,
+// following any continuation frames. It returns the first frame's header.
+func (r *Reader) readFrame(offset uint64, le *types.LogEntry) (frameHeader, error) {
+	fh, err := r.readFrameHeaderAt(int64(offset))
+	if err != nil {
+		return fh, err
+	}
+	if fh.typ != FrameEntry {
+		return fh, fmt.Errorf("%w: expected entry frame at offset %d, found type %d", types.ErrCorrupt, offset, fh.typ)
+	}
+
+	le.Data = le.Data[:0]
+	pos := int64(offset)
+	next := fh
+	for {
+		// Need to read more bytes, validate that len is a sensible number. We
+		// don't limit the total size of entries split across several frames. We
+		// only grow the buffer by one frame at a time after successfully reading
+		// the previous one so corrupt lengths can't make us allocate much more
+		// than the size of the file.
+		if next.len > MaxFrameSize {
+			return fh, fmt.Errorf("%w: frame header indicates a record larger than MaxFrameSize (%d bytes)", types.ErrCorrupt, MaxFrameSize)
+		}
+
+		start := len(le.Data)
+		end := start + int(next.len)
+		if cap(le.Data) < end {
+			grown := make([]byte, start, end)
+			copy(grown, le.Data)
+			le.Data = grown
+		}
+		le.Data = le.Data[:end]
+
+		if _, err := r.rf.ReadAt(le.Data[start:], pos+frameHeaderLen); err != nil {
+			return fh, err
+		}
+		if !next.more() {
+			return fh, nil
+		}
+
+		pos += int64(encodedFrameSize(int(next.len)))
+		next, err = r.readFrameHeaderAt(pos)
+		if err != nil {
+			return fh, err
+		}
+		if next.typ != FrameContinuation {
+			return fh, fmt.Errorf("%w: expected continuation frame at offset %d, found type %d", types.ErrCorrupt, pos, next.typ)
+		}
+	}
+}
+
+func (r *Reader) readFrameHeaderAt(offset int64) (frameHeader, error) {
 	if cap(r.scratchFrameHeader) < frameHeaderLen {
 		r.scratchFrameHeader = make([]byte, frameHeaderLen)
 	}
 	r.scratchFrameHeader = r.scratchFrameHeader[:frameHeaderLen]
-	n, err := r.rf.ReadAt(r.scratchFrameHeader, int64(offset))
+	n, err := r.rf.ReadAt(r.scratchFrameHeader, offset)
 	if errors.Is(err, io.EOF) && n >= frameHeaderLen {
-		// We might have hit EOF just because our read buffer (at least 64KiB) might
-		// be larger than the space left in the file (say if files are tiny or if we
-		// are reading a frame near the end.). So don't treat EOF as an error as
-		// long as we have actually managed to read a frameHeader - we'll work out
-		// if we got the whole thing or not below.
+		// We might have hit EOF just because the frame header is right at the end
+		// of the file (say if files are tiny or if we are reading a frame near the
+		// end). So don't treat EOF as an error as long as we have actually managed
+		// to read a frameHeader.
 		err = nil
-
-		// Re-slice buf.Bs so it's len() reflect only what we actually managed to
-		// read. Note this doesn't impact the buffer length when it's returned to
-		// the pool which will still return the whole cap.
-		le.Data = le.Data[:n]
 	}
 	if err != nil {
 		return frameHeader{}, err
 	}
-	fh, err := readFrameHeader(r.scratchFrameHeader)
-	if err != nil {
-		return fh, err
-	}
-
-	// Need to read more bytes, validate that len is a sensible number
-	if fh.len > MaxEntrySize {
-		return fh, fmt.Errorf("%w: frame header indicates a record larger than MaxEntrySize (%d bytes)", types.ErrCorrupt, MaxEntrySize)
-	}
-
-	if cap(le.Data) < int(fh.len) {
-		le.Data = make([]byte, fh.len)
-	}
-	le.Data = le.Data[:fh.len]
-
-	if _, err := r.rf.ReadAt(le.Data, int64(offset+frameHeaderLen)); err != nil {
-		return fh, err
-	}
-	return fh, nil
+	return readFrameHeader(r.scratchFrameHeader)
 }
 
-func (r *Reader) findFrameOffset(idx uint64) (uint32, error) {
+func (r *Reader) findFrameOffset(idx uint64) (uint64, error) {
 	if r.tail != nil {
 		// This is not a sealed segment.
 		return r.tail.OffsetForFrame(idx)
 	}
 
-	// Sealed segment, read from the on-disk index block.
-	if r.info.IndexStart == 0 {
-		return 0, fmt.Errorf("sealed segment has no index block")
-	}
-
 	if idx < r.info.MinIndex || (r.info.MaxIndex > 0 && idx > r.info.MaxIndex) {
 		return 0, types.ErrNotFound
 	}
 
+	if r.info.IndexStart == 0 {
+		// Sealed without an index block, use the one built on open.
+		i := idx - r.info.BaseIndex
+		if i >= uint64(len(r.offsets)) {
+			return 0, types.ErrNotFound
+		}
+		return r.offsets[i], nil
+	}
+
+	// Sealed segment, read from the on-disk index block.
+
 	// IndexStart is the offset to the first entry in the index array. We need to
 	// find the byte offset to the Nth entry
+	entrySize := uint64(indexEntrySize(r.vsn))
 	entryOffset := (idx - r.info.BaseIndex)
-	byteOffset := r.info.IndexStart + (entryOffset * 4)
 
-	var bs [4]byte
-	n, err := r.rf.ReadAt(bs[:], int64(byteOffset))
-	if err == io.EOF && n == 4 {
-		// Read all of it just happened to be at end of file, ignore
+	var bs []byte
+	if r.cache != nil {
+		index, err := r.cachedIndex()
+		if err != nil {
+			return 0, err
+		}
+		start := entryOffset * entrySize
+		if start+entrySize > uint64(len(index)) {
+			return 0, types.ErrNotFound
+		}
+		bs = index[start : start+entrySize]
+	} else {
+		byteOffset := r.info.IndexStart + (entryOffset * entrySize)
+
+		var buf [8]byte
+		bs = buf[:entrySize]
+		n, err := r.rf.ReadAt(bs, int64(byteOffset))
+		if err == io.EOF && n == int(entrySize) {
+			// Read all of it just happened to be at end of file, ignore
+			err = nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read segment index: %w", err)
+		}
+	}
+	if entrySize == 8 {
+		return binary.LittleEndian.Uint64(bs), nil
+	}
+	return uint64(binary.LittleEndian.Uint32(bs)), nil
+}
+
+// cachedIndex returns the index block of the segment from the cache, reading
+// it from the file into the cache if it's not there yet. It only holds entries
+// up to MaxIndex.
+func (r *Reader) cachedIndex() ([]byte, error) {
+	if index, ok := r.cache.get(r.info.ID); ok {
+		return index, nil
+	}
+	index := make([]byte, r.indexBlockSize())
+	n, err := r.rf.ReadAt(index, int64(r.info.IndexStart))
+	if err == io.EOF && n == len(index) {
 		err = nil
 	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to read segment index: %w", err)
+		return nil, fmt.Errorf("failed to read segment index: %w", err)
 	}
-	offset := binary.LittleEndian.Uint32(bs[:])
-	return offset, nil
+	r.cache.add(r.info.ID, index)
+	return index, nil
+}
+
+// indexBlockSize returns the size of the part of the index block that holds
+// entries up to MaxIndex.
+func (r *Reader) indexBlockSize() uint64 {
+	return (r.info.MaxIndex - r.info.BaseIndex + 1) * uint64(indexEntrySize(r.vsn))
+}
+
+// loadIndex builds the in-memory index of a sealed segment that has no index
+// block by reading through its frames. Only entries up to MaxIndex are indexed
+// since anything after that was truncated.
+func (r *Reader) loadIndex() error {
+	var offsets []uint64
+	_, _, err := readThroughSegment(r.rf, func(_ types.SegmentInfo, fh frameHeader, offset int64) (bool, error) {
+		if fh.typ == FrameEntry {
+			offsets = append(offsets, uint64(offset))
+		}
+		return r.info.MaxIndex == 0 || r.info.BaseIndex+uint64(len(offsets)) <= r.info.MaxIndex, nil
+	})
+	if err != nil {
+		return err
+	}
+	r.offsets = offsets
+	return nil
 }
@@ -162,6 +162,9 @@ type testWritableFile struct {
 	maxWritten    int
 	lastSyncStart int
 	closed, dirty bool
+
+	// writeErr and syncErr can be set by tests to make subsequent calls fail.
+	writeErr, syncErr error
 }
 
 func newTestWritableFile(size int) *testWritableFile {
@@ -207,6 +210,9 @@ func (f *testWritableFile) Dump() string {
 }
 
 func (f *testWritableFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.writeErr != nil {
+		return 0, f.writeErr
+	}
 	if !f.dirty {
 		f.lastSyncStart = int(off)
 	}
@@ -268,6 +274,9 @@ func (f *testWritableFile) Close() error {
 }
 
 func (f *testWritableFile) Sync() error {
+	if f.syncErr != nil {
+		return f.syncErr
+	}
 	f.dirty = false
 	return nil
 }
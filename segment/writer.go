@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"sync/atomic"
 
 	"github.com/polarsignals/wal/types"
@@ -34,7 +35,7 @@ type Writer struct {
 	//    seen, or a new backing array is allocated and the old one copied into it
 	//    which also will never mutate the entries readers can already "see" via
 	//    the old slice.
-	offsets atomic.Value // []uint32
+	offsets atomic.Value // []uint64
 
 	// writer state is accessed only on the (serial) write path so doesn't need
 	// synchronization.
@@ -50,7 +51,7 @@ type Writer struct {
 		// writeOffset is the absolute file offset up to which we've written data to
 		// the file. The contents of commitBuf will be written at this offset when
 		// it commits or we reach the end of the block, whichever happens first.
-		writeOffset uint32
+		writeOffset uint64
 
 		// indexStart is set when the tail is sealed indicating the file offset at
 		// which the index array was written.
@@ -60,38 +61,78 @@ type Writer struct {
 	info types.SegmentInfo
 	wf   types.WritableFile
 	r    types.SegmentReader
+
+	// maxEntrySize is the largest entry Append accepts and maxFrameSize the
+	// largest frame payload, above which entries are split into continuation
+	// frames.
+	maxEntrySize int
+	maxFrameSize int
+
+	// vsn is the format version in the file header. Continuation frames may
+	// only be written if it's at least versionContinuations and offsets are
+	// 64-bit if it's versionWideOffsets.
+	vsn uint8
+
+	// ckpt writes index checkpoints for recovery. It's nil if they're disabled.
+	ckpt *checkpointer
+
+	// recovery describes what recoverTail discarded, if anything.
+	recovery types.TailRecovery
+
+	// aligned widens writes to whole blocks if wf wants aligned writes. It's
+	// nil otherwise.
+	aligned *alignedWriter
 }
 
-func createFile(info types.SegmentInfo, wf types.WritableFile) (*Writer, error) {
-	r, err := openReader(info, wf)
+func newWriter(info types.SegmentInfo, wf types.WritableFile, maxEntrySize, maxFrameSize int) (*Writer, error) {
+	vsn := uint8(version)
+	switch {
+	case info.SizeLimit > maxNarrowSegmentSize:
+		vsn = versionWideOffsets
+	case maxEntrySize > maxFrameSize:
+		vsn = versionContinuations
+	}
+	// The reader only uses the version to read a sealed index but the tail's
+	// reader looks up offsets in memory instead.
+	r, err := openReader(info, wf, vsn)
 	if err != nil {
 		return nil, err
 	}
 	w := &Writer{
-		info: info,
-		wf:   wf,
-		r:    r,
+		info:         info,
+		wf:           wf,
+		r:            r,
+		maxEntrySize: maxEntrySize,
+		maxFrameSize: maxFrameSize,
+		vsn:          vsn,
+	}
+	if af, ok := wf.(types.AlignedFile); ok && af.WriteAlignment() > 1 {
+		w.aligned = newAlignedWriter(af.WriteAlignment())
 	}
 	r.tail = w
+	return w, nil
+}
+
+func createFile(info types.SegmentInfo, wf types.WritableFile, maxEntrySize, maxFrameSize int) (*Writer, error) {
+	w, err := newWriter(info, wf, maxEntrySize, maxFrameSize)
+	if err != nil {
+		return nil, err
+	}
 	if err := w.initEmpty(); err != nil {
 		return nil, err
 	}
 	return w, nil
 }
 
-func recoverFile(info types.SegmentInfo, wf types.WritableFile) (*Writer, error) {
-	r, err := openReader(info, wf)
+// recoverFile recovers the tail segment in wf. If ck is not nil only the frames
+// after the checkpointed entries are scanned.
+func recoverFile(info types.SegmentInfo, wf types.WritableFile, maxEntrySize, maxFrameSize int, ck *checkpoint) (*Writer, error) {
+	w, err := newWriter(info, wf, maxEntrySize, maxFrameSize)
 	if err != nil {
 		return nil, err
 	}
-	w := &Writer{
-		info: info,
-		wf:   wf,
-		r:    r,
-	}
-	r.tail = w
 
-	if err := w.recoverTail(); err != nil {
+	if err := w.recoverTail(ck); err != nil {
 		return nil, err
 	}
 
@@ -104,35 +145,59 @@ func (w *Writer) initEmpty() error {
 	w.ensureBufCap(fileHeaderLen)
 	w.writer.commitBuf = w.writer.commitBuf[:fileHeaderLen]
 
-	if err := writeFileHeader(w.writer.commitBuf, w.info); err != nil {
+	if err := writeFileHeader(w.writer.commitBuf, w.info, w.vsn); err != nil {
 		return err
 	}
 
 	w.writer.crc = crc32.Checksum(w.writer.commitBuf[:fileHeaderLen], castagnoliTable)
 
 	// Initialize the index
-	offsets := make([]uint32, 0, 32*1024)
+	offsets := make([]uint64, 0, 32*1024)
 	w.offsets.Store(offsets)
 	return nil
 }
 
-func (w *Writer) recoverTail() error {
+func (w *Writer) recoverTail(ck *checkpoint) error {
 	// We need to track the last two commit frames
 	type commitInfo struct {
 		fh         frameHeader
 		offset     int64
 		crcStart   int64
 		offsetsLen int
+		// verified is set for the commit a checkpoint was written after, which
+		// is known to be complete.
+		verified bool
 	}
 	var prevCommit, finalCommit *commitInfo
 
-	offsets := make([]uint32, 0, 32*1024)
+	offsets := make([]uint64, 0, 32*1024)
+	start := int64(fileHeaderLen)
 
-	readInfo, err := readThroughSegment(w.wf, func(_ types.SegmentInfo, fh frameHeader, offset int64) (bool, error) {
+	readInfo, readVsn, err := readSegmentHeader(w.wf)
+	if err != nil {
+		return err
+	}
+	if ck != nil && len(ck.offsets) > 0 && w.checkpointValid(ck) {
+		// Everything up to the checkpointed commit is known to be committed so
+		// pick up scanning after it.
+		offsets = append(offsets, ck.offsets...)
+		finalCommit = &commitInfo{
+			offset:     int64(ck.commitEnd) - frameHeaderLen,
+			offsetsLen: len(offsets),
+			verified:   true,
+		}
+		start = int64(ck.commitEnd)
+	}
+
+	// scanEnd is the end of the last frame we could decode, used to report how
+	// much was discarded.
+	scanEnd := start
+	err = scanFrames(w.wf, start, func(fh frameHeader, offset int64) (bool, error) {
+		scanEnd = offset + int64(encodedFrameSize(int(fh.len)))
 		switch fh.typ {
 		case FrameEntry:
 			// Record the frame offset
-			offsets = append(offsets, uint32(offset))
+			offsets = append(offsets, uint64(offset))
 
 		case FrameIndex:
 			// So this segment was sealed! (or attempted) keep track of this
@@ -163,11 +228,28 @@ func (w *Writer) recoverTail() error {
 		// There were no commit frames found at all. This segment file is
 		// effectively empty. Init it that way ready for appending. This overwrites
 		// the file header so it doesn't matter if it was valid or not.
+		switch {
+		case scanEnd > fileHeaderLen:
+			w.discarded(types.DiscardTornCommit, 0, scanEnd)
+		case *readInfo != (types.SegmentInfo{}) && validateFileHeader(*readInfo, w.info) != nil:
+			w.discarded(types.DiscardHeaderMismatch, 0, fileHeaderLen)
+		}
 		return w.initEmpty()
 	}
 
+	// The header was committed so we're stuck with its version even if the
+	// max entry size has changed since, unless we end up rewinding past the
+	// first commit below.
+	cfgVsn := w.vsn
+	w.vsn = readVsn
+
 	// Assume that the final commit is good for now and set the writer state
-	w.writer.writeOffset = uint32(finalCommit.offset + frameHeaderLen)
+	w.writer.writeOffset = uint64(finalCommit.offset + frameHeaderLen)
+	if scanEnd > int64(w.writer.writeOffset) {
+		// Anything after the final commit was never committed. This includes an
+		// index frame from a seal that didn't complete.
+		w.discarded(types.DiscardTornCommit, int64(w.writer.writeOffset), scanEnd)
+	}
 
 	// Just store what we have for now to ensure the defer doesn't panic we'll
 	// probably update this below.
@@ -198,20 +280,24 @@ func (w *Writer) recoverTail() error {
 	}
 
 	// Last frame was a commit frame! Let's check that all the data written in
-	// that commit frame made it to disk.
-	// Verify the length first
-	bufLen := finalCommit.offset - finalCommit.crcStart
-	// We know bufLen can't be bigger than the whole segment file because none of
-	// the values above were read from the data just from the offsets we moved
-	// through.
-	batchBuf := make([]byte, bufLen)
+	// that commit frame made it to disk, unless a checkpoint was written after
+	// it which means it did.
+	verified := finalCommit.verified
+	if !verified {
+		// Verify the length first
+		bufLen := finalCommit.offset - finalCommit.crcStart
+		// We know bufLen can't be bigger than the whole segment file because none
+		// of the values above were read from the data just from the offsets we
+		// moved through.
+		batchBuf := make([]byte, bufLen)
+
+		if _, err := w.wf.ReadAt(batchBuf, finalCommit.crcStart); err != nil {
+			return fmt.Errorf("failed to read last committed batch for CRC validation: %w", err)
+		}
 
-	if _, err := w.wf.ReadAt(batchBuf, finalCommit.crcStart); err != nil {
-		return fmt.Errorf("failed to read last committed batch for CRC validation: %w", err)
+		verified = crc32.Checksum(batchBuf, castagnoliTable) == finalCommit.fh.crc
 	}
-
-	gotCrc := crc32.Checksum(batchBuf, castagnoliTable)
-	if gotCrc == finalCommit.fh.crc {
+	if verified {
 		// All is good. We already setup the state we need for writer other than
 		// offsets.
 		w.offsets.Store(offsets)
@@ -224,10 +310,13 @@ func (w *Writer) recoverTail() error {
 	if prevCommit == nil {
 		// Init wil re-write the file header so it doesn't matter if it was corrupt
 		// or not!
+		w.discarded(types.DiscardCRCMismatch, 0, scanEnd)
+		w.vsn = cfgVsn
 		return w.initEmpty()
 	}
 
-	w.writer.writeOffset = uint32(prevCommit.offset + frameHeaderLen)
+	w.writer.writeOffset = uint64(prevCommit.offset + frameHeaderLen)
+	w.discarded(types.DiscardCRCMismatch, int64(w.writer.writeOffset), scanEnd)
 	offsets = offsets[:prevCommit.offsetsLen]
 	w.offsets.Store(offsets)
 
@@ -235,8 +324,25 @@ func (w *Writer) recoverTail() error {
 	return validateFileHeader(*readInfo, w.info)
 }
 
+func (w *Writer) discarded(reason types.DiscardReason, start, end int64) {
+	w.recovery = types.TailRecovery{
+		Reason:       reason,
+		DiscardStart: uint64(start),
+		DiscardEnd:   uint64(end),
+	}
+}
+
+// Recovery implements types.TailRecoveryReporter. It describes what was
+// discarded when the segment was recovered.
+func (w *Writer) Recovery() types.TailRecovery {
+	return w.recovery
+}
+
 // Close implements io.Closer
 func (w *Writer) Close() error {
+	if w.ckpt != nil {
+		w.ckpt.close()
+	}
 	return w.r.Close()
 }
 
@@ -256,6 +362,50 @@ func (w *Writer) Append(entries []types.LogEntry) error {
 		return types.ErrSealed
 	}
 
+	needsContinuations := false
+	for _, e := range entries {
+		if len(e.Data) > w.maxEntrySize {
+			return fmt.Errorf("%w: entry %d is %d bytes, the max is %d", types.ErrTooBig, e.Index, len(e.Data), w.maxEntrySize)
+		}
+		if len(e.Data) > w.maxFrameSize {
+			needsContinuations = true
+		}
+	}
+
+	// If anything below fails (e.g. because the disk is full) we roll back the
+	// in-memory writer state to what it was before this batch so that the
+	// segment stays consistent and appends can be retried later. Any bytes that
+	// made it to disk are after the last commit frame so recovery ignores them
+	// and the next append overwrites them.
+	prev := w.writer
+	prevOffsets := w.getOffsets()
+	committed := false
+	defer func() {
+		if !committed {
+			w.writer.commitBuf = w.writer.commitBuf[:len(prev.commitBuf)]
+			w.writer.crc = prev.crc
+			w.writer.writeOffset = prev.writeOffset
+			w.writer.indexStart = prev.indexStart
+			w.offsets.Store(prevOffsets)
+		}
+	}()
+
+	if needsContinuations && w.vsn < versionContinuations && len(w.getOffsets()) > 0 {
+		// This segment was created before the max entry size was raised so its
+		// version doesn't allow continuations. Seal it so the caller rotates to a
+		// new segment and retries there. (An empty segment is always recovered
+		// with the current version since its header isn't committed yet.)
+		if err := w.appendIndex(); err != nil {
+			return err
+		}
+		if err := w.appendCommit(); err != nil {
+			return err
+		}
+		w.checkpoint()
+		committed = true
+		return types.ErrSealed
+	}
+
 	// Iterate entries and append each one
 	for _, e := range entries {
 		if err := w.appendEntry(e); err != nil {
@@ -264,8 +414,10 @@ func (w *Writer) Append(entries []types.LogEntry) error {
 	}
 
 	ofs := w.getOffsets()
-	// Work out if we need to seal before we commit and sync.
-	if (w.writer.writeOffset + uint32(len(w.writer.commitBuf)+indexFrameSize(len(ofs)))) > w.info.SizeLimit {
+	// Work out if we need to seal before we commit and sync. We also seal before
+	// the index gets too large for a single frame.
+	if w.writer.writeOffset+uint64(len(w.writer.commitBuf)+indexFrameSize(len(ofs), w.vsn)) > w.info.SizeLimit ||
+		len(ofs)*indexEntrySize(w.vsn) > maxIndexLen {
 		// Seal the segment! We seal it by writing an index frame before we commit.
 		if err := w.appendIndex(); err != nil {
 			return err
@@ -276,19 +428,51 @@ func (w *Writer) Append(entries []types.LogEntry) error {
 	if err := w.appendCommit(); err != nil {
 		return err
 	}
+	w.checkpoint()
 
 	// Commit in-memory
 	atomic.StoreUint64(&w.commitIdx, entries[len(entries)-1].Index)
+	committed = true
 	return nil
 }
 
-func (w *Writer) getOffsets() []uint32 {
-	return w.offsets.Load().([]uint32)
+// checkpoint writes an index checkpoint after a commit if one is due. Once the
+// segment is sealed its index block makes the checkpoint file redundant so
+// it's removed.
+func (w *Writer) checkpoint() {
+	if w.ckpt == nil {
+		return
+	}
+	if w.writer.indexStart > 0 {
+		w.ckpt.remove()
+		w.ckpt = nil
+		return
+	}
+	w.ckpt.maybeWrite(w.getOffsets(), w.writer.writeOffset)
+}
+
+// checkpointValid sanity checks that ck describes entries committed to this
+// segment before recovery relies on it.
+func (w *Writer) checkpointValid(ck *checkpoint) bool {
+	last := ck.offsets[len(ck.offsets)-1]
+	if ck.commitEnd < fileHeaderLen+2*frameHeaderLen || last >= ck.commitEnd || ck.offsets[0] < fileHeaderLen {
+		return false
+	}
+	var buf [frameHeaderLen]byte
+	if _, err := w.wf.ReadAt(buf[:], int64(ck.commitEnd)-frameHeaderLen); err != nil {
+		return false
+	}
+	fh, err := readFrameHeader(buf[:])
+	return err == nil && fh.typ == FrameCommit
+}
+
+func (w *Writer) getOffsets() []uint64 {
+	return w.offsets.Load().([]uint64)
 }
 
 // OffsetForFrame implements tailWriter and allows readers to lookup entry
 // frames in the tail's in-memory index.
-func (w *Writer) OffsetForFrame(idx uint64) (uint32, error) {
+func (w *Writer) OffsetForFrame(idx uint64) (uint64, error) {
 	if idx < w.info.BaseIndex || idx < w.info.MinIndex || idx > w.LastIndex() {
 		return 0, types.ErrNotFound
 	}
@@ -308,13 +492,41 @@ func (w *Writer) appendEntry(e types.LogEntry) error {
 			w.info.BaseIndex, e.Index, w.info.BaseIndex+uint64(len(offsets)))
 	}
 
-	fh := frameHeader{
-		typ: FrameEntry,
-		len: uint32(len(e.Data)),
+	if len(e.Data) > w.maxFrameSize && w.vsn < versionContinuations {
+		return fmt.Errorf("%w: entry %d is %d bytes, the max without continuations is %d", types.ErrTooBig, e.Index, len(e.Data), w.maxFrameSize)
 	}
-	bufOffset, err := w.appendFrame(fh, e.Data)
-	if err != nil {
-		return err
+	if w.vsn < versionWideOffsets && w.encodedEntrySize(len(e.Data))+w.writer.writeOffset+uint64(len(w.writer.commitBuf))+
+		uint64(indexFrameSize(len(offsets)+1, w.vsn)) > math.MaxUint32 {
+		return fmt.Errorf("%w: entry %d would grow the segment past 4GiB", types.ErrTooBig, e.Index)
+	}
+
+	// Write the entry in frames of at most maxFrameSize. All but the last have
+	// frameFlagMore set.
+	fh := frameHeader{typ: FrameEntry}
+	bufOffset := -1
+	data := e.Data
+	for {
+		chunk := data
+		if len(chunk) > w.maxFrameSize {
+			chunk = chunk[:w.maxFrameSize]
+		}
+		data = data[len(chunk):]
+		fh.len = uint32(len(chunk))
+		fh.flags = 0
+		if len(data) > 0 {
+			fh.flags = frameFlagMore
+		}
+		off, err := w.appendFrame(fh, chunk)
+		if err != nil {
+			return err
+		}
+		if bufOffset < 0 {
+			bufOffset = off
+		}
+		if len(data) == 0 {
+			break
+		}
+		fh.typ = FrameContinuation
 	}
 	// Update the offsets index
 
@@ -326,7 +538,7 @@ func (w *Writer) appendEntry(e types.LogEntry) error {
 	// same memory locations. Old readers might still be looking at the old
 	// array (lower than numEntries) through the current tail.offsets slice but
 	// we are not touching that at least below numEntries.
-	offsets = append(offsets, w.writer.writeOffset+uint32(bufOffset))
+	offsets = append(offsets, w.writer.writeOffset+uint64(bufOffset))
 
 	// Now we can make it available to readers. Note that readers still
 	// shouldn't read it until we actually commit to disk (and increment
@@ -335,6 +547,56 @@ func (w *Writer) appendEntry(e types.LogEntry) error {
 	return nil
 }
 
+// copyFrom appends the entries first to last read from r to a segment that
+// isn't part of the log yet. Unlike Append it doesn't commit since nobody can
+// read the segment until the caller calls seal and adds it to the log.
+func (w *Writer) copyFrom(r *Reader, first, last uint64) error {
+	le := types.LogEntry{Data: make([]byte, 0, minBufSize)}
+	for idx := first; idx <= last; idx++ {
+		if err := r.GetLog(idx, &le); err != nil {
+			return fmt.Errorf("failed to read entry %d from segment %d: %w", idx, r.info.ID, err)
+		}
+		le.Index = idx
+		if err := w.appendEntry(le); err != nil {
+			return err
+		}
+		// Write out the buffer every so often rather than holding the whole
+		// segment in memory.
+		if len(w.writer.commitBuf) >= minBufSize {
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// seal writes the index and commits everything appended by copyFrom. It
+// returns the IndexStart of the sealed segment.
+func (w *Writer) seal() (uint64, error) {
+	if err := w.appendIndex(); err != nil {
+		return 0, err
+	}
+	if err := w.appendCommit(); err != nil {
+		return 0, err
+	}
+	return w.writer.indexStart, nil
+}
+
+// encodedEntrySize returns the number of bytes an entry of n bytes takes up
+// once split into frames.
+func (w *Writer) encodedEntrySize(n int) uint64 {
+	if n <= w.maxFrameSize {
+		return uint64(encodedFrameSize(n))
+	}
+	full := n / w.maxFrameSize
+	size := uint64(full) * uint64(encodedFrameSize(w.maxFrameSize))
+	if rem := n % w.maxFrameSize; rem > 0 {
+		size += uint64(encodedFrameSize(rem))
+	}
+	return size
+}
+
 func (w *Writer) appendCommit() error {
 	fh := frameHeader{
 		typ: FrameCommit,
@@ -374,12 +636,12 @@ func (w *Writer) appendIndex() error {
 	// Append the index record before we commit (commit and flush happen later
 	// generally)
 	offsets := w.getOffsets()
-	l := indexFrameSize(len(offsets))
+	l := indexFrameSize(len(offsets), w.vsn)
 	w.ensureBufCap(l)
 
 	startOff := len(w.writer.commitBuf)
 
-	if err := writeIndexFrame(w.writer.commitBuf[startOff:startOff+l], offsets); err != nil {
+	if err := writeIndexFrame(w.writer.commitBuf[startOff:startOff+l], offsets, w.vsn); err != nil {
 		return err
 	}
 	w.writer.commitBuf = w.writer.commitBuf[:startOff+l]
@@ -389,7 +651,7 @@ func (w *Writer) appendIndex() error {
 
 	// Record the file offset where the index starts (the actual index data so
 	// after the frame header).
-	w.writer.indexStart = uint64(w.writer.writeOffset) + uint64(startOff+frameHeaderLen)
+	w.writer.indexStart = w.writer.writeOffset + uint64(startOff+frameHeaderLen)
 	return nil
 }
 
@@ -414,18 +676,24 @@ func (w *Writer) appendFrame(fh frameHeader, data []byte) (int, error) {
 
 func (w *Writer) flush() error {
 	// Write to file
-	n, err := w.wf.WriteAt(w.writer.commitBuf, int64(w.writer.writeOffset))
-	if err == io.EOF && n == len(w.writer.commitBuf) {
-		// Writer may return EOF even if it wrote all bytes if it wrote right up to
-		// the end of the file. Ignore that case though.
-		err = nil
-	}
-	if err != nil {
-		return err
+	if w.aligned != nil {
+		if err := w.aligned.writeAt(w.wf, w.writer.commitBuf, w.writer.writeOffset); err != nil {
+			return err
+		}
+	} else {
+		n, err := w.wf.WriteAt(w.writer.commitBuf, int64(w.writer.writeOffset))
+		if err == io.EOF && n == len(w.writer.commitBuf) {
+			// Writer may return EOF even if it wrote all bytes if it wrote right up to
+			// the end of the file. Ignore that case though.
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	// Reset writer state ready for next writes
-	w.writer.writeOffset += uint32(len(w.writer.commitBuf))
+	w.writer.writeOffset += uint64(len(w.writer.commitBuf))
 	w.writer.commitBuf = w.writer.commitBuf[:0]
 	return nil
 }
@@ -473,7 +741,30 @@ func (w *Writer) LastIndex() uint64 {
 	return atomic.LoadUint64(&w.commitIdx)
 }
 
-func readThroughSegment(r types.ReadableFile, fn func(info types.SegmentInfo, fh frameHeader, offset int64) (bool, error)) (*types.SegmentInfo, error) {
+// Size returns the number of bytes written to the segment file so far. Like
+// Append it must only be called from the single writer.
+func (w *Writer) Size() uint64 {
+	return w.writer.writeOffset
+}
+
+// readThroughSegment calls fn for every frame in r until it reaches the end of
+// the written data. It returns the info and format version from the file
+// header, which may not be valid if nothing was ever committed.
+func readThroughSegment(r types.ReadableFile, fn func(info types.SegmentInfo, fh frameHeader, offset int64) (bool, error)) (*types.SegmentInfo, uint8, error) {
+	readInfo, vsn, err := readSegmentHeader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = scanFrames(r, fileHeaderLen, func(fh frameHeader, offset int64) (bool, error) {
+		return fn(*readInfo, fh, offset)
+	})
+	return readInfo, vsn, err
+}
+
+// readSegmentHeader reads the file header of a segment that might not have
+// been committed yet. The returned info is empty rather than nil if the header
+// is missing or malformed.
+func readSegmentHeader(r types.ReadableFile) (*types.SegmentInfo, uint8, error) {
 	// First read the file header. Note we wrote it as part of the first commit so
 	// it may be missing or partial written and that's OK as long as there are no
 	// other later commit frames!
@@ -482,17 +773,17 @@ func readThroughSegment(r types.ReadableFile, fn func(info types.SegmentInfo, fh
 	// EOF is ok - the file might be empty if we crashed before committing
 	// anything and preallocation isn't supported.
 	if err != io.EOF && err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	readInfo, err := readFileHeader(fh[:])
+	readInfo, vsn, err := readFileHeader(fh[:])
 	if err == types.ErrCorrupt {
 		// Header is malformed or missing, don't error yet though we'll detect it
 		// later when we know if it's a problem or not.
 		err = nil
 	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	// If header wasn't detected as corrupt, it might still be just in a way
 	// that's valid since we've not verified it against the expected metadata yet.
@@ -504,26 +795,35 @@ func readThroughSegment(r types.ReadableFile, fn func(info types.SegmentInfo, fh
 		// corrupt when it shouldn't be later. Just prevents a nil panic.
 		readInfo = &types.SegmentInfo{}
 	}
+	return readInfo, vsn, nil
+}
 
-	// Read through file from after header until we hit zeros, EOF or corrupt
-	// frames.
-	offset := int64(fileHeaderLen)
-	var buf [frameHeaderLen]byte
+// scanFrames calls fn for every frame in r starting at offset until it hits
+// zeros, EOF or a corrupt frame header. It reads scanBufSize bytes at a time
+// rather than making a read for every frame header.
+func scanFrames(r types.ReadableFile, offset int64, fn func(fh frameHeader, offset int64) (bool, error)) error {
+	buf := make([]byte, scanBufSize)
+	// buf[:bufLen] holds the file contents from bufStart.
+	bufStart, bufLen := int64(0), 0
 
 	for {
-		n, err := r.ReadAt(buf[:], offset)
-		if err == io.EOF {
-			if n < frameHeaderLen {
-				return readInfo, nil
+		if offset < bufStart || offset+frameHeaderLen > bufStart+int64(bufLen) {
+			n, err := r.ReadAt(buf, offset)
+			if err == io.EOF {
+				if n < frameHeaderLen {
+					return nil
+				}
+				// This is OK! The last frame in file might be a commit frame so as long
+				// as we have it all then we can ignore the EOF for this iteration.
+				err = nil
 			}
-			// This is OK! The last frame in file might be a commit frame so as long
-			// as we have it all then we can ignore the EOF for this iteration.
-			err = nil
-		}
-		if err != nil {
-			return readInfo, fmt.Errorf("failed reading frame at offset=%d: %w", offset, err)
+			if err != nil {
+				return fmt.Errorf("failed reading frame at offset=%d: %w", offset, err)
+			}
+			bufStart, bufLen = offset, n
 		}
-		fh, err := readFrameHeader(buf[:frameHeaderLen])
+		pos := offset - bufStart
+		fh, err := readFrameHeader(buf[pos : pos+frameHeaderLen])
 		if err != nil {
 			// This is not actually an error case. If we failed to decode it could be
 			// because of a torn write (since we don't assume writes are atomic). We
@@ -531,21 +831,21 @@ func readThroughSegment(r types.ReadableFile, fn func(info types.SegmentInfo, fh
 			// FS (see README for details). So this must be due to corruption that
 			// happened due to non-atomic sector updates whilst committing the last
 			// write batch.
-			return readInfo, nil
+			return nil
 		}
 		if fh.typ == FrameInvalid {
 			// This means we've hit zeros at the end of the file (or due to an
 			// incomplete write, which we treat the same way).
-			return readInfo, nil
+			return nil
 		}
 
 		// Call the callback
-		shouldContinue, err := fn(*readInfo, fh, offset)
+		shouldContinue, err := fn(fh, offset)
 		if err != nil {
-			return readInfo, err
+			return err
 		}
 		if !shouldContinue {
-			return readInfo, nil
+			return nil
 		}
 
 		// Skip to next frame
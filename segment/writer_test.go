@@ -4,10 +4,16 @@
 package segment
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 
+	"github.com/polarsignals/wal/fs"
 	"github.com/polarsignals/wal/types"
 	"github.com/stretchr/testify/require"
 )
@@ -118,3 +124,394 @@ func TestConcurrentReadersAndWriter(t *testing.T) {
 	require.Greater(t, int(atomic.LoadUint64(&numReads)), 1000)
 	require.Greater(t, int(atomic.LoadUint64(&sealedMaxIndex)), 1000)
 }
+
+func TestWriterRecoversFromFailedAppend(t *testing.T) {
+	cases := []struct {
+		name string
+		fail func(f *testWritableFile, err error)
+	}{
+		{
+			name: "write fails",
+			fail: func(f *testWritableFile, err error) { f.writeErr = err },
+		},
+		{
+			name: "sync fails",
+			fail: func(f *testWritableFile, err error) { f.syncErr = err },
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			vfs := newTestVFS()
+			f := NewFiler("test", vfs)
+
+			seg1 := testSegment(1)
+			w, err := f.Create(seg1)
+			require.NoError(t, err)
+			file := testFileFor(t, w)
+
+			// Make the very first append fail so the file header is also still
+			// pending in the write buffer.
+			tc.fail(file, types.ErrDiskFull)
+			err = w.Append([]types.LogEntry{{Index: 1, Data: []byte("one")}})
+			require.ErrorIs(t, err, types.ErrDiskFull)
+			require.Equal(t, uint64(0), w.LastIndex())
+
+			var got types.LogEntry
+			require.ErrorIs(t, w.GetLog(1, &got), types.ErrNotFound)
+
+			// Space freed, the same entry can now be appended.
+			tc.fail(file, nil)
+			require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Data: []byte("one")}}))
+
+			// Fail again mid-segment.
+			tc.fail(file, types.ErrDiskFull)
+			err = w.Append([]types.LogEntry{{Index: 2, Data: []byte("two")}, {Index: 3, Data: []byte("three")}})
+			require.ErrorIs(t, err, types.ErrDiskFull)
+			require.Equal(t, uint64(1), w.LastIndex())
+
+			tc.fail(file, nil)
+			require.NoError(t, w.Append([]types.LogEntry{{Index: 2, Data: []byte("TWO")}}))
+			require.NoError(t, w.Append([]types.LogEntry{{Index: 3, Data: []byte("THREE")}}))
+
+			expect := []string{"one", "TWO", "THREE"}
+			for i, want := range expect {
+				require.NoError(t, w.GetLog(uint64(i+1), &got))
+				require.Equal(t, want, string(got.Data))
+			}
+
+			// And the file must be recoverable with the same content.
+			w2, err := f.RecoverTail(seg1)
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), w2.LastIndex())
+			for i, want := range expect {
+				require.NoError(t, w2.GetLog(uint64(i+1), &got))
+				require.Equal(t, want, string(got.Data))
+			}
+		})
+	}
+}
+
+func TestContinuationFrames(t *testing.T) {
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs, WithMaxEntrySize(1000))
+	// Use tiny frames so that entries don't need to be huge.
+	f.maxFrameSize = 64
+
+	seg := testSegment(1)
+	w, err := f.Create(seg)
+	require.NoError(t, err)
+	require.Equal(t, uint8(versionContinuations), w.(*Writer).vsn)
+
+	sizes := []int{10, 64, 65, 128, 300, 1000, 0}
+	var entries []types.LogEntry
+	for i, n := range sizes {
+		entries = append(entries, types.LogEntry{
+			Index: uint64(i + 1),
+			Data:  bytes.Repeat([]byte{byte('a' + i)}, n),
+		})
+	}
+	require.NoError(t, w.Append(entries[:3]))
+	require.NoError(t, w.Append(entries[3:]))
+
+	err = w.Append([]types.LogEntry{{Index: 8, Data: make([]byte, 1001)}})
+	require.ErrorIs(t, err, types.ErrTooBig)
+
+	check := func(r types.SegmentReader) {
+		t.Helper()
+		for _, want := range entries {
+			var got types.LogEntry
+			require.NoError(t, r.GetLog(want.Index, &got), "idx=%d", want.Index)
+			require.Equal(t, string(want.Data), string(got.Data), "idx=%d", want.Index)
+		}
+	}
+	check(w)
+
+	// Recovery must skip over continuation frames.
+	w2, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(entries)), w2.LastIndex())
+	check(w2)
+
+	var dumped []types.LogEntry
+	err = f.DumpSegment(seg.BaseIndex, seg.ID, 0, 0, func(_ types.SegmentInfo, e types.LogEntry) (bool, error) {
+		dumped = append(dumped, types.LogEntry{Index: e.Index, Data: append([]byte{}, e.Data...)})
+		return true, nil
+	})
+	require.NoError(t, err)
+	require.Len(t, dumped, len(entries))
+	for i := range entries {
+		require.Equal(t, entries[i].Index, dumped[i].Index)
+		require.Equal(t, string(entries[i].Data), string(dumped[i].Data))
+	}
+
+	// Fill and seal the segment then read it back from the on-disk index.
+	idx := uint64(len(entries))
+	for {
+		sealed, indexStart, err := w2.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			seg.IndexStart = indexStart
+			seg.MaxIndex = idx
+			break
+		}
+		idx++
+		require.NoError(t, w2.Append([]types.LogEntry{{Index: idx, Data: make([]byte, 500)}}))
+	}
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	check(r)
+}
+
+func TestContinuationsInOldSegment(t *testing.T) {
+	vfs := newTestVFS()
+	old := NewFiler("test", vfs)
+	big := types.LogEntry{Data: make([]byte, 100)}
+
+	f := NewFiler("test", vfs, WithMaxEntrySize(1000))
+	f.maxFrameSize = 64
+
+	// An empty segment created before the max entry size was raised is
+	// recovered with the new version since its header isn't committed yet.
+	seg := testSegment(1)
+	_, err := old.Create(seg)
+	require.NoError(t, err)
+	w, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, uint8(versionContinuations), w.(*Writer).vsn)
+	big.Index = 1
+	require.NoError(t, w.Append([]types.LogEntry{big}))
+
+	// But one with committed entries keeps its version and is sealed instead so
+	// the caller rotates.
+	seg = testSegment(1)
+	w, err = old.Create(seg)
+	require.NoError(t, err)
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Data: []byte("one")}}))
+	w, err = f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, uint8(version), w.(*Writer).vsn)
+	big.Index = 2
+	require.ErrorIs(t, w.Append([]types.LogEntry{big}), types.ErrSealed)
+	sealed, _, err := w.Sealed()
+	require.NoError(t, err)
+	require.True(t, sealed)
+	require.Equal(t, uint64(1), w.LastIndex())
+}
+
+func TestContinuationsInOldSegmentSealFails(t *testing.T) {
+	vfs := newTestVFS()
+	old := NewFiler("test", vfs)
+	f := NewFiler("test", vfs, WithMaxEntrySize(1000))
+	f.maxFrameSize = 64
+
+	seg := testSegment(1)
+	w, err := old.Create(seg)
+	require.NoError(t, err)
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 1, Data: []byte("one")}}))
+	w, err = f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, uint8(version), w.(*Writer).vsn)
+
+	// If sealing for a continuation fails the segment must not be left looking
+	// sealed when its index was never made durable.
+	file := testFileFor(t, w)
+	file.syncErr = types.ErrDiskFull
+	err = w.Append([]types.LogEntry{{Index: 2, Data: make([]byte, 100)}})
+	require.ErrorIs(t, err, types.ErrDiskFull)
+	sealed, _, err := w.Sealed()
+	require.NoError(t, err)
+	require.False(t, sealed)
+
+	// Once the disk has space the segment can still be appended to.
+	file.syncErr = nil
+	require.NoError(t, w.Append([]types.LogEntry{{Index: 2, Data: []byte("two")}}))
+	require.Equal(t, uint64(2), w.LastIndex())
+
+	w2, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), w2.LastIndex())
+	var got types.LogEntry
+	require.NoError(t, w2.GetLog(2, &got))
+	require.Equal(t, "two", string(got.Data))
+}
+
+func TestWideOffsets(t *testing.T) {
+	// Segments only get 64-bit offsets if they may grow past 2GiB.
+	info := testSegment(1)
+	w, err := newWriter(info, newTestWritableFile(0), DefaultMaxEntrySize, MaxFrameSize)
+	require.NoError(t, err)
+	require.Equal(t, uint8(version), w.vsn)
+
+	info.SizeLimit = 3 * 1024 * 1024 * 1024
+	w, err = newWriter(info, newTestWritableFile(0), DefaultMaxEntrySize, MaxFrameSize)
+	require.NoError(t, err)
+	require.Equal(t, uint8(versionWideOffsets), w.vsn)
+
+	// Allocating a file that big is too slow for a unit test so force a small
+	// segment into the wide format before anything is committed.
+	vfs := newTestVFS()
+	f := NewFiler("test", vfs)
+	seg := testSegment(1)
+	sw, err := f.Create(seg)
+	require.NoError(t, err)
+	w = sw.(*Writer)
+	w.vsn = versionWideOffsets
+	require.NoError(t, w.initEmpty())
+
+	var entries []types.LogEntry
+	idx := uint64(0)
+	for {
+		sealed, indexStart, err := w.Sealed()
+		require.NoError(t, err)
+		if sealed {
+			seg.IndexStart = indexStart
+			seg.MaxIndex = idx
+			break
+		}
+		idx++
+		e := types.LogEntry{Index: idx, Data: []byte(fmt.Sprintf("entry-%d", idx))}
+		entries = append(entries, e)
+		require.NoError(t, w.Append([]types.LogEntry{e}))
+	}
+
+	check := func(r types.SegmentReader) {
+		t.Helper()
+		for _, want := range entries {
+			var got types.LogEntry
+			require.NoError(t, r.GetLog(want.Index, &got), "idx=%d", want.Index)
+			require.Equal(t, string(want.Data), string(got.Data), "idx=%d", want.Index)
+		}
+	}
+
+	// The sealed index is read with 8 byte entries.
+	r, err := f.Open(seg)
+	require.NoError(t, err)
+	require.Equal(t, uint8(versionWideOffsets), r.(*Reader).vsn)
+	check(r)
+
+	// Recovery keeps the version from the file header.
+	seg.IndexStart = 0
+	w2, err := f.RecoverTail(seg)
+	require.NoError(t, err)
+	require.Equal(t, uint8(versionWideOffsets), w2.(*Writer).vsn)
+	check(w2)
+}
+
+// alignedVFS wraps a VFS so segment files ask for aligned writes and reject any
+// that aren't, like a file opened with O_DIRECT would.
+type alignedVFS struct {
+	types.VFS
+	align   int
+	failErr error
+}
+
+func (fs *alignedVFS) Create(dir, name string, size uint64) (types.WritableFile, error) {
+	wf, err := fs.VFS.Create(dir, name, size)
+	return fs.wrap(name, wf, err)
+}
+
+func (fs *alignedVFS) OpenWriter(dir, name string) (types.WritableFile, error) {
+	wf, err := fs.VFS.OpenWriter(dir, name)
+	return fs.wrap(name, wf, err)
+}
+
+func (fs *alignedVFS) wrap(name string, wf types.WritableFile, err error) (types.WritableFile, error) {
+	if err != nil || !strings.HasSuffix(name, segmentFileSuffix) {
+		return wf, err
+	}
+	return &alignedFile{WritableFile: wf, fs: fs}, nil
+}
+
+type alignedFile struct {
+	types.WritableFile
+	fs *alignedVFS
+}
+
+func (f *alignedFile) WriteAlignment() int {
+	return f.fs.align
+}
+
+func (f *alignedFile) WriteAt(p []byte, off int64) (int, error) {
+	align := f.fs.align
+	if len(p)%align != 0 || off%int64(align) != 0 || uintptr(unsafe.Pointer(&p[0]))%uintptr(align) != 0 {
+		return 0, fmt.Errorf("unaligned write of %d bytes at %d", len(p), off)
+	}
+	if f.fs.failErr != nil {
+		return 0, f.fs.failErr
+	}
+	return f.WritableFile.WriteAt(p, off)
+}
+
+func TestAlignedWrites(t *testing.T) {
+	mem := fs.NewMemFS()
+	mem.Mkdir("/wal")
+	vfs := &alignedVFS{VFS: mem, align: 512}
+	f := NewFiler("/wal", vfs)
+
+	info := testSegment(1)
+	info.SizeLimit = 64 * 1024
+	sw, err := f.Create(info)
+	require.NoError(t, err)
+
+	rnd := rand.New(rand.NewSource(1))
+	var want []string
+	appendN := func(n int) error {
+		batch := make([]types.LogEntry, 0, n)
+		for i := 0; i < n; i++ {
+			data := strings.Repeat(string(rune('a'+rnd.Intn(26))), 1+rnd.Intn(1500))
+			batch = append(batch, types.LogEntry{Index: uint64(len(want) + i + 1), Data: []byte(data)})
+		}
+		if err := sw.Append(batch); err != nil {
+			return err
+		}
+		for _, e := range batch {
+			want = append(want, string(e.Data))
+		}
+		return nil
+	}
+	check := func(r types.SegmentReader) {
+		var le types.LogEntry
+		for i, data := range want {
+			require.NoError(t, r.GetLog(uint64(i+1), &le))
+			require.Equal(t, data, string(le.Data))
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, appendN(1+rnd.Intn(4)))
+	}
+
+	// A failed append is rolled back and the block it started in rewritten by
+	// the next one.
+	vfs.failErr = types.ErrDiskFull
+	require.ErrorIs(t, appendN(3), types.ErrDiskFull)
+	vfs.failErr = nil
+	require.NoError(t, appendN(2))
+	check(sw)
+	require.NoError(t, sw.Close())
+
+	// After recovery the partial tail block is read back before it's
+	// rewritten.
+	sw, err = f.RecoverTail(info)
+	require.NoError(t, err)
+	check(sw)
+	for {
+		require.NoError(t, appendN(1+rnd.Intn(4)))
+		if sealed, _, err := sw.Sealed(); err == nil && sealed {
+			break
+		}
+	}
+	check(sw)
+	_, indexStart, err := sw.Sealed()
+	require.NoError(t, err)
+	require.NoError(t, sw.Close())
+
+	info.IndexStart = indexStart
+	info.MaxIndex = uint64(len(want))
+	r, err := f.Open(info)
+	require.NoError(t, err)
+	check(r)
+	require.NoError(t, r.Close())
+}
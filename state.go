@@ -34,6 +34,11 @@ type state struct {
 	nextBaseIndex uint64
 	segments      *immutable.SortedMap[uint64, segmentState]
 	tail          types.SegmentWriter
+
+	// cursors maps registered cursor names to their last committed index. Like
+	// the rest of state it must not be mutated once published, use withCursor
+	// or withoutCursor to get a modified copy.
+	cursors map[string]uint64
 }
 
 type segmentState struct {
@@ -51,13 +56,27 @@ func (s *state) Persistent() types.PersistentState {
 		_, s, _ := it.Next()
 		segs = append(segs, s.SegmentInfo)
 	}
+	var cursors map[string]uint64
+	if len(s.cursors) > 0 {
+		cursors = make(map[string]uint64, len(s.cursors))
+		for name, idx := range s.cursors {
+			cursors[name] = idx
+		}
+	}
 	return types.PersistentState{
 		NextSegmentID: s.nextSegmentID,
 		Segments:      segs,
+		Cursors:       cursors,
 	}
 }
 
 func (s *state) getLog(index uint64, le *types.LogEntry) error {
+	// The tail writer doesn't know about front truncations that happened since
+	// it was opened so it would still return entries below the first index.
+	if index < s.firstIndex() {
+		return ErrNotFound
+	}
+
 	// Check the tail writer first
 	if s.tail != nil {
 		err := s.tail.GetLog(index, le)
@@ -88,9 +107,17 @@ func (s *state) getLog(index uint64, le *types.LogEntry) error {
 // there which means the caller can be sure it's not going to return the tail
 // segment.
 func (s *state) findSegmentReader(idx uint64) (types.SegmentReader, error) {
+	seg, ok := s.findSegment(idx)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return seg.r, nil
+}
 
+// findSegment is like findSegmentReader but returns the whole segmentState.
+func (s *state) findSegment(idx uint64) (segmentState, bool) {
 	if s.segments.Len() == 0 {
-		return nil, ErrNotFound
+		return segmentState{}, false
 	}
 
 	// Search for a segment with baseIndex.
@@ -100,6 +127,10 @@ func (s *state) findSegmentReader(idx uint64) (types.SegmentReader, error) {
 	// to the first result equal or greater so we are either at it (if equal) or
 	// on the one _after_ the one we need. We step back since that's most likely
 	it.Seek(idx)
+	if it.Done() {
+		// idx is past the last baseIndex so it can only be in the last segment.
+		it.Last()
+	}
 	// The first call to Next/Prev actually returns the node the iterator is
 	// currently on (which is probably the one after the one we want) but in some
 	// edge cases we might actually want this one. Rather than reversing back and
@@ -111,10 +142,10 @@ func (s *state) findSegmentReader(idx uint64) (types.SegmentReader, error) {
 
 	// We either have the right segment or it doesn't exist.
 	if ok && seg.MinIndex <= idx && (seg.MaxIndex == 0 || seg.MaxIndex >= idx) {
-		return seg.r, nil
+		return seg, true
 	}
 
-	return nil, ErrNotFound
+	return segmentState{}, false
 }
 
 func (s *state) getTailInfo() *segmentState {
@@ -179,6 +210,39 @@ func (s *state) lastIndex() uint64 {
 	return tailSeg.BaseIndex - 1
 }
 
+// minCursorIndex returns the lowest committed index of all registered cursors.
+// ok is false if there are no cursors registered.
+func (s *state) minCursorIndex() (min uint64, ok bool) {
+	for _, idx := range s.cursors {
+		if !ok || idx < min {
+			min = idx
+			ok = true
+		}
+	}
+	return min, ok
+}
+
+// withCursor returns a copy of the cursors map with name set to idx.
+func (s *state) withCursor(name string, idx uint64) map[string]uint64 {
+	cursors := make(map[string]uint64, len(s.cursors)+1)
+	for n, i := range s.cursors {
+		cursors[n] = i
+	}
+	cursors[name] = idx
+	return cursors
+}
+
+// withoutCursor returns a copy of the cursors map without name.
+func (s *state) withoutCursor(name string) map[string]uint64 {
+	cursors := make(map[string]uint64, len(s.cursors))
+	for n, i := range s.cursors {
+		if n != name {
+			cursors[n] = i
+		}
+	}
+	return cursors
+}
+
 func (s *state) acquire() func() {
 	atomic.AddInt32(&s.refCount, 1)
 	return s.release
@@ -211,5 +275,6 @@ func (s *state) clone() state {
 		nextSegmentID: s.nextSegmentID,
 		segments:      s.segments,
 		tail:          s.tail,
+		cursors:       s.cursors,
 	}
 }
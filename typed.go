@@ -0,0 +1,118 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/polarsignals/wal/codec"
+	"github.com/polarsignals/wal/types"
+)
+
+// TypedWAL stores values of type T in a WAL, encoding them with a
+// codec.Codec so callers don't have to deal with LogEntry.Data themselves.
+type TypedWAL[T any] struct {
+	w     *WAL
+	codec codec.Codec[T]
+
+	// appendMu serializes Append so that concurrent calls pick distinct indexes.
+	appendMu sync.Mutex
+}
+
+// NewTyped returns a TypedWAL that stores values in w using c. The caller
+// remains responsible for closing w. Appending to w directly as well as
+// through the TypedWAL is possible but the caller has to coordinate so the
+// indexes don't collide.
+func NewTyped[T any](w *WAL, c codec.Codec[T]) *TypedWAL[T] {
+	return &TypedWAL[T]{w: w, codec: c}
+}
+
+// WAL returns the underlying WAL, e.g. to truncate it.
+func (t *TypedWAL[T]) WAL() *WAL {
+	return t.w
+}
+
+// Append encodes v and stores it at the index after the current last index,
+// or at index 1 if the log is empty. It returns the index v was stored at.
+func (t *TypedWAL[T]) Append(v T) (uint64, error) {
+	data, err := t.codec.Encode(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode entry: %w", err)
+	}
+
+	t.appendMu.Lock()
+	defer t.appendMu.Unlock()
+
+	last, err := t.w.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+	index := last + 1
+	if err := t.w.StoreLogs([]types.LogEntry{{Index: index, Data: data}}); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// Get returns the value stored at index. It returns ErrNotFound if index isn't
+// in the log and a *codec.DecodeError if the entry can't be decoded.
+func (t *TypedWAL[T]) Get(index uint64) (T, error) {
+	var zero T
+	if err := t.w.checkClosed(); err != nil {
+		return zero, err
+	}
+	var le types.LogEntry
+	if err := t.w.GetLog(index, &le); err != nil {
+		return zero, err
+	}
+	v, err := t.codec.Decode(le.Data)
+	if err != nil {
+		// Only look the segment up on failure to keep reads cheap. If the entry
+		// was truncated in the meantime the ID is left zero.
+		info, _ := t.w.segmentInfo(index)
+		return zero, &codec.DecodeError{Index: index, SegmentID: info.ID, Err: err}
+	}
+	return v, nil
+}
+
+// Range calls fn with each value from index from to index to inclusive, in
+// order, clamped to the entries in the log when Range is called. It stops
+// early without error if fn returns false and returns the first error from
+// either fn or Get. Entries truncated concurrently cause ErrNotFound.
+func (t *TypedWAL[T]) Range(from, to uint64, fn func(index uint64, v T) (bool, error)) error {
+	first, err := t.w.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := t.w.LastIndex()
+	if err != nil {
+		return err
+	}
+	if first == 0 {
+		// Empty log
+		return nil
+	}
+	if from < first {
+		from = first
+	}
+	if to > last {
+		to = last
+	}
+
+	for index := from; index <= to; index++ {
+		v, err := t.Get(index)
+		if err != nil {
+			return err
+		}
+		more, err := fn(index, v)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
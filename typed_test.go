@@ -0,0 +1,68 @@
+// Copyright (c) HashiCorp, Inc
+// SPDX-License-Identifier: MPL-2.0
+
+package wal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/polarsignals/wal/codec"
+	"github.com/polarsignals/wal/types"
+)
+
+type typedEvent struct {
+	Name  string
+	Count int
+}
+
+func TestTypedWAL(t *testing.T) {
+	w, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer w.Close()
+
+	tw := NewTyped[typedEvent](w, codec.JSON[typedEvent]{})
+
+	for i := 1; i <= 5; i++ {
+		idx, err := tw.Append(typedEvent{Name: "e", Count: i})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), idx)
+	}
+
+	got, err := tw.Get(3)
+	require.NoError(t, err)
+	require.Equal(t, typedEvent{Name: "e", Count: 3}, got)
+
+	_, err = tw.Get(6)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Range clamps to the log and stops when asked to.
+	var counts []int
+	err = tw.Range(0, 100, func(index uint64, v typedEvent) (bool, error) {
+		require.Equal(t, index, uint64(v.Count))
+		counts = append(counts, v.Count)
+		return v.Count < 4, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4}, counts)
+
+	// Appending continues after truncations.
+	require.NoError(t, w.TruncateBack(2))
+	idx, err := tw.Append(typedEvent{Name: "after"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx)
+
+	// Entries that aren't valid for the codec report where they are.
+	require.NoError(t, w.StoreLogs([]types.LogEntry{{Index: 4, Data: []byte("not json")}}))
+	_, err = tw.Get(4)
+	var decErr *codec.DecodeError
+	require.True(t, errors.As(err, &decErr))
+	require.Equal(t, uint64(4), decErr.Index)
+	tail := w.loadState().getTailInfo()
+	require.Equal(t, tail.ID, decErr.SegmentID)
+
+	err = tw.Range(1, 4, func(uint64, typedEvent) (bool, error) { return true, nil })
+	require.True(t, errors.As(err, &decErr))
+}
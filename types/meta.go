@@ -22,12 +22,35 @@ type MetaStore interface {
 	// called concurrently with Get/SetStable operations.
 	CommitState(PersistentState) error
 
+	// GetStable returns the value stored for key or nil if there is none. It may
+	// be called concurrently with any other method except Load.
+	GetStable(key []byte) ([]byte, error)
+
+	// SetStable durably stores value for key, replacing any existing value. A
+	// nil value removes the key. It must not return until the value is persisted
+	// in a crash-safe way. Stable values are independent of the state replaced
+	// by CommitState. It may be called concurrently with any other method except
+	// Load.
+	SetStable(key, value []byte) error
+
 	io.Closer
 }
 
+// StateSizeReporter is an optional interface a MetaStore may implement to
+// report the size in bytes of the encoded state it most recently loaded or
+// committed.
+type StateSizeReporter interface {
+	EncodedStateSize() int
+}
+
 // PersistentState represents the WAL file metadata we need to store reliably to
 // recover on restart.
 type PersistentState struct {
 	NextSegmentID uint64
 	Segments      []SegmentInfo
+
+	// Cursors maps the name of each registered consumer cursor to the last index
+	// it committed. It's stored alongside the segments so that cursor updates
+	// are committed atomically with the rest of the WAL metadata.
+	Cursors map[string]uint64 `json:",omitempty"`
 }
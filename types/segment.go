@@ -43,7 +43,12 @@ type SegmentInfo struct {
 	// pre-allocated to this size on filesystems that support it. It is a soft
 	// limit in the sense that the final Append usually takes the segment file
 	// past this size before it is considered full and sealed.
-	SizeLimit uint32
+	SizeLimit uint64
+
+	// Size is the number of bytes written to the segment file. It's set when the
+	// segment is sealed and is zero for the tail and for segments sealed by
+	// versions that didn't record it.
+	Size uint64
 }
 
 // SegmentFiler is the interface that provides access to segments to the WAL. It
@@ -126,3 +131,39 @@ type SegmentReader interface {
 	// If the log doesn't exist in this segment ErrNotFound must be returned.
 	GetLog(idx uint64, le *LogEntry) error
 }
+
+// DiscardReason describes why data was discarded from the tail segment during
+// recovery.
+type DiscardReason string
+
+const (
+	// DiscardTornCommit means frames were found after the last complete commit
+	// frame. They were never committed so can't have been acknowledged.
+	DiscardTornCommit DiscardReason = "torn_commit"
+
+	// DiscardCRCMismatch means the last commit frame's CRC didn't match the data
+	// it committed so the segment was rolled back to the previous commit.
+	DiscardCRCMismatch DiscardReason = "crc_mismatch"
+
+	// DiscardHeaderMismatch means the file header didn't match the segment's
+	// metadata and nothing had been committed after it, so the segment was
+	// reinitialized.
+	DiscardHeaderMismatch DiscardReason = "header_mismatch"
+)
+
+// TailRecovery describes what was discarded while recovering a tail segment.
+type TailRecovery struct {
+	// Reason is why data was discarded. It's empty if nothing was.
+	Reason DiscardReason
+
+	// DiscardStart and DiscardEnd are the file offsets of the discarded range.
+	// DiscardEnd is the end of the last frame that could be decoded, anything
+	// after that was torn or never written.
+	DiscardStart, DiscardEnd uint64
+}
+
+// TailRecoveryReporter is an optional interface a SegmentWriter returned by
+// RecoverTail may implement to describe what recovery discarded.
+type TailRecoveryReporter interface {
+	Recovery() TailRecovery
+}
@@ -12,6 +12,15 @@ var (
 	ErrCorrupt  = errors.New("WAL is corrupt")
 	ErrSealed   = errors.New("segment is sealed")
 	ErrClosed   = errors.New("closed")
+
+	// ErrDiskFull is returned when a write fails because there is not enough
+	// space left on the device, or when an append is rejected because free space
+	// dropped below the configured reserve.
+	ErrDiskFull = errors.New("disk full")
+
+	// ErrTooBig is returned when appending an entry larger than the configured
+	// maximum entry size.
+	ErrTooBig = errors.New("entry too big")
 )
 
 // LogEntry represents an entry that has already been encoded.
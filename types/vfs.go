@@ -42,6 +42,36 @@ type VFS interface {
 	OpenWriter(dir, name string) (WritableFile, error)
 }
 
+// FreeSpaceReporter is an optional interface a VFS may implement to report how
+// many bytes are available to unprivileged writers in dir.
+type FreeSpaceReporter interface {
+	FreeSpace(dir string) (uint64, error)
+}
+
+// FileMapper is an optional interface a VFS may implement to open files memory
+// mapped read-only. Reads from the returned file are served from memory
+// without system calls. The mapping is released by Close so the file must not
+// be read after it's closed.
+type FileMapper interface {
+	OpenMapped(dir, name string) (ReadableFile, error)
+}
+
+// FileMover is an optional interface a VFS may implement to move a file into
+// another directory, creating the directory if needed. It must fail if newName
+// already exists in newDir and the move must be durable once it returns.
+type FileMover interface {
+	Move(dir, name, newDir, newName string) error
+}
+
+// AlignedFile is an optional interface a WritableFile may implement if writes
+// to it are only efficient when aligned, for example because it was opened
+// with O_DIRECT. WriteAlignment returns the size in bytes that the offset,
+// length and memory address of a buffer passed to WriteAt should be a multiple
+// of, or zero if any write is fine.
+type AlignedFile interface {
+	WriteAlignment() int
+}
+
 // WritableFile provides random read-write access to a file as well as the
 // ability to fsync it to disk.
 type WritableFile interface {
@@ -4,6 +4,8 @@
 package wal
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -16,6 +18,7 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
+	"github.com/polarsignals/wal/fs"
 	"github.com/polarsignals/wal/types"
 )
 
@@ -24,11 +27,21 @@ var (
 	ErrCorrupt    = types.ErrCorrupt
 	ErrSealed     = types.ErrSealed
 	ErrClosed     = types.ErrClosed
+	ErrDiskFull   = types.ErrDiskFull
+	ErrTooBig     = types.ErrTooBig
 	ErrOutOfRange = errors.New("index out of range")
 
 	DefaultSegmentSize = 64 * 1024 * 1024
 )
 
+const (
+	// MinSegmentSize and MaxSegmentSize are the limits WithSegmentSize accepts.
+	// Segments larger than 2GiB store 64-bit offsets in their index which older
+	// versions of this package can't read.
+	MinSegmentSize = 512
+	MaxSegmentSize = 1 << 40
+)
+
 // LogStore is used to provide an interface for storing
 // and retrieving logs in a durable fashion.
 type LogStore interface {
@@ -67,8 +80,64 @@ type WAL struct {
 
 	metrics *Metrics
 
-	logger      log.Logger
-	segmentSize int
+	logger       log.Logger
+	segmentSize  int
+	maxEntrySize int
+
+	hooks      Hooks
+	hookRunner *hookRunner
+
+	retention   retentionPolicy
+	cursorGuard bool
+
+	// compaction configures background rewriting of sealed segments. compactCh
+	// is nil unless it's enabled.
+	compaction compactionPolicy
+	compactCh  chan struct{}
+
+	// prealloc configures creating the next segment file in the background.
+	prealloc preallocPolicy
+
+	// diskReserve is the number of bytes of free space below which appends are
+	// rejected with ErrDiskFull. Zero disables the check.
+	diskReserve uint64
+
+	// freeSpace caches the free space the SegmentFiler last reported, less the
+	// bytes appended since, so that appends don't each need a statfs. It was
+	// reported at freeSpaceAt, which is zeroed to force a refresh. Both are
+	// protected by writeMu. See checkDiskReserve.
+	freeSpace   uint64
+	freeSpaceAt time.Time
+
+	// mmap makes reads of sealed segments go through a memory mapping. Segments
+	// sealed by rotation are reopened with the SegmentFiler so they're mapped
+	// too rather than read through the old tail writer.
+	mmap bool
+
+	// fsOpts configures how the default SegmentFiler's VFS syncs and writes
+	// segment files.
+	fsOpts fs.Options
+
+	// indexCacheBytes is the memory budget for the default SegmentFiler's cache
+	// of sealed segment index blocks. Zero disables it.
+	indexCacheBytes uint64
+
+	// entryCache holds recently appended or read entries. It's nil unless
+	// enabled.
+	entryCache *entryCache
+
+	// quarantine makes Open move orphaned segment files aside rather than
+	// delete them. Quarantined files older than quarantineRetention are deleted
+	// by Open unless it's zero.
+	quarantine          bool
+	quarantineRetention time.Duration
+
+	// recovery is what Open recovered. It's immutable once Open returns.
+	recovery RecoveryReport
+
+	// shutdownCh is closed by Close to stop background goroutines other than
+	// runRotate which is stopped by closing triggerRotate.
+	shutdownCh chan struct{}
 
 	// s is the current state of the WAL files. It is an immutable snapshot that
 	// can be accessed without a lock when reading. We only support a single
@@ -113,6 +182,7 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 	w := &WAL{
 		dir:           dir,
 		triggerRotate: make(chan uint64, 1),
+		shutdownCh:    make(chan struct{}),
 	}
 	// Apply options
 	for _, opt := range opts {
@@ -121,24 +191,45 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 	if err := w.applyDefaultsAndValidate(); err != nil {
 		return nil, err
 	}
+	if w.compaction.enabled() {
+		w.compactCh = make(chan struct{}, 1)
+	}
+	if w.prealloc.enabled() {
+		w.prealloc.ch = make(chan struct{}, 1)
+		w.prealloc.done = make(chan struct{})
+	}
+	w.hookRunner = newHookRunner(w.hooks)
+	// Make sure we don't leak the hook goroutine if we fail to open.
+	success := false
+	defer func() {
+		if !success {
+			w.hookRunner.close()
+		}
+	}()
 
 	// Load or create metaDB
 	persisted, err := w.metaDB.Load(w.dir)
 	if err != nil {
 		return nil, err
 	}
+	w.observeMetaStateSize()
 
 	newState := state{
 		segments:      &immutable.SortedMap[uint64, segmentState]{},
 		nextSegmentID: persisted.NextSegmentID,
+		cursors:       persisted.Cursors,
 	}
 
 	// Get the set of all persisted segments so we can prune it down to just the
 	// unused ones as we go.
-	toDelete, err := w.sf.List()
+	listed, err := w.sf.List()
 	if err != nil {
 		return nil, err
 	}
+	toDelete := make(map[uint64]types.SegmentInfo, len(listed))
+	for ID, baseIndex := range listed {
+		toDelete[ID] = types.SegmentInfo{ID: ID, BaseIndex: baseIndex}
+	}
 
 	// Build the state
 	recoveredTail := false
@@ -168,6 +259,11 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 			if err != nil {
 				return nil, err
 			}
+			tail := si
+			w.recovery.Tail = &tail
+			if rr, ok := sw.(types.TailRecoveryReporter); ok {
+				w.recovery.Discarded = rr.Recovery()
+			}
 			// Set the tail and "reader" for this segment
 			ss := segmentState{
 				SegmentInfo: si,
@@ -219,6 +315,7 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 		if err := w.metaDB.CommitState(newState.Persistent()); err != nil {
 			return nil, err
 		}
+		w.observeMetaStateSize()
 
 		// Create the new segment file
 		w, err := w.sf.Create(si)
@@ -238,12 +335,37 @@ func Open(dir string, opts ...walOpt) (*WAL, error) {
 	// don't need to jump through the mutateState hoops yet!
 	w.s.Store(&newState)
 
-	// Delete any unused segment files left over after a crash.
-	w.deleteSegments(toDelete)
+	// Delete any unused segment files left over after a crash, or move them
+	// aside if they might be the only copy of data the metadata lost track of.
+	if w.quarantine {
+		w.recovery.QuarantinedOrphans = w.quarantineSegments(toDelete)
+		w.pruneQuarantine(time.Now())
+	} else {
+		w.recovery.DeletedOrphans = w.deleteSegments(toDelete)
+	}
+	w.recovery.LastIndex = newState.lastIndex()
+	w.reportRecovery()
+
+	w.hookRunner.recovered(newState.Persistent().Segments)
 
 	// Start the rotation routine
 	go w.runRotate()
 
+	if w.retention.enabled() {
+		go w.runRetention()
+	}
+
+	if w.compaction.enabled() {
+		go w.runCompaction()
+		// There might be work left over from before we were last closed.
+		w.triggerCompaction()
+	}
+
+	if w.prealloc.enabled() {
+		go w.runPrealloc()
+	}
+
+	success = true
 	return w, nil
 }
 
@@ -284,6 +406,7 @@ func (w *WAL) mutateStateLocked(tx stateTxn) error {
 	if err := w.metaDB.CommitState(newS.Persistent()); err != nil {
 		return err
 	}
+	w.observeMetaStateSize()
 
 	if postCommit != nil {
 		if err := postCommit(); err != nil {
@@ -291,18 +414,45 @@ func (w *WAL) mutateStateLocked(tx stateTxn) error {
 		}
 	}
 
+	// Older states can still reference segments that this transition closes, so
+	// a state's finalizer must not run before those of the states it replaced.
+	// Each replaced state holds a reference to its successor until its own
+	// finalizer has run to enforce that.
+	releaseNew := newS.acquire()
 	w.s.Store(&newS)
-	s.finalizer.Store(fn)
+	s.finalizer.Store(func() {
+		if fn != nil {
+			fn()
+		}
+		releaseNew()
+	})
 	return nil
 }
 
+// observeMetaStateSize updates the encoded state size metric if the meta store
+// reports it.
+func (w *WAL) observeMetaStateSize() {
+	if sr, ok := w.metaDB.(types.StateSizeReporter); ok {
+		w.metrics.MetaStateBytes.Set(float64(sr.EncodedStateSize()))
+	}
+}
+
 // acquireState should be used by all readers to fetch the current state. The
 // returned release func must be called when no further accesses to state or the
 // data within it will be performed to free old files that may have been
 // truncated concurrently.
 func (w *WAL) acquireState() (*state, func()) {
-	s := w.loadState()
-	return s, s.acquire()
+	for {
+		s := w.loadState()
+		release := s.acquire()
+		// If s was replaced between loading and acquiring it, its finalizer might
+		// already have run and closed the segments. Once we've seen it's still
+		// current after acquiring, the finalizer can't run until we release it.
+		if w.loadState() == s {
+			return s, release
+		}
+		release()
+	}
 }
 
 // newSegment creates a types.SegmentInfo with the passed ID and baseIndex, filling in
@@ -312,7 +462,7 @@ func (w *WAL) newSegment(ID, baseIndex uint64) types.SegmentInfo {
 		ID:        ID,
 		BaseIndex: baseIndex,
 		MinIndex:  baseIndex,
-		SizeLimit: uint32(w.segmentSize),
+		SizeLimit: uint64(w.segmentSize),
 
 		CreateTime: time.Now(),
 	}
@@ -340,14 +490,30 @@ func (w *WAL) LastIndex() (uint64, error) {
 
 // GetLog gets a log entry at a given index.
 func (w *WAL) GetLog(index uint64, log *types.LogEntry) error {
+	return w.GetLogContext(context.Background(), index, log)
+}
+
+// GetLogContext is like GetLog but returns ctx.Err() if ctx is done before the
+// read starts. Reads never wait for locks so there is nothing to cancel once
+// the read is in progress.
+func (w *WAL) GetLogContext(ctx context.Context, index uint64, log *types.LogEntry) error {
 	if err := w.checkClosed(); err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The cache generation must be read before acquiring the state, see
+	// entryCache.
+	var gen uint64
+	if w.entryCache != nil {
+		gen = w.entryCache.generation()
+	}
 	s, release := w.acquireState()
 	defer release()
 	w.metrics.EntriesRead.Inc()
 
-	if err := s.getLog(index, log); err != nil {
+	if err := w.readLog(s, gen, index, log); err != nil {
 		return err
 	}
 	log.Index = index
@@ -355,8 +521,44 @@ func (w *WAL) GetLog(index uint64, log *types.LogEntry) error {
 	return nil
 }
 
+// segmentInfo returns the info of the segment holding index, or false if index
+// isn't in the log.
+func (w *WAL) segmentInfo(index uint64) (types.SegmentInfo, bool) {
+	s, release := w.acquireState()
+	defer release()
+	seg, ok := s.findSegment(index)
+	return seg.SegmentInfo, ok
+}
+
+// readLog reads the entry at index from the entry cache if it's enabled and
+// the entry is in s, or else from the segments in s.
+func (w *WAL) readLog(s *state, gen uint64, index uint64, log *types.LogEntry) error {
+	if w.entryCache == nil {
+		return s.getLog(index, log)
+	}
+	// The cache might still hold entries truncated since s was loaded.
+	if index >= s.firstIndex() && index <= s.lastIndex() && w.entryCache.get(index, log) {
+		w.metrics.EntryCacheHits.Inc()
+		return nil
+	}
+	w.metrics.EntryCacheMisses.Inc()
+	if err := s.getLog(index, log); err != nil {
+		return err
+	}
+	w.entryCache.add(gen, types.LogEntry{Index: index, Data: log.Data})
+	return nil
+}
+
 // StoreLogs stores multiple log entries.
 func (w *WAL) StoreLogs(encoded []types.LogEntry) error {
+	return w.StoreLogsContext(context.Background(), encoded)
+}
+
+// StoreLogsContext is like StoreLogs but gives up and returns ctx.Err() if ctx
+// is done while waiting for the write lock or for a segment rotation to
+// complete. Once entries start being written to the segment the append runs to
+// completion so a cancelled call never leaves a partially committed batch.
+func (w *WAL) StoreLogsContext(ctx context.Context, encoded []types.LogEntry) error {
 	if err := w.checkClosed(); err != nil {
 		return err
 	}
@@ -364,16 +566,89 @@ func (w *WAL) StoreLogs(encoded []types.LogEntry) error {
 		return nil
 	}
 
-	w.writeMu.Lock()
+	if err := w.lockWriteRotatedContext(ctx); err != nil {
+		return err
+	}
 	defer w.writeMu.Unlock()
 
-	awaitCh := w.awaitRotate
-	if awaitCh != nil {
+	// Last chance to bail out before we start modifying anything.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return w.storeLogsLocked(encoded)
+}
+
+// lockWriteRotatedContext is like lockWriteContext but also waits for any
+// pending background rotation to complete. Anything that writes to or replaces
+// the tail segment must use it since the rotation would otherwise seal the wrong
+// tail once it gets the lock.
+func (w *WAL) lockWriteRotatedContext(ctx context.Context) error {
+	if err := w.lockWriteContext(ctx); err != nil {
+		return err
+	}
+	for w.awaitRotate != nil {
 		// We managed to race for writeMu with the background rotate operation which
 		// needs to complete first. Wait for it to complete.
+		awaitCh := w.awaitRotate
 		w.writeMu.Unlock()
-		<-awaitCh
+		select {
+		case <-awaitCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := w.lockWriteContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockWriteContext acquires writeMu unless ctx is done first in which case
+// ctx.Err() is returned and the lock is not held.
+func (w *WAL) lockWriteContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		// Context can never be cancelled, no need for the extra goroutine.
 		w.writeMu.Lock()
+		return nil
+	}
+	if w.writeMu.TryLock() {
+		return nil
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		w.writeMu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// The goroutine will still get the lock eventually, hand it straight
+		// back when it does.
+		go func() {
+			<-locked
+			w.writeMu.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// storeLogsLocked appends encoded to the tail. writeMu must be held and there
+// must be no rotation in progress.
+func (w *WAL) storeLogsLocked(encoded []types.LogEntry) error {
+	// If the tail is sealed even though no rotation is in progress then the
+	// last rotation failed, for example because the disk was full. Retry it now
+	// so that appends can resume once the problem is resolved.
+	sealed, indexStart, err := w.loadState().tail.Sealed()
+	if err != nil {
+		return err
+	}
+	if sealed {
+		if err := w.rotateSegmentLocked(indexStart); err != nil {
+			return err
+		}
 	}
 
 	s, release := w.acquireState()
@@ -421,35 +696,124 @@ func (w *WAL) StoreLogs(encoded []types.LogEntry) error {
 		if lastIdx > 0 && l.Index != (lastIdx+1) {
 			return fmt.Errorf("non-monotonic log entries: tried to append index %d after %d", l.Index, lastIdx)
 		}
+		if len(l.Data) > w.maxEntrySize {
+			return fmt.Errorf("%w: entry %d is %d bytes, the max is %d", ErrTooBig, l.Index, len(l.Data), w.maxEntrySize)
+		}
 		lastIdx = l.Index
 		nBytes += uint64(len(encoded[i].Data))
 	}
-	if err := s.tail.Append(encoded); err != nil {
+	if err := w.checkDiskReserve(nBytes, time.Now()); err != nil {
+		return err
+	}
+	err = s.tail.Append(encoded)
+	if errors.Is(err, ErrSealed) {
+		// The tail was created before the max entry size was raised and can't
+		// hold entries this big so it sealed itself. Rotate and retry in a new
+		// segment.
+		_, sealedIndexStart, sealErr := s.tail.Sealed()
+		if sealErr != nil {
+			return sealErr
+		}
+		if err := w.rotateSegmentLocked(sealedIndexStart); err != nil {
+			return err
+		}
+		s2, release2 := w.acquireState()
+		defer release2()
+		s = s2
+		err = s.tail.Append(encoded)
+	}
+	if err != nil {
 		return err
 	}
 	w.metrics.Appends.Inc()
 	w.metrics.EntriesWritten.Add(float64(len(encoded)))
 	w.metrics.BytesWritten.Add(float64(nBytes))
+	if w.entryCache != nil {
+		w.entryCache.add(w.entryCache.generation(), encoded...)
+	}
 
 	// Check if we need to roll logs
-	sealed, indexStart, err := s.tail.Sealed()
+	sealed, indexStart, err = s.tail.Sealed()
 	if err != nil {
 		return err
 	}
 	if sealed {
 		// Async rotation to allow caller to do more work while we mess with files.
 		w.triggerRotateLocked(indexStart)
+	} else {
+		w.maybePreallocLocked(s)
 	}
 	return nil
 }
 
+// SetStable durably stores a small value under key in the MetaStore, replacing
+// any previous value. A nil value removes the key. It doesn't return until the
+// value has been fsynced, so it's suitable for things like raft's current term
+// and vote which must never go backwards after a crash. Stable values are
+// independent of the log and aren't affected by truncations.
+func (w *WAL) SetStable(key []byte, value []byte) error {
+	if err := w.checkClosed(); err != nil {
+		return err
+	}
+	w.metrics.StableSets.Inc()
+	return w.metaDB.SetStable(key, value)
+}
+
+// GetStable returns the value stored under key or nil if it isn't set.
+func (w *WAL) GetStable(key []byte) ([]byte, error) {
+	if err := w.checkClosed(); err != nil {
+		return nil, err
+	}
+	w.metrics.StableGets.Inc()
+	return w.metaDB.GetStable(key)
+}
+
+// SetUint64 durably stores val under key with the same guarantees as
+// SetStable.
+func (w *WAL) SetUint64(key []byte, val uint64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], val)
+	return w.SetStable(key, buf[:])
+}
+
+// GetUint64 returns the value stored under key by SetUint64 or zero if it
+// isn't set.
+func (w *WAL) GetUint64(key []byte) (uint64, error) {
+	raw, err := w.GetStable(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) == 0 {
+		// Not set, return zero per interface contract
+		return 0, nil
+	}
+	if len(raw) != 8 {
+		return 0, fmt.Errorf("GetUint64 called on a non-uint64 key")
+	}
+	return binary.LittleEndian.Uint64(raw), nil
+}
+
+// TruncateFront truncates the front of the log by removing all entries that
+// are before the provided `index`. In other words the entry at `index` becomes
+// the first entry in the log.
 func (w *WAL) TruncateFront(index uint64) error {
+	return w.TruncateFrontContext(context.Background(), index)
+}
+
+// TruncateFrontContext is like TruncateFront but returns ctx.Err() without
+// truncating anything if ctx is done while waiting for the write lock.
+func (w *WAL) TruncateFrontContext(ctx context.Context, index uint64) error {
 	err := func() error {
 		if err := w.checkClosed(); err != nil {
 			return err
 		}
-		w.writeMu.Lock()
+		if err := w.lockWriteRotatedContext(ctx); err != nil {
+			return err
+		}
 		defer w.writeMu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		s, release := w.acquireState()
 		defer release()
@@ -458,6 +822,11 @@ func (w *WAL) TruncateFront(index uint64) error {
 			// no-op.
 			return nil
 		}
+		if w.cursorGuard {
+			if min, ok := s.minCursorIndex(); ok && index > min+1 {
+				return fmt.Errorf("%w: can't truncate front to %d, lowest cursor has committed %d", ErrCursorBehind, index, min)
+			}
+		}
 		// Note that lastIndex is not checked here to allow for a WAL "reset".
 		// e.g. if the last index is currently 5, and a TruncateFront(10) call
 		// comes in, this is a valid truncation, resulting in an empty WAL with
@@ -465,19 +834,33 @@ func (w *WAL) TruncateFront(index uint64) error {
 		// StoreLogs, the firstIndex will be set to the index of the first log
 		// (special case with empty WAL).
 
-		return w.truncateHeadLocked(index)
+		return w.truncateHeadLocked(index, "front")
 	}()
 	w.metrics.Truncations.WithLabelValues("front", fmt.Sprintf("%t", err == nil))
 	return err
 }
 
+// TruncateBack truncates the back of the log by removing all entries that are
+// after the provided `index`. In other words the entry at `index` becomes the
+// last entry in the log.
 func (w *WAL) TruncateBack(index uint64) error {
+	return w.TruncateBackContext(context.Background(), index)
+}
+
+// TruncateBackContext is like TruncateBack but returns ctx.Err() without
+// truncating anything if ctx is done while waiting for the write lock.
+func (w *WAL) TruncateBackContext(ctx context.Context, index uint64) error {
 	err := func() error {
 		if err := w.checkClosed(); err != nil {
 			return err
 		}
-		w.writeMu.Lock()
+		if err := w.lockWriteRotatedContext(ctx); err != nil {
+			return err
+		}
 		defer w.writeMu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		s, release := w.acquireState()
 		defer release()
@@ -538,6 +921,8 @@ func (w *WAL) runRotate() {
 }
 
 func (w *WAL) rotateSegmentLocked(indexStart uint64) error {
+	var sealed types.SegmentInfo
+	var reopened io.Closer
 	txn := func(newState *state) (func(), func() error, error) {
 		// Mark current tail as sealed in segments
 		tail := newState.getTailInfo()
@@ -553,16 +938,51 @@ func (w *WAL) rotateSegmentLocked(indexStart uint64) error {
 		tail.SealTime = time.Now()
 		tail.MaxIndex = newState.tail.LastIndex()
 		tail.IndexStart = indexStart
+		recordSealedSize(&tail.SegmentInfo, newState.tail)
 		w.metrics.LastSegmentAgeSeconds.Set(tail.SealTime.Sub(tail.CreateTime).Seconds())
 
 		// Update the old tail with the seal time etc.
 		newState.segments = newState.segments.Set(tail.BaseIndex, *tail)
+		sealed = tail.SegmentInfo
 
 		post, err := w.createNextSegment(newState)
-		return nil, post, err
+		if err != nil {
+			return nil, nil, err
+		}
+		var fin func()
+		if w.mmap {
+			reopened, fin = w.reopenSealed(newState, *tail)
+		}
+		return fin, post, nil
 	}
 	w.metrics.SegmentRotations.Inc()
-	return w.mutateStateLocked(txn)
+	if err := w.mutateStateLocked(txn); err != nil {
+		w.closeSegments([]io.Closer{reopened})
+		return err
+	}
+	if next := w.loadState().getTailInfo(); next != nil {
+		w.hookRunner.rotated(sealed, next.SegmentInfo)
+	}
+	w.triggerCompaction()
+	return nil
+}
+
+// reopenSealed replaces the reader of seg, which was just sealed by rotation,
+// in newState with one opened by the SegmentFiler. It returns the new reader
+// and a finalizer that closes the old tail writer. If the segment can't be
+// reopened reads keep going through the writer and both are nil.
+func (w *WAL) reopenSealed(newState *state, seg segmentState) (io.Closer, func()) {
+	r, err := w.sf.Open(seg.SegmentInfo)
+	if err != nil {
+		level.Warn(w.logger).Log("msg", "failed to reopen sealed segment", "id", seg.ID, "err", err)
+		return nil, nil
+	}
+	old := seg.r
+	seg.r = r
+	newState.segments = newState.segments.Set(seg.BaseIndex, seg)
+	return r, func() {
+		w.closeSegments([]io.Closer{old})
+	}
 }
 
 // createNextSegment is passes a mutable copy of the new state ready to have a
@@ -603,6 +1023,10 @@ func (w *WAL) createNextSegment(newState *state) (func() error, error) {
 			return err
 		}
 		newState.tail = sw
+		// Prepare the segment after this one once it fills up.
+		w.prealloc.requested = false
+		// Creating the file may have allocated its whole size.
+		w.freeSpaceAt = time.Time{}
 
 		// Also cache the reader/log getter which is also the writer. We don't bother
 		// reopening read only since we assume we have exclusive access anyway and
@@ -640,7 +1064,7 @@ func (w *WAL) resetEmptyFirstSegmentBaseIndex(newBaseIndex uint64) error {
 			newState.tail = nil
 			fin = func() {
 				w.closeSegments([]io.Closer{tailSeg.r})
-				w.deleteSegments(map[uint64]uint64{tailSeg.ID: tailSeg.BaseIndex})
+				w.deleteSegments(map[uint64]types.SegmentInfo{tailSeg.ID: tailSeg.SegmentInfo})
 			}
 		}
 
@@ -659,12 +1083,14 @@ func (w *WAL) resetEmptyFirstSegmentBaseIndex(newBaseIndex uint64) error {
 	return w.mutateStateLocked(txn)
 }
 
-func (w *WAL) truncateHeadLocked(newMin uint64) error {
+// truncateHeadLocked removes all entries before newMin. typ is used to label
+// metrics and hooks.
+func (w *WAL) truncateHeadLocked(newMin uint64, typ string) error {
 	txn := stateTxn(func(newState *state) (func(), func() error, error) {
 		oldLastIndex := newState.lastIndex()
 
 		// Iterate the segments to find any that are entirely deleted.
-		toDelete := make(map[uint64]uint64)
+		toDelete := make(map[uint64]types.SegmentInfo)
 		toClose := make([]io.Closer, 0, 1)
 		it := newState.segments.Iterator()
 		var head *segmentState
@@ -687,7 +1113,7 @@ func (w *WAL) truncateHeadLocked(newMin uint64) error {
 				break
 			}
 
-			toDelete[seg.ID] = seg.BaseIndex
+			toDelete[seg.ID] = seg.SegmentInfo
 			toClose = append(toClose, seg.r)
 			newState.segments = newState.segments.Delete(seg.BaseIndex)
 			nTruncated += (maxIdx - seg.MinIndex + 1) // +1 because MaxIndex is inclusive
@@ -715,7 +1141,7 @@ func (w *WAL) truncateHeadLocked(newMin uint64) error {
 			}
 			postCommit = pc
 		}
-		w.metrics.EntriesTruncated.WithLabelValues("front").Add(float64(nTruncated))
+		w.metrics.EntriesTruncated.WithLabelValues(typ).Add(float64(nTruncated))
 
 		// Return a finalizer that will be called when all readers are done with the
 		// segments in the current state to close and delete old segments.
@@ -726,13 +1152,25 @@ func (w *WAL) truncateHeadLocked(newMin uint64) error {
 		return fin, postCommit, nil
 	})
 
-	return w.mutateStateLocked(txn)
+	err := w.mutateStateLocked(txn)
+	if w.entryCache != nil {
+		// Even on error as the state might have changed. If the log is now empty
+		// the next append can start at a lower index so the cache must not hold
+		// anything truncated.
+		w.entryCache.removeBefore(newMin)
+	}
+	if err != nil {
+		return err
+	}
+	w.hookRunner.truncated(typ, newMin, w.loadState().Persistent().Segments)
+	w.triggerCompaction()
+	return nil
 }
 
 func (w *WAL) truncateTailLocked(newMax uint64) error {
 	txn := stateTxn(func(newState *state) (func(), func() error, error) {
 		// Reverse iterate the segments to find any that are entirely deleted.
-		toDelete := make(map[uint64]uint64)
+		toDelete := make(map[uint64]types.SegmentInfo)
 		toClose := make([]io.Closer, 0, 1)
 		it := newState.segments.Iterator()
 		it.Last()
@@ -751,7 +1189,7 @@ func (w *WAL) truncateTailLocked(newMax uint64) error {
 				maxIdx = newState.lastIndex()
 			}
 
-			toDelete[seg.ID] = seg.BaseIndex
+			toDelete[seg.ID] = seg.SegmentInfo
 			toClose = append(toClose, seg.r)
 			newState.segments = newState.segments.Delete(seg.BaseIndex)
 			nTruncated += (maxIdx - seg.MinIndex + 1) // +1 becuase MaxIndex is inclusive
@@ -766,6 +1204,7 @@ func (w *WAL) truncateTailLocked(newMax uint64) error {
 			if tail.SealTime.IsZero() {
 				tail.SealTime = time.Now()
 				maxIdx = newState.lastIndex()
+				recordSealedSize(&tail.SegmentInfo, newState.tail)
 			}
 			// Update the MaxIndex
 
@@ -792,17 +1231,35 @@ func (w *WAL) truncateTailLocked(newMax uint64) error {
 		return fin, pc, nil
 	})
 
-	return w.mutateStateLocked(txn)
+	err := w.mutateStateLocked(txn)
+	if w.entryCache != nil {
+		// Even on error as the state might have changed. Entries after newMax can
+		// be appended again with different data.
+		w.entryCache.removeAfter(newMax)
+	}
+	if err != nil {
+		return err
+	}
+	w.hookRunner.truncated("back", newMax, w.loadState().Persistent().Segments)
+	w.triggerCompaction()
+	return nil
 }
 
-func (w *WAL) deleteSegments(toDelete map[uint64]uint64) {
-	for ID, baseIndex := range toDelete {
-		if err := w.sf.Delete(baseIndex, ID); err != nil {
+// deleteSegments deletes the segment files and returns the ones that were
+// deleted successfully.
+func (w *WAL) deleteSegments(toDelete map[uint64]types.SegmentInfo) []types.SegmentInfo {
+	var deleted []types.SegmentInfo
+	for ID, info := range toDelete {
+		if err := w.sf.Delete(info.BaseIndex, ID); err != nil {
 			// This is not fatal. We can continue just old files might need manual
 			// cleanup somehow.
-			level.Error(w.logger).Log("msg", "failed to delete old segment", "baseIndex", baseIndex, "id", ID, "err", err)
+			level.Error(w.logger).Log("msg", "failed to delete old segment", "baseIndex", info.BaseIndex, "id", ID, "err", err)
+			continue
 		}
+		w.hookRunner.segmentDeleted(info)
+		deleted = append(deleted, info)
 	}
+	return deleted
 }
 
 func (w *WAL) closeSegments(toClose []io.Closer) {
@@ -816,6 +1273,45 @@ func (w *WAL) closeSegments(toClose []io.Closer) {
 	}
 }
 
+// spaceReporter is implemented by SegmentFilers that can report free space
+// such as segment.Filer.
+type spaceReporter interface {
+	FreeSpace() (uint64, error)
+}
+
+// freeSpaceRefreshInterval is how long checkDiskReserve trusts the cached free
+// space. Our own appends are accounted for so this only bounds how long space
+// used by other processes goes unnoticed.
+const freeSpaceRefreshInterval = time.Second
+
+// checkDiskReserve returns an error wrapping ErrDiskFull if appending n more
+// bytes would eat into the configured free space reserve. Truncations never
+// check the reserve so operators can always free up space.
+//
+// The free space is cached and only asked for again once it's older than
+// freeSpaceRefreshInterval, after a segment file was created, or before
+// rejecting an append so space freed since the last check is never missed.
+// writeMu MUST be held.
+func (w *WAL) checkDiskReserve(n uint64, now time.Time) error {
+	if w.diskReserve == 0 {
+		return nil
+	}
+	if w.freeSpaceAt.IsZero() || now.Sub(w.freeSpaceAt) >= freeSpaceRefreshInterval ||
+		w.freeSpace < w.diskReserve+n {
+		free, err := w.sf.(spaceReporter).FreeSpace()
+		if err != nil {
+			return fmt.Errorf("failed to check free space: %w", err)
+		}
+		w.freeSpace, w.freeSpaceAt = free, now
+	}
+	if w.freeSpace < w.diskReserve+n {
+		return fmt.Errorf("%w: %d bytes free, appending %d bytes would exceed the %d byte reserve",
+			ErrDiskFull, w.freeSpace, n, w.diskReserve)
+	}
+	w.freeSpace -= n
+	return nil
+}
+
 func (w *WAL) checkClosed() error {
 	closed := atomic.LoadUint32(&w.closed)
 	if closed != 0 {
@@ -836,6 +1332,19 @@ func (w *WAL) Close() error {
 		return nil
 	}
 
+	err := w.shutdown()
+
+	// Don't let a preallocation in progress create files after we return.
+	if w.prealloc.enabled() {
+		<-w.prealloc.done
+	}
+
+	// Deliver any outstanding hooks now we no longer hold the write lock.
+	w.hookRunner.close()
+	return err
+}
+
+func (w *WAL) shutdown() error {
 	// Wait for writes
 	w.writeMu.Lock()
 	defer w.writeMu.Unlock()
@@ -845,6 +1354,7 @@ func (w *WAL) Close() error {
 	w.awaitRotate = nil
 	// Awake and terminate the runRotate
 	close(w.triggerRotate)
+	close(w.shutdownCh)
 
 	// Replace state with nil state
 	s := w.loadState()
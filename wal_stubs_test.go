@@ -63,6 +63,7 @@ func segFull() testStorageOpt {
 		seg.mutate(func(newState *testSegmentState) error {
 			newState.info.SealTime = time.Now()
 			newState.info.MaxIndex = newState.info.BaseIndex + uint64(len(es)) - 1
+			newState.info.Size = uint64(4 * len(es))
 			return nil
 		})
 		ts.setupMaxIndex += uint64(seg.numLogs())
@@ -205,6 +206,9 @@ type testStorage struct {
 	metaState types.PersistentState
 	stable    map[string][]byte
 
+	// freeSpace is reported by FreeSpace.
+	freeSpace uint64
+
 	// errors that can be set by test to force subsequent calls to return the
 	// error.
 	loadErr, commitErr, getStableErr, setStableErr,
@@ -353,6 +357,9 @@ func (ts *testStorage) Create(info types.SegmentInfo) (types.SegmentWriter, erro
 	if ok {
 		return nil, fmt.Errorf("segment ID %d already exists", info.ID)
 	}
+	if ts.createErr != nil {
+		return nil, ts.createErr
+	}
 	sw := &testSegment{
 		limit: 100, // Set a size limit or it will be immediately full!
 	}
@@ -361,7 +368,15 @@ func (ts *testStorage) Create(info types.SegmentInfo) (types.SegmentWriter, erro
 		logs: &immutable.SortedMap[uint64, types.LogEntry]{},
 	})
 	ts.segments[info.ID] = sw
-	return sw, ts.createErr
+	return sw, nil
+}
+
+// FreeSpace implements spaceReporter
+func (ts *testStorage) FreeSpace() (uint64, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.recordCall("FreeSpace")
+	return ts.freeSpace, nil
 }
 
 // RecoverTail implements segmentFiler
@@ -380,6 +395,8 @@ func (ts *testStorage) RecoverTail(info types.SegmentInfo) (types.SegmentWriter,
 	if ts.recoverErr != nil {
 		return nil, ts.recoverErr
 	}
+	// A real filer would open the file again after the last WAL closed it.
+	sw.reopen()
 	return sw, nil
 }
 
@@ -488,6 +505,13 @@ func (s *testSegment) Close() error {
 	})
 }
 
+func (s *testSegment) reopen() {
+	s.mutate(func(newState *testSegmentState) error {
+		newState.closed = false
+		return nil
+	})
+}
+
 func (s *testSegment) GetLog(idx uint64, le *types.LogEntry) error {
 	state := s.loadState()
 	if state.closed {
@@ -538,6 +562,11 @@ func (s *testSegment) Sealed() (bool, uint64, error) {
 	return state.logs.Len() >= s.limit, 12345, nil
 }
 
+// Size pretends each entry takes up 4 bytes.
+func (s *testSegment) Size() uint64 {
+	return uint64(4 * s.loadState().logs.Len())
+}
+
 func (s *testSegment) LastIndex() uint64 {
 	state := s.loadState()
 	if state.closed {
@@ -5,12 +5,16 @@ package wal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/polarsignals/wal/fs"
+	"github.com/polarsignals/wal/segment"
 	"github.com/polarsignals/wal/types"
 	"github.com/stretchr/testify/require"
 )
@@ -842,3 +846,480 @@ func TestClose(t *testing.T) {
 	err = w.TruncateBack(2)
 	require.ErrorIs(t, err, ErrClosed)
 }
+
+func TestGetLogBelowFirstIndex(t *testing.T) {
+	w, err := Open(t.TempDir())
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Truncating within the tail segment must hide the removed entries even
+	// though they are still in the tail's file.
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 10)))
+	require.NoError(t, w.TruncateFront(5))
+
+	var log types.LogEntry
+	require.ErrorIs(t, w.GetLog(4, &log), ErrNotFound)
+	require.NoError(t, w.GetLog(5, &log))
+	require.Equal(t, uint64(5), log.Index)
+}
+
+func TestTruncateBackDuringRotation(t *testing.T) {
+	w, err := Open(t.TempDir(), WithSegmentSize(8*1024))
+	require.NoError(t, err)
+	defer w.Close()
+
+	// One big batch fills the tail and triggers a background rotation. The
+	// truncation must wait for it rather than letting it seal the new tail the
+	// truncation creates.
+	require.NoError(t, w.StoreLogs(makeLogEntries(1, 500)))
+	require.NoError(t, w.TruncateBack(449))
+	require.NoError(t, w.StoreLogs(makeLogEntries(450, 10)))
+
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(459), last)
+}
+
+func TestMaxEntrySize(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, WithMaxEntrySize(1024))
+	require.NoError(t, err)
+
+	require.NoError(t, w.StoreLogs([]types.LogEntry{{Index: 1, Data: make([]byte, 1024)}}))
+	err = w.StoreLogs([]types.LogEntry{{Index: 2, Data: make([]byte, 1025)}})
+	require.ErrorIs(t, err, ErrTooBig)
+	require.NoError(t, w.Close())
+
+	if testing.Short() {
+		t.Skip("skipping entries larger than a frame in short mode")
+	}
+
+	// Raising the limit past the frame size works on a WAL whose tail was
+	// written without continuations. The tail gets rotated.
+	w, err = Open(dir, WithMaxEntrySize(2*segment.MaxFrameSize))
+	require.NoError(t, err)
+	defer w.Close()
+
+	big := make([]byte, segment.MaxFrameSize+10)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	require.NoError(t, w.StoreLogs([]types.LogEntry{{Index: 2, Data: big}}))
+	require.Len(t, w.loadState().Persistent().Segments, 2)
+
+	var got types.LogEntry
+	require.NoError(t, w.GetLog(2, &got))
+	require.Equal(t, big, got.Data)
+	require.NoError(t, w.GetLog(1, &got))
+	require.Len(t, got.Data, 1024)
+}
+
+func TestSegmentSizeLimits(t *testing.T) {
+	for _, size := range []int{-1, 1, MinSegmentSize - 1} {
+		_, err := Open(t.TempDir(), WithSegmentSize(size))
+		require.ErrorContains(t, err, "segment size", "size=%d", size)
+	}
+	if strconv.IntSize == 64 {
+		max := uint64(MaxSegmentSize)
+		_, err := Open(t.TempDir(), WithSegmentSize(int(max+1)))
+		require.ErrorContains(t, err, "segment size")
+	}
+
+	w, err := Open(t.TempDir(), WithSegmentSize(MinSegmentSize))
+	require.NoError(t, err)
+	defer w.Close()
+	for i := uint64(1); i <= 20; i++ {
+		require.NoError(t, w.StoreLogs([]types.LogEntry{{Index: i, Data: make([]byte, 100)}}))
+	}
+	require.Greater(t, len(w.loadState().Persistent().Segments), 1)
+}
+
+func TestMmap(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir, WithSegmentSize(8*1024), WithMmap())
+	require.NoError(t, err)
+
+	for i := uint64(1); i <= 2000; i += 10 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(i, 10)))
+	}
+	// Wait for any pending rotation.
+	require.NoError(t, w.StoreLogs(makeLogEntries(2001, 1)))
+
+	// Segments sealed by rotation are read through a reopened reader rather
+	// than the old tail writer.
+	s := w.loadState()
+	require.Greater(t, s.segments.Len(), 2)
+	it := s.segments.Iterator()
+	for !it.Done() {
+		_, seg, _ := it.Next()
+		if seg.SealTime.IsZero() {
+			continue
+		}
+		require.IsType(t, &segment.Reader{}, seg.r, "segment %d", seg.ID)
+	}
+
+	check := func(w *WAL, first uint64) {
+		t.Helper()
+		var le types.LogEntry
+		for i := first; i <= 2001; i++ {
+			require.NoError(t, w.GetLog(i, &le))
+			validateLogEntry(t, le)
+		}
+	}
+	check(w, 1)
+
+	// Readers holding an old state can still read segments truncated away.
+	old, release := w.acquireState()
+	require.NoError(t, w.TruncateFront(1500))
+	var le types.LogEntry
+	require.NoError(t, old.getLog(1, &le))
+	require.Equal(t, "Log entry 1", string(le.Data))
+	release()
+
+	check(w, 1500)
+	require.NoError(t, w.Close())
+
+	w, err = Open(dir, WithSegmentSize(8*1024), WithMmap())
+	require.NoError(t, err)
+	defer w.Close()
+	check(w, 1500)
+}
+
+func TestIndexCache(t *testing.T) {
+	// A budget too small to hold any index block must still read correctly.
+	for _, budget := range []uint64{1, 1024 * 1024} {
+		dir := t.TempDir()
+		w, err := Open(dir, WithSegmentSize(8*1024), WithIndexCache(budget))
+		require.NoError(t, err)
+		for i := uint64(1); i <= 1000; i += 10 {
+			require.NoError(t, w.StoreLogs(makeLogEntries(i, 10)))
+		}
+		require.NoError(t, w.Close())
+
+		w, err = Open(dir, WithSegmentSize(8*1024), WithIndexCache(budget))
+		require.NoError(t, err)
+		var le types.LogEntry
+		for i := uint64(1); i <= 1000; i++ {
+			require.NoError(t, w.GetLog(i, &le), "budget=%d", budget)
+			validateLogEntry(t, le)
+		}
+		require.NoError(t, w.Close())
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	_, w, err := testOpenWAL(t, []testStorageOpt{segTail(10)}, nil, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Hold the write lock so every writer has to wait.
+	w.writeMu.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = w.StoreLogsContext(ctx, makeLogEntries(11, 5))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = w.TruncateFrontContext(ctx, 5)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = w.TruncateBackContext(ctx, 5)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Simulate a rotation in progress: a writer that gets the lock must then wait
+	// for the rotation and should also honor cancellation while doing so.
+	rotateDone := make(chan struct{})
+	w.awaitRotate = rotateDone
+	w.writeMu.Unlock()
+
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel2()
+	err = w.StoreLogsContext(ctx2, makeLogEntries(11, 5))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	w.writeMu.Lock()
+	w.awaitRotate = nil
+	close(rotateDone)
+	w.writeMu.Unlock()
+
+	// Nothing was written or truncated by the cancelled calls.
+	first, err := w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 1, int(first))
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 10, int(last))
+
+	// An already cancelled context fails fast even with nothing to wait for.
+	cancelled, cancel3 := context.WithCancel(context.Background())
+	cancel3()
+	var log types.LogEntry
+	require.ErrorIs(t, w.GetLogContext(cancelled, 1, &log), context.Canceled)
+	require.ErrorIs(t, w.StoreLogsContext(cancelled, makeLogEntries(11, 1)), context.Canceled)
+
+	// The lock was not leaked by any of the cancelled calls.
+	require.NoError(t, w.StoreLogsContext(context.Background(), makeLogEntries(11, 5)))
+	require.NoError(t, w.GetLogContext(context.Background(), 15, &log))
+	validateLogEntry(t, log)
+	require.NoError(t, w.TruncateBackContext(context.Background(), 12))
+	require.NoError(t, w.TruncateFrontContext(context.Background(), 2))
+
+	first, err = w.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, 2, int(first))
+	last, err = w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 12, int(last))
+}
+
+func TestDiskReserve(t *testing.T) {
+	ts, w, err := testOpenWAL(t, []testStorageOpt{
+		segFull(),
+		segTail(10),
+		func(ts *testStorage) { ts.freeSpace = 1 << 20 },
+	}, []walOpt{WithDiskReserve(4096)}, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(111, 5)))
+
+	// Drop below the reserve. Appends go by the cached free space until it's
+	// refreshed.
+	ts.mu.Lock()
+	ts.freeSpace = 4096
+	ts.mu.Unlock()
+	require.NoError(t, w.StoreLogs(makeLogEntries(116, 5)))
+
+	w.writeMu.Lock()
+	w.freeSpaceAt = w.freeSpaceAt.Add(-freeSpaceRefreshInterval)
+	w.writeMu.Unlock()
+	err = w.StoreLogs(makeLogEntries(121, 5))
+	require.ErrorIs(t, err, ErrDiskFull)
+
+	// Truncations are still allowed so operators can recover.
+	require.NoError(t, w.TruncateFront(50))
+	require.NoError(t, w.TruncateBack(114))
+
+	ts.mu.Lock()
+	ts.freeSpace = 1 << 20
+	ts.mu.Unlock()
+
+	require.NoError(t, w.StoreLogs(makeLogEntries(115, 5)))
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, 119, int(last))
+}
+
+func TestDiskReserveCachesFreeSpace(t *testing.T) {
+	ts, w, err := testOpenWAL(t, []testStorageOpt{
+		segTail(10),
+		func(ts *testStorage) { ts.freeSpace = 1 << 20 },
+	}, []walOpt{WithDiskReserve(4096)}, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	calls := func() int {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		return ts.calls["FreeSpace"]
+	}
+	before := calls()
+	for idx := uint64(11); idx <= 20; idx++ {
+		require.NoError(t, w.StoreLogs(makeLogEntries(idx, 1)))
+	}
+	require.Equal(t, before+1, calls())
+
+	// Our own appends count against the cached value so they can't overrun the
+	// reserve before the next refresh. That refresh happens before rejecting.
+	w.writeMu.Lock()
+	w.freeSpace = 4096 + uint64(len("Log entry 21"))
+	w.writeMu.Unlock()
+	require.NoError(t, w.StoreLogs(makeLogEntries(21, 1)))
+	require.Equal(t, before+1, calls())
+	require.NoError(t, w.StoreLogs(makeLogEntries(22, 1)))
+	require.Equal(t, before+2, calls())
+}
+
+func TestDiskReserveRequiresSpaceReporter(t *testing.T) {
+	_, err := Open(t.TempDir(), WithDiskReserve(4096), WithSegmentFiler(struct{ types.SegmentFiler }{}))
+	require.ErrorContains(t, err, "can report free space")
+}
+
+func TestFailedRotationIsRetried(t *testing.T) {
+	ts, w, err := testOpenWAL(t, []testStorageOpt{segTail(99)}, nil, false)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Creating the next segment fails, e.g. because the disk is full.
+	ts.mu.Lock()
+	ts.createErr = ErrDiskFull
+	ts.mu.Unlock()
+
+	// This append fills and seals the tail but the rotation fails.
+	require.NoError(t, w.StoreLogs(makeLogEntries(100, 1)))
+
+	// The next append retries the rotation which still fails.
+	err = w.StoreLogs(makeLogEntries(101, 1))
+	require.ErrorIs(t, err, ErrDiskFull)
+
+	ts.mu.Lock()
+	ts.createErr = nil
+	ts.mu.Unlock()
+
+	// Now space is available again appends resume.
+	require.NoError(t, w.StoreLogs(makeLogEntries(101, 1)))
+
+	var log types.LogEntry
+	for idx := uint64(1); idx <= 101; idx++ {
+		require.NoError(t, w.GetLog(idx, &log))
+		validateLogEntry(t, log)
+	}
+	ts.assertValidMetaState(t)
+}
+
+func TestFaultInjection(t *testing.T) {
+	mem := fs.NewMemFS()
+	mem.Mkdir("/wal")
+	ffs := fs.NewFaultFS(mem, 42,
+		fs.FaultRule{Op: fs.OpWriteAt, Kind: fs.FaultTornWrite, Probability: 0.02},
+		fs.FaultRule{Op: fs.OpWriteAt, Kind: fs.FaultShortWrite, Probability: 0.02},
+		fs.FaultRule{Op: fs.OpSync, Kind: fs.FaultError, Probability: 0.02},
+		fs.FaultRule{Op: fs.OpCreate, Kind: fs.FaultError, Probability: 0.2},
+	)
+	meta := makeTestStorage()
+
+	open := func() *WAL {
+		t.Helper()
+		// Recovery must succeed even though writes are still failing.
+		w, err := Open("/wal",
+			WithMetaStore(meta),
+			WithSegmentFiler(segment.NewFiler("/wal", ffs)),
+			WithSegmentSize(8*1024),
+		)
+		require.NoError(t, err)
+		return w
+	}
+
+	w := open()
+	acked := uint64(0)
+	for i := 0; i < 2000; i++ {
+		err := w.StoreLogs(makeLogEntries(acked+1, 1+i%5))
+		if err == nil {
+			last, err := w.LastIndex()
+			require.NoError(t, err)
+			acked = last
+			continue
+		}
+		if i%2 == 0 {
+			// Keep going with the same WAL, it must have rolled back the failed
+			// append.
+			continue
+		}
+		// Crash and recover.
+		w.Close()
+		mem.Crash()
+		w = open()
+
+		last, err := w.LastIndex()
+		require.NoError(t, err)
+		require.Equal(t, acked, last, "acknowledged entries lost or unacknowledged ones recovered")
+	}
+	require.NoError(t, w.Close())
+	require.Greater(t, ffs.Injected(), 0)
+
+	ffs.ClearRules()
+	mem.Crash()
+	w = open()
+	defer w.Close()
+
+	last, err := w.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, acked, last)
+	require.Greater(t, acked, uint64(1000))
+
+	var le types.LogEntry
+	for idx := uint64(1); idx <= acked; idx++ {
+		require.NoError(t, w.GetLog(idx, &le))
+		validateLogEntry(t, le)
+	}
+}
+
+func TestStable(t *testing.T) {
+	ts, w, err := testOpenWAL(t, []testStorageOpt{
+		stable("vote", "node-a"),
+		stableInt("term", 3),
+	}, nil, false)
+	require.NoError(t, err)
+
+	got, err := w.GetStable([]byte("vote"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("node-a"), got)
+
+	term, err := w.GetUint64([]byte("term"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), term)
+
+	// Missing keys are nil or zero.
+	got, err = w.GetStable([]byte("missing"))
+	require.NoError(t, err)
+	require.Nil(t, got)
+	n, err := w.GetUint64([]byte("missing"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), n)
+
+	require.NoError(t, w.SetUint64([]byte("term"), 4))
+	term, err = w.GetUint64([]byte("term"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), term)
+
+	require.NoError(t, w.SetStable([]byte("vote"), []byte("node-b")))
+	got, err = w.GetStable([]byte("vote"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("node-b"), got)
+
+	// A non-uint64 value is an error.
+	_, err = w.GetUint64([]byte("vote"))
+	require.ErrorContains(t, err, "non-uint64 key")
+
+	// Errors from the meta store are returned.
+	ts.setStableErr = errors.New("IO error")
+	require.ErrorContains(t, w.SetUint64([]byte("term"), 5), "IO error")
+	ts.getStableErr = errors.New("IO error")
+	_, err = w.GetStable([]byte("vote"))
+	require.ErrorContains(t, err, "IO error")
+
+	require.NoError(t, w.Close())
+	_, err = w.GetStable([]byte("vote"))
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, w.SetStable([]byte("vote"), nil), ErrClosed)
+}
+
+func TestFSOptions(t *testing.T) {
+	opts := fs.Options{Sync: fs.SyncData, DirectIO: true}
+	if _, err := fs.NewWithOptions(opts); err != nil {
+		_, err := Open(t.TempDir(), WithFSOptions(opts))
+		require.Error(t, err)
+		t.Skip(err)
+	}
+
+	dir := t.TempDir()
+	w, err := Open(dir, WithSegmentSize(8*1024), WithFSOptions(opts))
+	require.NoError(t, err)
+	for i := uint64(1); i <= 2000; i += 10 {
+		require.NoError(t, w.StoreLogs(makeLogEntries(i, 10)))
+	}
+	require.NoError(t, w.StoreLogs(makeLogEntries(2001, 1)))
+	require.Greater(t, w.loadState().segments.Len(), 2)
+	require.NoError(t, w.Close())
+
+	w, err = Open(dir, WithSegmentSize(8*1024), WithFSOptions(opts))
+	require.NoError(t, err)
+	defer w.Close()
+	// Appends after recovery rewrite the partial block at the end of the tail.
+	require.NoError(t, w.StoreLogs(makeLogEntries(2002, 10)))
+	var le types.LogEntry
+	for i := uint64(1); i <= 2011; i++ {
+		require.NoError(t, w.GetLog(i, &le))
+		validateLogEntry(t, le)
+	}
+}